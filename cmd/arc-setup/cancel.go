@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2"
+)
+
+// signalContext is cancelled on SIGINT or SIGTERM. After the first signal
+// they are handled as usual again, so a second one kills arc-setup if
+// cleaning up hangs.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	return ctx, stop
+}
+
+// sleepContext sleeps for d, returning early with ctx's error if it is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rollbackTimeout bounds the API requests made while rolling back, which run
+// after the root context has been cancelled.
+const rollbackTimeout = 30 * time.Second
+
+// pendingSetup is what an unfinished setup has created, persisted in state so
+// that an interrupted setup can be resumed or rolled back by the next run.
+type pendingSetup struct {
+	Organization     string `json:"organization"`
+	AppID            string `json:"app_id,omitempty"`
+	AppSlug          string `json:"app_slug,omitempty"`
+	InstallationID   string `json:"installation_id,omitempty"`
+	PrivateKeyRef    string `json:"private_key_ref,omitempty"`
+	WebhookSecretRef string `json:"webhook_secret_ref,omitempty"`
+
+	// KeyFile is the private key downloaded for a registered App, which
+	// rolling back deletes.
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// vars is the part of arc.env the pending setup has decided.
+func (p *pendingSetup) vars(githubHost githubInstance) Vars {
+	return Vars{
+		EnterpriseURL:    githubHost.EnterpriseURL(),
+		AppID:            p.AppID,
+		InstallationID:   p.InstallationID,
+		Organization:     p.Organization,
+		ConfigURL:        githubHost.OrgURL(p.Organization),
+		PrivateKeyRef:    p.PrivateKeyRef,
+		WebhookSecretRef: p.WebhookSecretRef,
+	}
+}
+
+// record saves p to state, so it survives arc-setup exiting.
+func (p *pendingSetup) record(state *State, vars Vars) error {
+	p.AppID = vars.AppID
+	p.InstallationID = vars.InstallationID
+	p.PrivateKeyRef = vars.PrivateKeyRef
+	p.WebhookSecretRef = vars.WebhookSecretRef
+
+	state.Pending = p
+
+	return state.save()
+}
+
+const (
+	pendingResume   = "Resume it"
+	pendingRollback = "Roll it back and start over"
+	pendingIgnore   = "Leave it and start over"
+)
+
+// resumePending handles a setup an earlier run left unfinished, returning it
+// if it should be resumed.
+func resumePending(state *State, githubHost githubInstance) (*pendingSetup, error) {
+	p := state.Pending
+	if p == nil {
+		return nil, nil
+	}
+	if p.AppID == "" {
+		// Nothing was created, so there is nothing to resume.
+		state.Pending = nil
+		return nil, state.save()
+	}
+
+	answer := pendingResume
+	prompt := &survey.Select{
+		Message: fmt.Sprintf("Setup of App %v on %v was interrupted. What should happen to it?", p.AppSlug, p.Organization),
+		Options: []string{pendingResume, pendingRollback, pendingIgnore},
+		Default: pendingResume,
+	}
+	if err := ask(prompt, &answer); err != nil {
+		return nil, err
+	}
+
+	switch answer {
+	case pendingResume:
+		logInfof("Resuming setup of App %v on %v.", p.AppSlug, p.Organization)
+		return p, nil
+	case pendingRollback:
+		rollback(githubHost, p)
+	}
+
+	state.Pending = nil
+
+	return nil, state.save()
+}
+
+const (
+	interruptedKeep     = "Keep it, to resume on the next run"
+	interruptedRollback = "Roll it back"
+)
+
+// interrupted handles setup being cancelled, offering to roll back what it
+// created or keep it for the next run to resume. It returns err, as setup
+// still did not finish.
+func interrupted(state *State, githubHost githubInstance, p *pendingSetup, err error) error {
+	if p == nil || p.AppID == "" {
+		if p != nil && p.Organization != "" {
+			logWarnf("Setup was interrupted before the App was created. If it was created in the browser, delete it at %v.", githubHost.AppSettingsURL(p.Organization, ""))
+		}
+		return err
+	}
+
+	answer := interruptedKeep
+	if output != outputNDJSON {
+		prompt := &survey.Select{
+			Message: fmt.Sprintf("Setup was interrupted after creating App %v. What should happen to it?", p.AppSlug),
+			Options: []string{interruptedKeep, interruptedRollback},
+			Default: interruptedKeep,
+		}
+		if askErr := ask(prompt, &answer); askErr != nil {
+			// Interrupted again: keep everything, so nothing is lost.
+			answer = interruptedKeep
+		}
+	}
+
+	if answer == interruptedRollback {
+		rollback(githubHost, p)
+
+		state.Pending = nil
+		if saveErr := state.save(); saveErr != nil {
+			logWarnf("%v", saveErr)
+		}
+
+		return err
+	}
+
+	// Pending is normally recorded as setup goes, this catches anything since.
+	state.Pending = p
+	if saveErr := state.save(); saveErr != nil {
+		logWarnf("Could not record the interrupted setup, delete App %v at %v: %v", p.AppSlug, githubHost.AppAdvancedURL(p.Organization, p.AppSlug), saveErr)
+		return err
+	}
+	emit(event{
+		Type:         eventSetupInterrupted,
+		Message:      fmt.Sprintf("Setup was interrupted, run arc-setup again to resume setting up App %v", p.AppSlug),
+		AppSlug:      p.AppSlug,
+		Organization: p.Organization,
+	})
+
+	return err
+}
+
+// rollback undoes what p created, as far as it can. GitHub has no API to
+// delete an App, so the user is pointed at where to do it.
+func rollback(githubHost githubInstance, p *pendingSetup) {
+	vars := p.vars(githubHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	if p.InstallationID != "" {
+		if err := uninstall(ctx, githubHost, vars); err != nil {
+			logWarnf("Could not uninstall App %v from %v: %v", p.AppSlug, p.Organization, err)
+		} else {
+			logInfof("Uninstalled App %v from %v.", p.AppSlug, p.Organization)
+		}
+	}
+
+	// Only once uninstalled, which needs the private key.
+	for _, ref := range []string{p.PrivateKeyRef, p.WebhookSecretRef} {
+		if ref == "" {
+			continue
+		}
+		if err := deleteSecret(ctx, ref); err != nil {
+			logWarnf("Could not delete %v, remove it by hand: %v", ref, err)
+		} else {
+			logInfof("Deleted %v.", ref)
+		}
+	}
+
+	if existing, err := loadVars(); err == nil && existing.AppID == p.AppID {
+		removeFile(VarFileName)
+	}
+	if p.KeyFile != "" {
+		removeFile(p.KeyFile)
+	}
+
+	logWarnf("Delete App %v at %v to finish rolling back.", p.AppSlug, githubHost.AppAdvancedURL(p.Organization, p.AppSlug))
+}
+
+func uninstall(ctx context.Context, githubHost githubInstance, vars Vars) error {
+	id, err := strconv.ParseInt(vars.InstallationID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid installation ID %q", vars.InstallationID)
+	}
+
+	client, err := newAppClient(ctx, githubHost, vars)
+	if err != nil {
+		return err
+	}
+
+	return client.deleteInstallation(ctx, id)
+}
+
+func removeFile(name string) {
+	err := files.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		logWarnf("Could not remove %v: %v", name, err)
+		return
+	}
+
+	logInfof("Removed %v.", name)
+}
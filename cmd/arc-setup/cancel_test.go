@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupInterruptedBeforeApp(t *testing.T) {
+	f := newFakeGitHub(t)
+	mem, p := setupFake(t, f, ModeLegacy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.onEnter = cancel
+
+	if err := realMain(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	for _, r := range f.Requests() {
+		if strings.HasPrefix(r, "POST /gamf/code") {
+			t.Errorf("polled for the code after being interrupted: %v", r)
+		}
+	}
+	if _, err := mem.Stat(VarFileName); err == nil {
+		t.Errorf("%v was written", VarFileName)
+	}
+
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Pending != nil {
+		t.Errorf("recorded %+v, with nothing to resume", state.Pending)
+	}
+}
+
+func TestSetupInterruptedResume(t *testing.T) {
+	f := newFakeGitHub(t)
+	_, p := setupFake(t, f, ModeLegacy)
+	p.interruptAt = "Installation ID"
+	p.answers["was interrupted after"] = interruptedKeep
+
+	if err := realMain(context.Background()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Pending == nil || state.Pending.AppID != "42" || state.Pending.AppSlug != f.Slug {
+		t.Fatalf("got pending setup %+v, want App 42", state.Pending)
+	}
+
+	starts := len(f.Requests())
+	p.answers["was interrupted. What"] = pendingResume
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSetup(t, f, true)
+	for _, r := range f.Requests()[starts:] {
+		if strings.HasPrefix(r, "POST /gamf") {
+			t.Errorf("resuming created another App: %v", r)
+		}
+	}
+
+	state, err = loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Pending != nil {
+		t.Errorf("pending setup %+v left behind", state.Pending)
+	}
+}
+
+func TestSetupInterruptedRollback(t *testing.T) {
+	f := newFakeGitHub(t)
+	mem, p := setupFake(t, f, ModeScaleSet)
+	p.interruptAt = "Runner Group"
+	p.answers["was interrupted after"] = interruptedRollback
+
+	if err := realMain(context.Background()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	if !contains(f.Requests(), "DELETE /api/v3/app/installations/7") {
+		t.Errorf("installation was not deleted, requests: %v", f.Requests())
+	}
+	if _, err := mem.Stat("downloads/key.pem"); err == nil {
+		t.Error("downloaded key was not removed")
+	}
+	if _, err := (&fileSecrets{path: SecretsFileName}).Get(context.Background(), "", secretPrivateKey); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got error %v reading the stored private key, want it deleted", err)
+	}
+
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Pending != nil {
+		t.Errorf("pending setup %+v left behind", state.Pending)
+	}
+}
+
+func TestRunPipelineCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	saved := retryBackoff
+	retryBackoff = time.Hour
+	defer func() { retryBackoff = saved }()
+
+	ran := false
+	results, err := runPipeline(ctx, []step{
+		{
+			name:    "first",
+			retries: 3,
+			run: func(w io.Writer) error {
+				cancel()
+				return errors.New("flaky")
+			},
+		},
+		{
+			name: "second",
+			deps: []string{"first"},
+			run: func(w io.Writer) error {
+				ran = true
+				return nil
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if ran {
+		t.Error("ran a step after being cancelled")
+	}
+	if results[0].status != stepFailed || results[0].attempts != 1 {
+		t.Errorf("got %v after %v attempts, want failed after 1", results[0].status, results[0].attempts)
+	}
+	if results[1].status != stepSkipped {
+		t.Errorf("got %v, want skipped", results[1].status)
+	}
+}
+
+func TestRunCommandCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := runCommandTo(ctx, io.Discard, "sleep", "60")
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if ctx.Err() == nil {
+		t.Fatalf("returned %v before being cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v to stop after being cancelled", elapsed)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
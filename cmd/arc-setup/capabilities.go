@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ghesVersion is a GHES feature release, e.g. 3.9.
+type ghesVersion struct {
+	Major, Minor int
+}
+
+func parseGHESVersion(s string) (ghesVersion, error) {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(s), "enterprise-server@"), ".", 3)
+	if len(parts) < 2 {
+		return ghesVersion{}, fmt.Errorf("invalid GHES version %q", s)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return ghesVersion{}, fmt.Errorf("invalid GHES version %q", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ghesVersion{}, fmt.Errorf("invalid GHES version %q", s)
+	}
+
+	return ghesVersion{Major: major, Minor: minor}, nil
+}
+
+func (v ghesVersion) atLeast(other ghesVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+
+	return v.Minor >= other.Minor
+}
+
+func (v ghesVersion) String() string { return fmt.Sprintf("%v.%v", v.Major, v.Minor) }
+
+// The GHES releases which introduced the features arc-setup depends on.
+var (
+	ghesActions     = ghesVersion{3, 0}
+	ghesWorkflowJob = ghesVersion{3, 3}
+	ghesScaleSets   = ghesVersion{3, 9}
+
+	// ghesRunnerGroupWorkflows added restricted_to_workflows and
+	// selected_workflows to runner groups.
+	ghesRunnerGroupWorkflows = ghesVersion{3, 5}
+)
+
+// capabilities are the features of the GitHub instance that change what
+// arc-setup installs. github.com and GHE.com have all of them.
+type capabilities struct {
+	// Version is the GHES version, or empty for github.com and GHE.com.
+	Version string
+
+	// Actions is false on GHES releases which predate GitHub Actions,
+	// and so runners and runner groups.
+	Actions bool
+
+	// WorkflowJob is whether the workflow_job webhook event exists. Without
+	// it, the HorizontalRunnerAutoscaler has to poll instead.
+	WorkflowJob bool
+
+	// ScaleSets is whether gha-runner-scale-set is supported.
+	ScaleSets bool
+
+	// RunnerGroupWorkflows is whether runner groups can be restricted to
+	// selected workflows.
+	RunnerGroupWorkflows bool
+}
+
+var (
+	capabilitiesMu    sync.Mutex
+	capabilitiesCache = map[string]capabilities{}
+)
+
+// detectCapabilities works out what githubHost supports, from the version
+// in /meta or, failing that, the X-GitHub-Enterprise-Version header. Results
+// are cached for the rest of the run.
+func detectCapabilities(ctx context.Context, githubHost githubInstance) (capabilities, error) {
+	if !githubHost.IsGHES() {
+		return capabilities{Actions: true, WorkflowJob: true, ScaleSets: true, RunnerGroupWorkflows: true}, nil
+	}
+
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+
+	if c, ok := capabilitiesCache[githubHost.Name()]; ok {
+		return c, nil
+	}
+
+	meta, header, err := githubHost.meta(ctx)
+	if err != nil {
+		return capabilities{}, err
+	}
+
+	raw := meta.InstalledVersion
+	if raw == "" {
+		raw = header
+	}
+	if raw == "" {
+		return capabilities{}, fmt.Errorf("%v did not report its GHES version", githubHost)
+	}
+
+	v, err := parseGHESVersion(raw)
+	if err != nil {
+		return capabilities{}, err
+	}
+
+	c := capabilities{
+		Version:     raw,
+		Actions:     v.atLeast(ghesActions),
+		WorkflowJob: v.atLeast(ghesWorkflowJob),
+		ScaleSets:   v.atLeast(ghesScaleSets),
+
+		RunnerGroupWorkflows: v.atLeast(ghesRunnerGroupWorkflows),
+	}
+	capabilitiesCache[githubHost.Name()] = c
+
+	return c, nil
+}
+
+// checkMode returns an error if mode can't work against this instance.
+func (c capabilities) checkMode(mode Mode) error {
+	if !c.Actions {
+		return fmt.Errorf("GHES %v does not support GitHub Actions, %v or later is needed", c.Version, ghesActions)
+	}
+
+	if mode == ModeScaleSet && !c.ScaleSets {
+		return fmt.Errorf("runner scale sets need GHES %v or later, but this is %v; use legacy mode instead", ghesScaleSets, c.Version)
+	}
+
+	return nil
+}
+
+// appEvents are the webhook events the legacy mode App subscribes to.
+func (c capabilities) appEvents() []string {
+	if !c.WorkflowJob {
+		return []string{"check_run"}
+	}
+
+	return []string{"workflow_job", "check_run"}
+}
+
+// runnerGroupWarnings are why runner groups, or policy if it isn't nil, won't
+// work as configured against this instance.
+func (c capabilities) runnerGroupWarnings(policy *runnerGroupPolicy) []string {
+	if !c.Actions {
+		return []string{fmt.Sprintf("GHES %v predates runner groups, %v or later is needed", c.Version, ghesActions)}
+	}
+
+	if policy != nil && policy.RestrictedToWorkflows && !c.RunnerGroupWorkflows {
+		return []string{fmt.Sprintf("GHES %v can't restrict runner groups to workflows, %v or later is needed; any workflow will be able to use the group", c.Version, ghesRunnerGroupWorkflows)}
+	}
+
+	return nil
+}
+
+// meta fetches /meta, which needs no authentication, along with the
+// X-GitHub-Enterprise-Version header GHES sets on every response.
+func (h githubInstance) meta(ctx context.Context) (githubMeta, string, error) {
+	var meta githubMeta
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.APIURL()+"/meta", nil)
+	if err != nil {
+		return meta, "", fmt.Errorf("error building request: %w", err)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return meta, "", fmt.Errorf("failed to make request to GitHub: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return meta, "", fmt.Errorf("GET %v/meta: got status %v", h.APIURL(), res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&meta); err != nil {
+		return meta, "", fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return meta, res.Header.Get("X-GitHub-Enterprise-Version"), nil
+}
+
+// withPullMetrics switches any HorizontalRunnerAutoscaler in objs from
+// workflow_job webhooks to polling how busy the runners are, for instances
+// without the event. Polling can't tell when runners are needed from zero,
+// so one is always kept.
+func withPullMetrics(objs []kubeObject, c capabilities) {
+	if c.WorkflowJob {
+		return
+	}
+
+	for _, obj := range objs {
+		if obj.kind() != "HorizontalRunnerAutoscaler" {
+			continue
+		}
+
+		spec := nestedMap(obj, "spec")
+		delete(spec, "scaleUpTriggers")
+		spec["minReplicas"] = 1
+		spec["metrics"] = []interface{}{
+			map[string]interface{}{
+				"type":               "PercentageRunnersBusy",
+				"scaleUpThreshold":   "0.75",
+				"scaleDownThreshold": "0.25",
+				"scaleUpFactor":      "2",
+				"scaleDownFactor":    "0.5",
+			},
+		}
+	}
+}
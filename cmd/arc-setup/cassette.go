@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/AlecAivazis/survey/v2"
+)
+
+// CassetteVersion is bumped whenever the cassette format changes
+// incompatibly.
+const CassetteVersion = 1
+
+// cassette is a recorded arc-setup session: the files it read, the answers
+// it was given and its HTTP interactions, all with secrets scrubbed. Replaying
+// one runs setup again without GitHub, gamf or a terminal.
+type cassette struct {
+	Version      int               `json:"version"`
+	PublicURL    string            `json:"public_url,omitempty"`
+	Files        map[string]string `json:"files,omitempty"`
+	Prompts      []cassettePrompt  `json:"prompts,omitempty"`
+	Interactions []interaction     `json:"interactions"`
+}
+
+type cassettePrompt struct {
+	Message string `json:"message"`
+	Answer  string `json:"answer"`
+}
+
+type interaction struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+type cassetteResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// recordPath and replayPath are set by --record and --replay.
+var recordPath, replayPath string
+
+// scrubBody redacts secrets from a request or response body.
+func scrubBody(b []byte) string { return redact(string(redactJSON(b))) }
+
+// scrubHeaders keeps the headers worth having in a cassette, redacted.
+func scrubHeaders(h http.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+
+	out := map[string]string{}
+	for k := range h {
+		v := strings.Join(h.Values(k), ", ")
+		if sensitiveHeaders[k] {
+			v = redacted
+		}
+		out[k] = redact(v)
+	}
+
+	return out
+}
+
+// interactionKey is what a request is matched on when replaying: its method
+// and scrubbed URL, so requests carrying codes still match.
+func interactionKey(method, url string) string {
+	return method + " " + redact(strings.NewReplacer("%5B", "[", "%5D", "]").Replace(url))
+}
+
+// recorder collects a cassette as arc-setup runs.
+type recorder struct {
+	mu       sync.Mutex
+	cassette cassette
+	written  map[string]bool
+
+	// secrets are values of sensitiveEnv seen in the environment and in
+	// dotenv files, which are redacted from prompt answers too.
+	secrets []string
+
+	next    http.RoundTripper
+	files   fileSystem
+	prompts prompter
+}
+
+// startRecording wraps httpClient, files and prompts so everything they do
+// is recorded.
+func startRecording() *recorder {
+	r := &recorder{
+		cassette: cassette{Version: CassetteVersion, Files: map[string]string{}},
+		written:  map[string]bool{},
+		next:     httpClient.Transport,
+		files:    files,
+		prompts:  prompts,
+	}
+	if r.next == nil {
+		r.next = http.DefaultTransport
+	}
+	for k := range sensitiveEnv {
+		if v := os.Getenv(k); v != "" {
+			r.secrets = append(r.secrets, v)
+		}
+	}
+	if u, err := codespacesURL(); err == nil {
+		r.cassette.PublicURL = u
+	}
+
+	client := *httpClient
+	client.Transport = recordingTransport{r}
+	httpClient = &client
+	files = recordingFileSystem{r}
+	prompts = recordingPrompter{r}
+
+	return r
+}
+
+// save writes the cassette to path.
+func (r *recorder) save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Answers given before a dotenv file was read may hold its secrets.
+	for i, p := range r.cassette.Prompts {
+		r.cassette.Prompts[i].Answer = r.redactSecrets(p.Answer)
+	}
+
+	b, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding cassette: %w", err)
+	}
+
+	if err := os.WriteFile(path, append(b, '\n'), 0600); err != nil {
+		return fmt.Errorf("error writing cassette: %w", err)
+	}
+
+	logInfof("Recorded %v HTTP interactions to %v.", len(r.cassette.Interactions), path)
+
+	return nil
+}
+
+// redactSecrets replaces the secrets the recorder has seen in s. The caller
+// holds r.mu.
+func (r *recorder) redactSecrets(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+
+	return s
+}
+
+type recordingTransport struct{ r *recorder }
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := peekBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resBody, err := peekBody(&res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	t.r.mu.Lock()
+	defer t.r.mu.Unlock()
+
+	t.r.cassette.Interactions = append(t.r.cassette.Interactions, interaction{
+		Request: cassetteRequest{
+			Method:  req.Method,
+			URL:     redact(req.URL.String()),
+			Headers: scrubHeaders(req.Header),
+			Body:    scrubBody(reqBody),
+		},
+		Response: cassetteResponse{
+			Status:  res.StatusCode,
+			Headers: scrubHeaders(res.Header),
+			Body:    scrubBody(resBody),
+		},
+	})
+
+	return res, nil
+}
+
+// recordingFileSystem records the first read of each file arc-setup didn't
+// write itself. The secrets and token cache files are left out, as they can
+// only be decrypted by the recording user.
+type recordingFileSystem struct{ r *recorder }
+
+func (f recordingFileSystem) ReadFile(name string) ([]byte, error) {
+	b, err := f.r.files.ReadFile(name)
+	if err != nil || name == SecretsFileName || name == TokenCacheFileName || name == os.Getenv("ARC_SECRETS_IDENTITY") {
+		return b, err
+	}
+
+	f.r.mu.Lock()
+	defer f.r.mu.Unlock()
+
+	if _, ok := f.r.cassette.Files[name]; !ok && !f.r.written[name] {
+		scrubbed, secrets := redactDotenv(b)
+		f.r.secrets = append(f.r.secrets, secrets...)
+		f.r.cassette.Files[name] = redact(string(scrubbed))
+	}
+
+	return b, nil
+}
+
+func (f recordingFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f.r.mu.Lock()
+	f.r.written[name] = true
+	f.r.mu.Unlock()
+
+	return f.r.files.WriteFile(name, data, perm)
+}
+
+func (f recordingFileSystem) Stat(name string) (fs.FileInfo, error) { return f.r.files.Stat(name) }
+
+func (f recordingFileSystem) Remove(name string) error { return f.r.files.Remove(name) }
+
+type recordingPrompter struct{ r *recorder }
+
+func (p recordingPrompter) ask(prompt survey.Prompt, t interface{}, opts ...survey.AskOpt) error {
+	if err := p.r.prompts.ask(prompt, t, opts...); err != nil {
+		return err
+	}
+
+	answer := answerString(t)
+	if _, ok := prompt.(*survey.Password); ok {
+		answer = redacted
+	}
+
+	p.r.mu.Lock()
+	defer p.r.mu.Unlock()
+
+	p.r.cassette.Prompts = append(p.r.cassette.Prompts, cassettePrompt{Message: promptMessage(prompt), Answer: redact(p.r.redactSecrets(answer))})
+
+	return nil
+}
+
+func (p recordingPrompter) waitForEnter(ctx context.Context) error {
+	return p.r.prompts.waitForEnter(ctx)
+}
+
+func answerString(t interface{}) string {
+	if s, ok := t.(*string); ok {
+		return *s
+	}
+
+	return fmt.Sprint(t)
+}
+
+func promptMessage(p survey.Prompt) string {
+	switch p := p.(type) {
+	case *survey.Input:
+		return p.Message
+	case *survey.Select:
+		return p.Message
+	case *survey.Password:
+		return p.Message
+	default:
+		return fmt.Sprintf("%T", p)
+	}
+}
+
+// replayIdentityFile is where replays keep their secrets identity, as the
+// recording user's can't be used.
+const replayIdentityFile = "data/replay-identity.txt"
+
+// replayMain runs setup against the cassette at path, entirely in memory,
+// and prints the arc.env it would have written.
+func replayMain(ctx context.Context, path string, w io.Writer) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var c cassette
+	if err := json.Unmarshal(b, &c); err != nil {
+		return fmt.Errorf("error decoding cassette: %w", err)
+	}
+	if c.Version > CassetteVersion {
+		return fmt.Errorf("cassette version %v is newer than this arc-setup understands (%v)", c.Version, CassetteVersion)
+	}
+
+	key, err := replayPEM()
+	if err != nil {
+		return err
+	}
+
+	mem := newMemoryFileSystem()
+	for name, content := range c.Files {
+		if strings.TrimSpace(content) == redacted {
+			// The only whole file secret arc-setup reads is a private key.
+			content = string(key)
+		}
+		if err := mem.WriteFile(name, []byte(content), 0600); err != nil {
+			return err
+		}
+	}
+
+	files = mem
+
+	// Credentials are stored with the file backend in memory, whatever the
+	// recording used.
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	state.SecretsBackend = "file"
+	sb, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error encoding state: %w", err)
+	}
+	if err := mem.WriteFile(StateFileName, sb, 0600); err != nil {
+		return err
+	}
+	if err := os.Setenv("ARC_SECRETS_IDENTITY", replayIdentityFile); err != nil {
+		return err
+	}
+	if err := os.Unsetenv("ARC_SECRETS_PASSPHRASE"); err != nil {
+		return err
+	}
+	if c.PublicURL != "" {
+		if err := os.Setenv("ARC_PUBLIC_URL", c.PublicURL); err != nil {
+			return err
+		}
+	}
+
+	prompts = &replayPrompter{prompts: c.Prompts}
+	httpClient = &http.Client{Transport: traceTransport{next: newReplayTransport(c.Interactions, key)}}
+	codePollInterval, githubRetryDelay, installationPollInterval = 0, 0, 0
+
+	if err := realMain(ctx); err != nil {
+		return err
+	}
+
+	out, err := mem.ReadFile(VarFileName)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	_, err = w.Write(out)
+
+	return err
+}
+
+// replayPEM is a throwaway key replays use in place of the recorded one.
+func replayPEM() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+}
+
+// replayTransport answers requests from recorded interactions, in the order
+// they were recorded for each method and URL.
+type replayTransport struct {
+	mu    sync.Mutex
+	queue map[string][]cassetteResponse
+	key   []byte
+}
+
+func newReplayTransport(interactions []interaction, key []byte) *replayTransport {
+	t := &replayTransport{queue: map[string][]cassetteResponse{}, key: key}
+	for _, i := range interactions {
+		k := interactionKey(i.Request.Method, i.Request.URL)
+		t.queue[k] = append(t.queue[k], i.Response)
+	}
+
+	return t
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	k := interactionKey(req.Method, req.URL.String())
+
+	t.mu.Lock()
+	responses := t.queue[k]
+	if len(responses) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %v", k)
+	}
+	res := responses[0]
+	// The last response for a URL repeats, for polls that ran longer live.
+	if len(responses) > 1 {
+		t.queue[k] = responses[1:]
+	}
+	t.mu.Unlock()
+
+	header := http.Header{}
+	for k, v := range res.Headers {
+		header.Set(k, v)
+	}
+
+	body := restoreJSON([]byte(res.Body), t.key)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%v %v", res.Status, http.StatusText(res.Status)),
+		StatusCode:    res.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// pemKeys are the JSON keys holding private keys, which replays fill in so
+// the key can be used.
+var pemKeys = map[string]bool{"pem": true, "private_key": true, "github_app_private_key": true}
+
+// restoreJSON replaces redacted private keys in a JSON body with key.
+func restoreJSON(body, key []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return body
+	}
+
+	restored := false
+	for k := range pemKeys {
+		if m[k] == redacted {
+			m[k] = string(key)
+			restored = true
+		}
+	}
+	if !restored {
+		return body
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+
+	return b
+}
+
+// replayPrompter answers prompts with the recorded answers, in order.
+type replayPrompter struct {
+	prompts []cassettePrompt
+}
+
+func (p *replayPrompter) ask(prompt survey.Prompt, t interface{}, opts ...survey.AskOpt) error {
+	message := promptMessage(prompt)
+	if len(p.prompts) == 0 {
+		return fmt.Errorf("no recorded answer for %q", message)
+	}
+
+	next := p.prompts[0]
+	if next.Message != message {
+		return fmt.Errorf("recorded answer is for %q, not %q", next.Message, message)
+	}
+	p.prompts = p.prompts[1:]
+
+	out, ok := t.(*string)
+	if !ok {
+		return fmt.Errorf("unexpected answer type %T", t)
+	}
+	*out = next.Answer
+
+	return nil
+}
+
+func (p *replayPrompter) waitForEnter(ctx context.Context) error { return ctx.Err() }
+
+// memoryFileSystem is a fileSystem in memory, for replays.
+type memoryFileSystem struct {
+	mu    sync.Mutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data []byte
+	perm fs.FileMode
+}
+
+func newMemoryFileSystem() *memoryFileSystem {
+	return &memoryFileSystem{files: map[string]memoryFile{}}
+}
+
+func (m *memoryFileSystem) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return append([]byte(nil), f.data...), nil
+}
+
+func (m *memoryFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[name] = memoryFile{data: append([]byte(nil), data...), perm: perm}
+
+	return nil
+}
+
+func (m *memoryFileSystem) Stat(name string) (fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: errors.New("stat is not supported when replaying")}
+}
+
+func (m *memoryFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+
+	return nil
+}
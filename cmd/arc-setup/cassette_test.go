@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassetteRecordReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		mode Mode
+
+		// dotenv is an arc.env from an earlier run, read while recording.
+		dotenv  string
+		secrets []string
+	}{
+		{name: "manifest", mode: ModeLegacy},
+		{name: "registration", mode: ModeScaleSet},
+		{
+			name:    "dotenv secrets",
+			mode:    ModeLegacy,
+			dotenv:  "ARC_GITHUB_APP_ORGANIZATION=acme\nARC_GITHUB_APP_WEBHOOK_SECRET=plain-hook-secret\nARC_GITHUB_APP_PRIVATE_KEY=plain-private-key\nVAULT_TOKEN=s.plain-vault-token\n",
+			secrets: []string{"plain-hook-secret", "plain-private-key", "s.plain-vault-token"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGitHub(t)
+			f.CodeAfter = 2
+			f.ConversionStatuses = []int{502}
+			mem, _ := setupFake(t, f, tt.mode)
+
+			path := filepath.Join(t.TempDir(), "setup.json")
+			r := startRecording()
+			if tt.dotenv != "" {
+				if err := mem.WriteFile(VarFileName, []byte(tt.dotenv), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := loadVars(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := realMain(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.save(path); err != nil {
+				t.Fatal(err)
+			}
+
+			recorded, err := mem.ReadFile(VarFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, secret := range append([]string{string(f.PEM()), "BEGIN RSA PRIVATE KEY", f.Secret, fakeExchangeCode, "Bearer ey"}, tt.secrets...) {
+				if bytes.Contains(b, []byte(secret)) {
+					t.Errorf("cassette contains %q", secret)
+				}
+			}
+
+			// Nothing is left to answer the replay but the cassette.
+			f.Close()
+			prompts, files = nil, nil
+
+			var out bytes.Buffer
+			if err := replayMain(context.Background(), path, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := out.String(), string(recorded); got != want {
+				t.Errorf("replay wrote\n%v\nwant\n%v", got, want)
+			}
+		})
+	}
+}
+
+func TestReplayTransportUnknownRequest(t *testing.T) {
+	rt := newReplayTransport(nil, nil)
+	req, err := http.NewRequest(http.MethodGet, "https://github.example.com/api/v3/meta", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rt.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("got error %v, want no recorded response", err)
+	}
+}
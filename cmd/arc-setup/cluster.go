@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ClusterName is the name given to clusters arc-setup creates with kind and
+// k3d. minikube keeps its default profile so `minikube` commands work as is.
+const ClusterName = "arc-setup"
+
+// ClusterStatus describes a cluster as seen by its provider.
+type ClusterStatus struct {
+	Provider string
+	Exists   bool
+	Running  bool
+	Context  string
+}
+
+// ClusterProvider creates and manages the Kubernetes cluster that Actions
+// Runner Controller is installed onto.
+type ClusterProvider interface {
+	// Name is the value passed to --cluster to select this provider.
+	Name() string
+
+	// Create brings the cluster up, doing nothing if it is already running.
+	Create(ctx context.Context) error
+
+	// Status reports whether the cluster exists and is reachable.
+	Status(ctx context.Context) (ClusterStatus, error)
+
+	// Delete tears the cluster down.
+	Delete(ctx context.Context) error
+
+	// ExposeIngress makes the ingress-nginx controller reachable on
+	// localhost:80, blocking until ctx is cancelled.
+	ExposeIngress(ctx context.Context) error
+}
+
+var clusterProviders = map[string]ClusterProvider{
+	"minikube": minikubeProvider{},
+	"kind":     kindProvider{},
+	"k3d":      k3dProvider{},
+	"existing": existingProvider{},
+}
+
+func clusterProvider(name string) (ClusterProvider, error) {
+	p, ok := clusterProviders[name]
+	if !ok {
+		names := make([]string, 0, len(clusterProviders))
+		for n := range clusterProviders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return nil, fmt.Errorf("unknown cluster provider %q (must be one of %v)", name, strings.Join(names, ", "))
+	}
+
+	return p, nil
+}
+
+func clusterMain(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("usage: arc-setup cluster <create|status|delete|expose> [--cluster minikube|kind|k3d|existing]")
+	}
+	action := args[0]
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	defaultCluster := os.Getenv("ARC_CLUSTER")
+	if defaultCluster == "" {
+		defaultCluster = state.Cluster
+	}
+	if defaultCluster == "" {
+		defaultCluster = "minikube"
+	}
+
+	fs := flag.NewFlagSet("cluster "+action, flag.ContinueOnError)
+	name := fs.String("cluster", defaultCluster, "cluster provider: minikube, kind, k3d or existing")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+
+	provider, err := clusterProvider(*name)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "create":
+		if err := provider.Create(ctx); err != nil {
+			return err
+		}
+
+		state.Cluster = provider.Name()
+
+		return state.save()
+	case "status":
+		status, err := provider.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Provider: %v\n", status.Provider)
+		fmt.Printf("Exists: %v\n", status.Exists)
+		fmt.Printf("Running: %v\n", status.Running)
+		fmt.Printf("Context: %v\n", status.Context)
+
+		return nil
+	case "delete":
+		return provider.Delete(ctx)
+	case "expose":
+		return provider.ExposeIngress(ctx)
+	default:
+		return usageError("unknown cluster command %q", action)
+	}
+}
+
+type minikubeProvider struct{}
+
+func (minikubeProvider) Name() string { return "minikube" }
+
+func (minikubeProvider) Create(ctx context.Context) error {
+	logInfof("Starting up minikube...")
+
+	return runCommand(ctx, "minikube", "start")
+}
+
+func (p minikubeProvider) Status(ctx context.Context) (ClusterStatus, error) {
+	status := ClusterStatus{Provider: p.Name(), Context: "minikube"}
+
+	// minikube status exits non-zero when anything is stopped, but still
+	// prints its report.
+	out, _ := exec.CommandContext(ctx, "minikube", "status", "--output", "json").Output()
+	if len(out) == 0 {
+		return status, nil
+	}
+
+	var report struct {
+		Host      string `json:"Host"`
+		APIServer string `json:"APIServer"`
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return status, fmt.Errorf("error decoding minikube status: %w", err)
+	}
+
+	status.Exists = report.Host != "" && report.Host != "Nonexistent"
+	status.Running = report.Host == "Running" && report.APIServer == "Running"
+
+	return status, nil
+}
+
+func (minikubeProvider) Delete(ctx context.Context) error {
+	return runCommand(ctx, "minikube", "delete")
+}
+
+func (minikubeProvider) ExposeIngress(ctx context.Context) error {
+	var procs processGroup
+	defer procs.kill()
+
+	if err := procs.start(exec.Command("minikube", "tunnel")); err != nil {
+		return err
+	}
+
+	ip, err := waitForIngressIP(ctx, "minikube", &procs)
+	if err != nil {
+		return err
+	}
+
+	logInfof("Tunneling localhost:80 to %v:80", ip)
+	if err := procs.start(socat(ip + ":80")); err != nil {
+		return err
+	}
+
+	return procs.wait(ctx)
+}
+
+type kindProvider struct{}
+
+func (kindProvider) Name() string { return "kind" }
+
+func (p kindProvider) Create(ctx context.Context) error {
+	status, err := p.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Exists {
+		logInfof("Kind cluster %v already exists.", ClusterName)
+		return nil
+	}
+
+	logInfof("Starting up kind...")
+
+	return runCommand(ctx, "kind", "create", "cluster", "--name", ClusterName, "--wait", "5m")
+}
+
+func (p kindProvider) Status(ctx context.Context) (ClusterStatus, error) {
+	status := ClusterStatus{Provider: p.Name(), Context: "kind-" + ClusterName}
+
+	out, err := commandOutput(ctx, "kind", "get", "clusters")
+	if err != nil {
+		return status, err
+	}
+
+	for _, name := range strings.Fields(out) {
+		if name == ClusterName {
+			status.Exists = true
+		}
+	}
+	status.Running = status.Exists && apiServerReady(ctx, status.Context)
+
+	return status, nil
+}
+
+func (kindProvider) Delete(ctx context.Context) error {
+	return runCommand(ctx, "kind", "delete", "cluster", "--name", ClusterName)
+}
+
+func (p kindProvider) ExposeIngress(ctx context.Context) error {
+	return portForwardIngress(ctx, "kind-"+ClusterName)
+}
+
+type k3dProvider struct{}
+
+func (k3dProvider) Name() string { return "k3d" }
+
+func (p k3dProvider) Create(ctx context.Context) error {
+	status, err := p.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Exists {
+		logInfof("K3d cluster %v already exists, starting it...", ClusterName)
+		return runCommand(ctx, "k3d", "cluster", "start", ClusterName)
+	}
+
+	logInfof("Starting up k3d...")
+
+	// We install ingress-nginx ourselves, so traefik is disabled, and the k3d
+	// load balancer publishes port 80 so no tunnel is needed.
+	return runCommand(ctx, "k3d", "cluster", "create", ClusterName,
+		"--port", "80:80@loadbalancer",
+		"--k3s-arg", "--disable=traefik@server:0",
+		"--wait",
+	)
+}
+
+func (p k3dProvider) Status(ctx context.Context) (ClusterStatus, error) {
+	status := ClusterStatus{Provider: p.Name(), Context: "k3d-" + ClusterName}
+
+	out, err := commandOutput(ctx, "k3d", "cluster", "list", "--output", "json")
+	if err != nil {
+		return status, err
+	}
+
+	var clusters []struct {
+		Name           string `json:"name"`
+		ServersRunning int    `json:"serversRunning"`
+	}
+	if err := json.Unmarshal([]byte(out), &clusters); err != nil {
+		return status, fmt.Errorf("error decoding k3d clusters: %w", err)
+	}
+
+	for _, c := range clusters {
+		if c.Name == ClusterName {
+			status.Exists = true
+			status.Running = c.ServersRunning > 0 && apiServerReady(ctx, status.Context)
+		}
+	}
+
+	return status, nil
+}
+
+func (k3dProvider) Delete(ctx context.Context) error {
+	return runCommand(ctx, "k3d", "cluster", "delete", ClusterName)
+}
+
+func (k3dProvider) ExposeIngress(ctx context.Context) error {
+	logInfof("K3d publishes port 80 from its load balancer, nothing to tunnel.")
+
+	// Block like the other providers, so process managers keep us running.
+	<-ctx.Done()
+
+	return nil
+}
+
+// existingProvider uses whatever cluster the current kubeconfig context points
+// at. It never creates or deletes anything.
+type existingProvider struct{}
+
+// requiredPermissions are the verbs and resources installing
+// cert-manager, ingress-nginx and Actions Runner Controller need.
+var requiredPermissions = [][2]string{
+	{"create", "namespaces"},
+	{"create", "customresourcedefinitions.apiextensions.k8s.io"},
+	{"create", "clusterroles.rbac.authorization.k8s.io"},
+	{"create", "clusterrolebindings.rbac.authorization.k8s.io"},
+	{"create", "mutatingwebhookconfigurations.admissionregistration.k8s.io"},
+	{"create", "validatingwebhookconfigurations.admissionregistration.k8s.io"},
+	{"create", "deployments.apps"},
+	{"create", "services"},
+	{"create", "secrets"},
+	{"create", "ingresses.networking.k8s.io"},
+}
+
+func (existingProvider) Name() string { return "existing" }
+
+func (p existingProvider) Create(ctx context.Context) error {
+	status, err := p.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if !status.Running {
+		return fmt.Errorf("cluster for context %q is not reachable", status.Context)
+	}
+
+	logInfof("Using existing cluster from context %v, checking permissions...", status.Context)
+
+	kube, err := newKubeClient(ctx, status.Context)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, perm := range requiredPermissions {
+		ok, err := kube.canI(perm[0], perm[1])
+		if err != nil {
+			return fmt.Errorf("checking permission to %v %v: %w", perm[0], perm[1], err)
+		}
+		if !ok {
+			missing = append(missing, perm[0]+" "+perm[1])
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("context %q is missing permissions: %v", status.Context, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func (p existingProvider) Status(ctx context.Context) (ClusterStatus, error) {
+	status := ClusterStatus{Provider: p.Name()}
+
+	kubeContext, err := commandOutput(ctx, "kubectl", "config", "current-context")
+	if err != nil {
+		return status, fmt.Errorf("no current kubeconfig context: %w", err)
+	}
+
+	status.Context = kubeContext
+	status.Exists = true
+	status.Running = apiServerReady(ctx, kubeContext)
+
+	return status, nil
+}
+
+func (existingProvider) Delete(context.Context) error {
+	return errors.New("refusing to delete a cluster arc-setup did not create")
+}
+
+func (p existingProvider) ExposeIngress(ctx context.Context) error {
+	status, err := p.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	return portForwardIngress(ctx, status.Context)
+}
+
+func apiServerReady(ctx context.Context, kubeContext string) bool {
+	kube, err := newKubeClient(ctx, kubeContext)
+	return err == nil && kube.ready()
+}
+
+// waitForIngressIP polls until the ingress-nginx LoadBalancer service has an
+// address, failing early if any of procs exit or ctx is cancelled.
+func waitForIngressIP(ctx context.Context, kubeContext string, procs *processGroup) (string, error) {
+	kube, err := newKubeClient(ctx, kubeContext)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		var svc struct {
+			Status struct {
+				LoadBalancer struct {
+					Ingress []struct {
+						IP string `json:"ip"`
+					} `json:"ingress"`
+				} `json:"loadBalancer"`
+			} `json:"status"`
+		}
+		err := kube.get("v1", "Service", "ingress-nginx", "ingress-nginx-controller", &svc)
+		if err != nil && !isNotFound(err) {
+			return "", err
+		}
+		if ingress := svc.Status.LoadBalancer.Ingress; len(ingress) > 0 && ingress[0].IP != "" {
+			return ingress[0].IP, nil
+		}
+
+		if err := procs.exited(); err != nil {
+			return "", err
+		}
+
+		logInfof("Waiting for ingress-nginx load balancer...")
+		if err := sleepContext(ctx, time.Second); err != nil {
+			return "", err
+		}
+	}
+}
+
+// portForwardIngress port-forwards the ingress-nginx controller service and
+// bridges localhost:80 to it, for clusters without a load balancer.
+func portForwardIngress(ctx context.Context, kubeContext string) error {
+	var procs processGroup
+	defer procs.kill()
+
+	forward := exec.Command("kubectl", "--context", kubeContext,
+		"port-forward", "--namespace", "ingress-nginx",
+		"service/ingress-nginx-controller", "8080:80",
+	)
+	if err := procs.start(forward); err != nil {
+		return err
+	}
+
+	logInfof("Tunneling localhost:80 to ingress-nginx via localhost:8080")
+	if err := procs.start(socat("127.0.0.1:8080")); err != nil {
+		return err
+	}
+
+	return procs.wait(ctx)
+}
+
+func socat(target string) *exec.Cmd {
+	return exec.Command("sudo", "socat", "TCP-LISTEN:80,fork", "TCP:"+target)
+}
+
+// processGroup runs long lived commands together, so that when any of them
+// exits the rest can be torn down.
+type processGroup struct {
+	cmds  []*exec.Cmd
+	exits []chan struct{}
+	done  chan error
+}
+
+// processGroupGrace is how long kill waits for commands to exit after SIGTERM
+// before killing them.
+var processGroupGrace = 5 * time.Second
+
+func (g *processGroup) start(cmd *exec.Cmd) error {
+	if g.done == nil {
+		g.done = make(chan error, 8)
+	}
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Each command leads its own process group, so kill reaches what it
+	// starts too, like the socat sudo runs.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %v: %w", cmd.String(), err)
+	}
+
+	exit := make(chan struct{})
+	g.cmds = append(g.cmds, cmd)
+	g.exits = append(g.exits, exit)
+	go func() {
+		err := cmd.Wait()
+		close(exit)
+		if err == nil {
+			err = fmt.Errorf("%v exited", cmd.String())
+		}
+		g.done <- err
+	}()
+
+	return nil
+}
+
+// exited returns the error of the first command to exit, or nil if all are
+// still running.
+func (g *processGroup) exited() error {
+	select {
+	case err := <-g.done:
+		return err
+	default:
+		return nil
+	}
+}
+
+// wait blocks until any command exits, or ctx is cancelled. Cancelling isn't
+// an error, as it is how a tunnel is stopped.
+func (g *processGroup) wait(ctx context.Context) error {
+	select {
+	case err := <-g.done:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// kill stops every command's process group. sudo relays the SIGTERM to the
+// command it runs, which it can't do for a SIGKILL, so that is only sent once
+// the command exits or processGroupGrace passes, for whatever is left.
+func (g *processGroup) kill() {
+	for _, cmd := range g.cmds {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+
+	deadline := time.NewTimer(processGroupGrace)
+	defer deadline.Stop()
+
+	for i, cmd := range g.cmds {
+		select {
+		case <-g.exits[i]:
+		case <-deadline.C:
+			// Every later command has had the grace period too.
+			deadline.Reset(0)
+		}
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
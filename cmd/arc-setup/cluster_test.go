@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessGroupKill(t *testing.T) {
+	saved := processGroupGrace
+	processGroupGrace = 100 * time.Millisecond
+	defer func() { processGroupGrace = saved }()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	// Like sudo running socat, sh leaves its child running if only it is
+	// killed. The child also ignores SIGTERM, so needs the SIGKILL.
+	var procs processGroup
+	script := `sh -c 'trap "" TERM; echo $$ > ` + pidFile + `; while :; do sleep 1; done' & wait`
+	if err := procs.start(exec.Command("sh", "-c", script)); err != nil {
+		t.Fatal(err)
+	}
+
+	var child int
+	for deadline := time.Now().Add(5 * time.Second); child == 0; {
+		if b, err := os.ReadFile(pidFile); err == nil && strings.HasSuffix(string(b), "\n") {
+			child, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("child never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	procs.kill()
+
+	for deadline := time.Now().Add(5 * time.Second); processAlive(child); {
+		if time.Now().After(deadline) {
+			t.Fatalf("child %v outlived the process group", child)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExposeIngressCancelled(t *testing.T) {
+	savedLog := log.w
+	defer func() { log.w = savedLog }()
+	log.w = io.Discard
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- k3dProvider{}.ExposeIngress(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("got error %v from k3d, want none", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("k3d kept exposing ingress after ctx was cancelled")
+	}
+
+	var procs processGroup
+	defer procs.kill()
+	if err := procs.start(exec.Command("sleep", "60")); err != nil {
+		t.Fatal(err)
+	}
+	if err := procs.wait(ctx); err != nil {
+		t.Errorf("got error %v waiting for a tunnel, want none", err)
+	}
+
+	newFakeKube(t)
+	if _, err := waitForIngressIP(ctx, "", &procs); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v waiting for the load balancer, want it cancelled", err)
+	}
+}
+
+// processAlive reports whether pid is running, counting zombies as dead.
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(b)[strings.LastIndex(string(b), ")")+1:])
+
+	return len(fields) == 0 || fields[0] != "Z"
+}
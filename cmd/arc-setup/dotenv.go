@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DotenvVersion is the format version written in the header of dotenv files.
+// Files without a header are from before arc-setup quoted values, and are read
+// as unquoted KEY=value lines.
+const DotenvVersion = 1
+
+const dotenvVersionPrefix = "# arc-setup-dotenv: "
+
+// marshalDotenv writes es as KEY="value" lines, sorted by key, after a header
+// recording the format version and comment.
+//
+// Values are double quoted with $, `, " and \ backslash escaped, which a POSIX
+// shell reads back unchanged, so a file sourced by hand cannot run commands.
+// Newlines are kept literally inside the quotes.
+func marshalDotenv(es map[string]string, comment string) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%v%v\n", dotenvVersionPrefix, DotenvVersion)
+	for _, line := range strings.Split(comment, "\n") {
+		if line != "" {
+			fmt.Fprintf(&buf, "# %v\n", line)
+		}
+	}
+
+	for _, k := range sortedEnvKeys(es) {
+		fmt.Fprintf(&buf, "%v=%v\n", k, quoteDotenv(es[k]))
+	}
+
+	return buf.Bytes()
+}
+
+func quoteDotenv(v string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	// Bytewise, so invalid UTF-8 is kept rather than replaced.
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '\\', '"', '$', '`':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(v[i])
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// unmarshalDotenv reads a dotenv file. Besides what marshalDotenv writes, it
+// accepts blank lines, comments, an export prefix, and single quoted or bare
+// values, with shell quoting rules but no expansion.
+func unmarshalDotenv(b []byte) (map[string]string, error) {
+	s := string(b)
+
+	version := 0
+	if strings.HasPrefix(s, dotenvVersionPrefix) {
+		line := s[len(dotenvVersionPrefix):]
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+
+		v, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dotenv version %q", line)
+		}
+		if v > DotenvVersion {
+			return nil, fmt.Errorf("dotenv version %v is newer than this arc-setup supports (%v), please update", v, DotenvVersion)
+		}
+		version = v
+	}
+
+	if version == 0 {
+		return unmarshalLegacyDotenv(s)
+	}
+
+	p := dotenvParser{s: s, line: 1}
+	return p.parse()
+}
+
+// unmarshalLegacyDotenv reads the unquoted KEY=value lines written by
+// env.EnvSetToEnviron.
+func unmarshalLegacyDotenv(s string) (map[string]string, error) {
+	es := map[string]string{}
+
+	for n, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		k, v, ok := cut(line, "=")
+		if !ok || !envNameRe.MatchString(k) {
+			return nil, fmt.Errorf("line %v: expected KEY=value", n+1)
+		}
+		es[k] = v
+	}
+
+	return es, nil
+}
+
+type dotenvParser struct {
+	s    string
+	i    int
+	line int
+}
+
+func (p *dotenvParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %v: %v", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *dotenvParser) eof() bool { return p.i >= len(p.s) }
+
+func (p *dotenvParser) next() byte {
+	c := p.s[p.i]
+	p.i++
+	if c == '\n' {
+		p.line++
+	}
+
+	return c
+}
+
+func (p *dotenvParser) skipComment() {
+	for !p.eof() && p.s[p.i] != '\n' {
+		p.i++
+	}
+}
+
+func (p *dotenvParser) parse() (map[string]string, error) {
+	es := map[string]string{}
+
+	for !p.eof() {
+		switch p.s[p.i] {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+			continue
+		case '#':
+			p.skipComment()
+			continue
+		}
+
+		if strings.HasPrefix(p.s[p.i:], "export ") {
+			p.i += len("export ")
+		}
+
+		eq := strings.IndexByte(p.s[p.i:], '=')
+		if eq < 0 || !envNameRe.MatchString(p.s[p.i:p.i+eq]) {
+			return nil, p.errorf("expected KEY=value")
+		}
+		key := p.s[p.i : p.i+eq]
+		p.i += eq + 1
+
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		es[key] = value
+
+		// Only whitespace or a comment may follow a value.
+		for !p.eof() && (p.s[p.i] == ' ' || p.s[p.i] == '\t' || p.s[p.i] == '\r') {
+			p.i++
+		}
+		if !p.eof() {
+			switch p.s[p.i] {
+			case '#':
+				p.skipComment()
+			case '\n':
+			default:
+				return nil, p.errorf("unexpected %q after value of %v", p.s[p.i], key)
+			}
+		}
+	}
+
+	return es, nil
+}
+
+// value reads one shell word: any run of bare, single quoted and double
+// quoted parts.
+func (p *dotenvParser) value() (string, error) {
+	var b strings.Builder
+
+	for !p.eof() {
+		switch c := p.s[p.i]; c {
+		case ' ', '\t', '\r', '\n':
+			return b.String(), nil
+		case '\'':
+			p.next()
+			if err := p.singleQuoted(&b); err != nil {
+				return "", err
+			}
+		case '"':
+			p.next()
+			if err := p.doubleQuoted(&b); err != nil {
+				return "", err
+			}
+		case '\\':
+			p.next()
+			if !p.eof() {
+				b.WriteByte(p.next())
+			}
+		case '$', '`', '(', ')', ';', '&', '|', '<', '>':
+			return "", p.errorf("unquoted %q in value, quote it", c)
+		default:
+			b.WriteByte(p.next())
+		}
+	}
+
+	return b.String(), nil
+}
+
+func (p *dotenvParser) singleQuoted(b *strings.Builder) error {
+	for !p.eof() {
+		c := p.next()
+		if c == '\'' {
+			return nil
+		}
+		b.WriteByte(c)
+	}
+
+	return p.errorf("unterminated single quote")
+}
+
+// doubleQuoted reads up to the closing quote. Backslash only escapes $, `, "
+// and \ or continues a line, as in a POSIX shell.
+func (p *dotenvParser) doubleQuoted(b *strings.Builder) error {
+	for !p.eof() {
+		c := p.next()
+		switch c {
+		case '"':
+			return nil
+		case '$', '`':
+			return p.errorf("unescaped %q in double quoted value, expansion is not supported", c)
+		case '\\':
+			if p.eof() {
+				break
+			}
+			switch p.s[p.i] {
+			case '\\', '"', '$', '`':
+				c = p.next()
+			case '\n':
+				p.next()
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+
+	return p.errorf("unterminated double quote")
+}
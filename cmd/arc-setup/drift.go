@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// errDrift is returned by diff and reconcile with --exit-code when live state
+// does not match the desired state.
+var errDrift = errors.New("drift detected")
+
+// change is a single differing value, identified by a dotted path.
+type change struct {
+	Path    string
+	Live    interface{}
+	Desired interface{}
+}
+
+// drift is everything that differs for one target, along with how to fix it.
+type drift struct {
+	Target  string
+	Missing bool
+	Changes []change
+
+	// fix converges the target. It is nil when the drift can only be fixed
+	// by hand, in which case Manual explains how.
+	fix    func(w io.Writer) error
+	Manual string
+}
+
+func diffMain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	exitCode := flags.Bool("exit-code", false, "exit non-zero if any drift is found")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	drifts, err := detectDrift(ctx)
+	if err != nil {
+		return err
+	}
+
+	printDrift(os.Stdout, drifts)
+
+	if *exitCode && len(drifts) > 0 {
+		return errDrift
+	}
+
+	return nil
+}
+
+func reconcileMain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	exitCode := flags.Bool("exit-code", false, "exit non-zero if any drift could not be fixed")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	drifts, err := detectDrift(ctx)
+	if err != nil {
+		return err
+	}
+
+	printDrift(os.Stdout, drifts)
+
+	var unfixed int
+	for _, d := range drifts {
+		if d.fix == nil {
+			unfixed++
+			continue
+		}
+
+		fmt.Printf("ℹ Reconciling %v...\n", d.Target)
+		if err := d.fix(os.Stdout); err != nil {
+			return fmt.Errorf("reconciling %v: %w", d.Target, err)
+		}
+	}
+
+	if unfixed > 0 {
+		fmt.Printf("ℹ %v target(s) need fixing by hand, see above.\n", unfixed)
+
+		if *exitCode {
+			return errDrift
+		}
+	}
+
+	return nil
+}
+
+func printDrift(w io.Writer, drifts []drift) {
+	if len(drifts) == 0 {
+		fmt.Fprintf(w, "ℹ No drift detected.\n")
+		return
+	}
+
+	for _, d := range drifts {
+		switch {
+		case d.Missing:
+			fmt.Fprintf(w, "+ %v (missing)\n", d.Target)
+		case d.fix == nil:
+			fmt.Fprintf(w, "! %v\n", d.Target)
+		default:
+			fmt.Fprintf(w, "~ %v\n", d.Target)
+		}
+
+		for _, c := range d.Changes {
+			fmt.Fprintf(w, "    %v: %v => %v\n", c.Path, formatDriftValue(c.Path, c.Live), formatDriftValue(c.Path, c.Desired))
+		}
+
+		if d.Manual != "" {
+			fmt.Fprintf(w, "    fix by hand: %v\n", d.Manual)
+		}
+	}
+}
+
+// sensitivePathParts mark values which must not be printed in a diff.
+var sensitivePathParts = []string{"private_key", "secret", "token", "password"}
+
+func formatDriftValue(path string, v interface{}) string {
+	if v == nil {
+		return "(none)"
+	}
+
+	lower := strings.ToLower(path)
+	for _, part := range sensitivePathParts {
+		if strings.Contains(lower, part) {
+			return "(redacted)"
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return string(b)
+}
+
+// detectDrift compares the desired state derived from arc.env and state
+// against the cluster and GitHub.
+func detectDrift(ctx context.Context) ([]drift, error) {
+	state, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		return nil, err
+	}
+
+	githubHost, err := loadHost()
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []drift
+
+	releases, err := desiredReleases(ctx, state, vars)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range releases {
+		d, err := releaseDrift(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			drifts = append(drifts, *d)
+		}
+	}
+
+	if state.Mode.NeedsWebhook() {
+		ds, err := manifestDrift(ctx, "data/arc.yml")
+		if err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, ds...)
+	}
+
+	ds, err := appDrift(ctx, state, vars, githubHost)
+	if err != nil {
+		return nil, err
+	}
+	drifts = append(drifts, ds...)
+
+	d, err := runnerGroupDrift(ctx, githubHost, vars)
+	if err != nil {
+		return nil, err
+	}
+	if d != nil {
+		drifts = append(drifts, *d)
+	}
+
+	return drifts, nil
+}
+
+func desiredReleases(ctx context.Context, state *State, vars Vars) ([]helmRelease, error) {
+	if !state.Mode.NeedsWebhook() {
+		releases := []helmRelease{scaleSetControllerHelmRelease()}
+		for _, name := range splitScaleSets(vars.ScaleSets) {
+			r, err := scaleSetHelmRelease(ctx, vars, name)
+			if err != nil {
+				return nil, err
+			}
+			releases = append(releases, r)
+		}
+
+		return releases, nil
+	}
+
+	arc, err := arcRelease(ctx, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return []helmRelease{ingressNginxRelease(), certManagerRelease(), arc}, nil
+}
+
+// releaseDrift compares a release's chart version and user supplied values.
+func releaseDrift(ctx context.Context, r helmRelease) (*drift, error) {
+	target := fmt.Sprintf("helm release %v/%v", r.Namespace, r.Name)
+	fix := func(w io.Writer) error { return r.install(ctx, w) }
+
+	out, err := commandOutput(ctx, "helm", "list", "--namespace", r.Namespace, "--filter", "^"+r.Name+"$", "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []struct {
+		Chart  string `json:"chart"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("error decoding helm list: %w", err)
+	}
+	if len(list) == 0 {
+		return &drift{Target: target, Missing: true, fix: fix}, nil
+	}
+
+	var changes []change
+	if list[0].Status != "deployed" {
+		changes = append(changes, change{Path: "status", Live: list[0].Status, Desired: "deployed"})
+	}
+
+	// charts are listed as <name>-<version>
+	if live := strings.TrimPrefix(list[0].Chart, chartName(r.Chart)+"-"); live != r.Version {
+		changes = append(changes, change{Path: "version", Live: live, Desired: r.Version})
+	}
+
+	out, err = commandOutput(ctx, "helm", "get", "values", r.Name, "--namespace", r.Namespace, "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var live interface{}
+	if err := json.Unmarshal([]byte(out), &live); err != nil {
+		return nil, fmt.Errorf("error decoding helm values: %w", err)
+	}
+	if live == nil {
+		live = map[string]interface{}{}
+	}
+
+	desired, err := normalize(r.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	changes = append(changes, diffValues("values", live, desired, false)...)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	return &drift{Target: target, Changes: changes, fix: fix}, nil
+}
+
+func chartName(chart string) string {
+	return chart[strings.LastIndex(chart, "/")+1:]
+}
+
+// manifestDrift compares every object in the rendered template at path with
+// the cluster. Only fields set in the template are compared, so defaults and
+// status filled in by the API server are not drift.
+func manifestDrift(ctx context.Context, path string) ([]drift, error) {
+	objs, err := renderManifests(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []drift
+	for _, obj := range objs {
+		obj := obj
+		fix := func(w io.Writer) error {
+			if err := kube.apply(obj); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(w, "%v applied\n", obj)
+
+			return nil
+		}
+
+		var live interface{}
+		err := kube.get(obj.apiVersion(), obj.kind(), obj.namespace(), obj.name(), &live)
+		if isNotFound(err) {
+			drifts = append(drifts, drift{Target: obj.String(), Missing: true, fix: fix})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		desired, err := normalize(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		if changes := diffValues("", live, desired, true); len(changes) > 0 {
+			drifts = append(drifts, drift{Target: obj.String(), Changes: changes, fix: fix})
+		}
+	}
+
+	return drifts, nil
+}
+
+// appDrift compares the App's webhook URL, events and permissions with what
+// arc-setup would create for the mode. Only the webhook URL can be changed
+// through the API; events and permissions have to be changed by hand.
+func appDrift(ctx context.Context, state *State, vars Vars, githubHost githubInstance) ([]drift, error) {
+	client, err := newAppClient(ctx, githubHost, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := client.app(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		desiredEvents      []string
+		desiredPermissions map[string]string
+		desiredHookURL     string
+	)
+	if state.Mode.NeedsWebhook() {
+		if u, err := codespacesURL(); err == nil {
+			desiredHookURL = u + "/webhook"
+		}
+
+		caps, err := detectCapabilities(ctx, githubHost)
+		if err != nil {
+			return nil, err
+		}
+
+		m := buildGamfPayload(app.Slug, vars.Organization, githubHost.Name(), desiredHookURL, caps).Manifest
+		desiredEvents, desiredPermissions = m.DefaultEvents, m.DefaultPermissions
+	} else {
+		desiredPermissions = scaleSetAppPermissions
+	}
+
+	var drifts []drift
+
+	settings := drift{
+		Target: fmt.Sprintf("GitHub App %v events and permissions", app.Slug),
+		Manual: "update them at " + githubHost.AppPermissionsURL(vars.Organization, app.Slug),
+	}
+
+	liveEvents := append([]string{}, app.Events...)
+	sort.Strings(liveEvents)
+	wantEvents := append([]string{}, desiredEvents...)
+	sort.Strings(wantEvents)
+	if !reflect.DeepEqual(liveEvents, wantEvents) {
+		settings.Changes = append(settings.Changes, change{Path: "events", Live: liveEvents, Desired: wantEvents})
+	}
+
+	permissions := make([]string, 0, len(desiredPermissions))
+	for permission := range desiredPermissions {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+
+	for _, permission := range permissions {
+		access := desiredPermissions[permission]
+		if live, ok := app.Permissions[permission]; !ok {
+			settings.Changes = append(settings.Changes, change{Path: "permissions." + permission, Desired: access})
+		} else if live != access {
+			settings.Changes = append(settings.Changes, change{Path: "permissions." + permission, Live: live, Desired: access})
+		}
+	}
+
+	if len(settings.Changes) > 0 {
+		drifts = append(drifts, settings)
+	}
+
+	if desiredHookURL == "" {
+		return drifts, nil
+	}
+
+	cfg, err := client.hookConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.URL != desiredHookURL {
+		drifts = append(drifts, drift{
+			Target:  fmt.Sprintf("GitHub App %v webhook", app.Slug),
+			Changes: []change{{Path: "url", Live: cfg.URL, Desired: desiredHookURL}},
+			fix: func(w io.Writer) error {
+				if err := client.updateHookConfig(ctx, hookConfig{URL: desiredHookURL}); err != nil {
+					return err
+				}
+
+				fmt.Fprintf(w, "webhook URL updated to %v\n", desiredHookURL)
+
+				return nil
+			},
+		})
+	}
+
+	return drifts, nil
+}
+
+// normalize round trips v through JSON, so that it compares equal to values
+// decoded from API responses.
+func normalize(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding desired state: %w", err)
+	}
+
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("error decoding desired state: %w", err)
+	}
+
+	return out, nil
+}
+
+// diffValues compares normalized JSON values. With subset set, keys missing
+// from desired maps are ignored so that server populated fields are not
+// reported.
+func diffValues(path string, live, desired interface{}, subset bool) []change {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+
+		return path + "." + key
+	}
+
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return []change{{Path: path, Live: live, Desired: desired}}
+		}
+
+		var changes []change
+		for _, k := range sortedKeys(d) {
+			changes = append(changes, diffValues(join(k), l[k], d[k], subset)...)
+		}
+
+		if !subset {
+			for _, k := range sortedKeys(l) {
+				if _, ok := d[k]; !ok {
+					changes = append(changes, change{Path: join(k), Live: l[k]})
+				}
+			}
+		}
+
+		return changes
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return []change{{Path: path, Live: live, Desired: desired}}
+		}
+
+		var changes []change
+		for i := range d {
+			changes = append(changes, diffValues(fmt.Sprintf("%v[%v]", path, i), l[i], d[i], subset)...)
+		}
+
+		return changes
+	default:
+		if !reflect.DeepEqual(live, desired) {
+			return []change{{Path: path, Live: live, Desired: desired}}
+		}
+
+		return nil
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
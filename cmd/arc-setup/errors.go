@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// errorKind is a category of failure scripts can act on. Each maps to its
+// own exit code, documented in the README.
+type errorKind string
+
+const (
+	kindUnknown            errorKind = "unknown"
+	kindUsage              errorKind = "usage"
+	kindAuth               errorKind = "auth"
+	kindNetwork            errorKind = "network"
+	kindValidation         errorKind = "validation"
+	kindConversionExpired  errorKind = "conversion_expired"
+	kindClusterUnavailable errorKind = "cluster_unavailable"
+	kindCanceled           errorKind = "canceled"
+)
+
+// exitCodes are stable: scripts depend on them, so never renumber one.
+var exitCodes = map[errorKind]int{
+	kindUnknown:            1,
+	kindUsage:              2,
+	kindAuth:               3,
+	kindNetwork:            4,
+	kindValidation:         5,
+	kindConversionExpired:  6,
+	kindClusterUnavailable: 7,
+	kindCanceled:           130,
+}
+
+// setupError is a failure with a category, and a hint telling the user how to
+// fix it.
+type setupError struct {
+	Kind errorKind
+	Err  error
+
+	// Hint is what to do about it, in a sentence.
+	Hint string
+
+	// Docs links to further reading, if there is any worth following.
+	Docs string
+}
+
+func (e *setupError) Error() string { return e.Err.Error() }
+
+func (e *setupError) Unwrap() error { return e.Err }
+
+// ExitCode is the process exit code for the error's kind.
+func (e *setupError) ExitCode() int { return exitCodes[e.Kind] }
+
+func authError(err error, hint string) error {
+	return &setupError{
+		Kind: kindAuth,
+		Err:  err,
+		Hint: hint,
+		Docs: "https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app",
+	}
+}
+
+func conversionExpiredError(err error, hint string) error {
+	return &setupError{
+		Kind: kindConversionExpired,
+		Err:  err,
+		Hint: hint,
+		Docs: "https://docs.github.com/en/apps/sharing-github-apps/registering-a-github-app-from-a-manifest",
+	}
+}
+
+func clusterUnavailableError(err error) error {
+	return &setupError{
+		Kind: kindClusterUnavailable,
+		Err:  err,
+		Hint: "Check the cluster is running with `arc-setup cluster status`, and start it with `arc-setup cluster create`.",
+	}
+}
+
+func usageError(format string, a ...interface{}) error {
+	return &setupError{Kind: kindUsage, Err: fmt.Errorf(format, a...), Hint: "Run `arc-setup <command> -h` for usage."}
+}
+
+// parseFlags parses args into flags, marking a bad flag as a usage error.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	err := flags.Parse(args)
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+
+	return &setupError{Kind: kindUsage, Err: err}
+}
+
+// classifyError returns err as a setupError, inferring its kind from the
+// errors it wraps if it has not been given one.
+func classifyError(err error) *setupError {
+	var serr *setupError
+	if errors.As(err, &serr) {
+		return serr
+	}
+
+	var (
+		gerr *githubError
+		uerr *url.Error
+		nerr net.Error
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return &setupError{Kind: kindCanceled, Err: err, Hint: "Run arc-setup again to resume or roll back what was created."}
+	case errors.As(err, &gerr) && (gerr.StatusCode == http.StatusUnauthorized || gerr.StatusCode == http.StatusForbidden):
+		return &setupError{
+			Kind: kindAuth,
+			Err:  err,
+			Hint: "Check the App ID and private key in data/arc.env belong to the same App, and that the machine's clock is correct.",
+			Docs: "https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app",
+		}
+	case errors.As(err, &gerr) && gerr.StatusCode == http.StatusUnprocessableEntity:
+		return &setupError{
+			Kind: kindValidation,
+			Err:  err,
+			Hint: "GitHub rejected the request as invalid; the error above says which field.",
+			Docs: "https://docs.github.com/en/rest/overview/resources-in-the-rest-api#client-errors",
+		}
+	case errors.As(err, &uerr), errors.As(err, &nerr):
+		return &setupError{
+			Kind: kindNetwork,
+			Err:  err,
+			Hint: "Check the network connection, and ARC_HTTP_PROXY and ARC_CA_BUNDLE if GitHub is behind a proxy or an internal CA.",
+		}
+	default:
+		return &setupError{Kind: kindUnknown, Err: err}
+	}
+}
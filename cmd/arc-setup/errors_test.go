@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/AlecAivazis/survey/v2/terminal"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind errorKind
+		code int
+	}{
+		{name: "plain", err: errors.New("boom"), kind: kindUnknown, code: 1},
+		{name: "usage", err: usageError("unknown command %q", "nope"), kind: kindUsage, code: 2},
+		{name: "unauthorized", err: fmt.Errorf("step app failed: %w", &githubError{StatusCode: 401, Status: "401 Unauthorized"}), kind: kindAuth, code: 3},
+		{name: "network", err: &url.Error{Op: "Get", URL: "https://github.example.com", Err: errors.New("connection refused")}, kind: kindNetwork, code: 4},
+		{name: "validation", err: &githubError{StatusCode: 422, Status: "422 Unprocessable Entity"}, kind: kindValidation, code: 5},
+		{name: "conversion", err: conversionExpiredError(errors.New("gone"), "again"), kind: kindConversionExpired, code: 6},
+		{name: "cluster", err: clusterUnavailableError(&url.Error{Op: "Get", URL: "https://127.0.0.1:6443", Err: errors.New("connection refused")}), kind: kindClusterUnavailable, code: 7},
+		{name: "canceled", err: &url.Error{Op: "Post", URL: "https://gamf", Err: context.Canceled}, kind: kindCanceled, code: 130},
+		{name: "ctrl-c", err: handleSurveryErr(terminal.InterruptErr), kind: kindCanceled, code: 130},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyError(tt.err)
+			if got.Kind != tt.kind || got.ExitCode() != tt.code {
+				t.Errorf("got %v (exit %v), want %v (exit %v)", got.Kind, got.ExitCode(), tt.kind, tt.code)
+			}
+			if got.Error() != tt.err.Error() {
+				t.Errorf("got message %q, want %q", got.Error(), tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestExitCodesDistinct(t *testing.T) {
+	seen := map[int]errorKind{}
+	for kind, code := range exitCodes {
+		if other, ok := seen[code]; ok {
+			t.Errorf("%v and %v both exit %v", kind, other, code)
+		}
+		seen[code] = kind
+	}
+}
+
+func TestSetupMissingOrgsFails(t *testing.T) {
+	f := newFakeGitHub(t)
+	mem, _ := setupFake(t, f, ModeLegacy)
+	if err := mem.Remove(GitHubOrgsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := realMain(context.Background()); err == nil {
+		t.Fatal("setup succeeded without " + GitHubOrgsFile)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventType identifies a progress event. The values are a stable interface
+// for tooling that drives arc-setup with --output ndjson.
+type eventType string
+
+const (
+	eventStepStarted          eventType = "step_started"
+	eventStepFinished         eventType = "step_finished"
+	eventManifestStarted      eventType = "manifest_started"
+	eventActionRequired       eventType = "action_required"
+	eventExchangeCodeReceived eventType = "exchange_code_received"
+	eventAppConverted         eventType = "app_converted"
+	eventInstallationDetected eventType = "installation_detected"
+	eventEnvWritten           eventType = "env_written"
+	eventHelmInstalled        eventType = "helm_installed"
+	eventSetupInterrupted     eventType = "setup_interrupted"
+	eventError                eventType = "error"
+)
+
+// event is a single line of --output ndjson. Only the fields relevant to
+// Type are set.
+type event struct {
+	Time    time.Time `json:"time"`
+	Type    eventType `json:"type"`
+	Message string    `json:"message,omitempty"`
+
+	// URL is where the user needs to go, for action_required events.
+	URL string `json:"url,omitempty"`
+
+	// Input is what arc-setup reads from stdin once the action is done:
+	// "enter" for a newline, or "prompt" for an interactive question.
+	Input string `json:"input,omitempty"`
+
+	Step     string `json:"step,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Duration string `json:"duration,omitempty"`
+
+	AppID          int    `json:"app_id,omitempty"`
+	AppSlug        string `json:"app_slug,omitempty"`
+	Organization   string `json:"organization,omitempty"`
+	InstallationID string `json:"installation_id,omitempty"`
+
+	Release   string `json:"release,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Chart     string `json:"chart,omitempty"`
+	Version   string `json:"version,omitempty"`
+
+	Path string `json:"path,omitempty"`
+
+	// Error events carry the error's kind, what to do about it and the exit
+	// code arc-setup is about to exit with.
+	Error    string `json:"error,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+	Docs     string `json:"docs,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+type outputFormat string
+
+const (
+	outputText   outputFormat = "text"
+	outputNDJSON outputFormat = "ndjson"
+)
+
+var (
+	output   = outputText
+	outputMu sync.Mutex
+
+	// eventOutput is where --output ndjson writes events.
+	eventOutput io.Writer = os.Stdout
+)
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch f := outputFormat(s); f {
+	case "":
+		return outputText, nil
+	case outputText, outputNDJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown output %q (must be text or ndjson)", s)
+	}
+}
+
+// emit reports e. With --output ndjson it is written to stdout as a JSON
+// line; otherwise action_required events are printed for the user and the
+// rest are logged.
+func emit(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Message = redact(e.Message)
+	e.Error = redact(e.Error)
+
+	if output == outputNDJSON {
+		b, err := json.Marshal(e)
+		if err != nil {
+			logErrorf("error encoding event: %v", err)
+			return
+		}
+
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		fmt.Fprintf(eventOutput, "%s\n", b)
+
+		return
+	}
+
+	switch e.Type {
+	case eventActionRequired:
+		if e.URL != "" {
+			fmt.Printf("ℹ %v: %v\n", e.Message, e.URL)
+		} else {
+			fmt.Printf("ℹ %v\n", e.Message)
+		}
+	case eventError:
+		logErrorf("error: %v", e.Error)
+		if e.Hint != "" {
+			logInfof("%v", e.Hint)
+		}
+		if e.Docs != "" {
+			logInfof("See %v", e.Docs)
+		}
+	case eventStepStarted:
+		// The step's own output says what it is doing.
+	default:
+		if e.Message != "" {
+			logInfof("%v", e.Message)
+		}
+	}
+}
+
+// humanOutput is where output meant for a person goes: stdout, unless stdout
+// carries events.
+func humanOutput() io.Writer {
+	if output == outputNDJSON {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	env "github.com/Netflix/go-env"
+	"gopkg.in/yaml.v3"
+)
+
+// exportedConfig is the App's configuration with its secrets resolved, in
+// the shape every export format is built from.
+type exportedConfig struct {
+	EnterpriseURL  string `env:"ARC_GITHUB_ENTERPRISE_URL" json:"enterprise_url,omitempty"`
+	AppID          string `env:"ARC_GITHUB_APP_ID" json:"app_id"`
+	InstallationID string `env:"ARC_GITHUB_APP_INSTALLATION_ID" json:"installation_id"`
+	Organization   string `env:"ARC_GITHUB_APP_ORGANIZATION" json:"organization,omitempty"`
+	RunnerGroup    string `env:"ARC_GITHUB_APP_RUNNER_GROUP" json:"runner_group,omitempty"`
+	ConfigURL      string `env:"ARC_GITHUB_CONFIG_URL" json:"config_url,omitempty"`
+	ScaleSets      string `env:"ARC_RUNNER_SCALE_SETS" json:"scale_sets,omitempty"`
+	PrivateKey     string `env:"ARC_GITHUB_APP_PRIVATE_KEY" json:"private_key"`
+	WebhookSecret  string `env:"ARC_GITHUB_APP_WEBHOOK_SECRET" json:"webhook_secret,omitempty"`
+
+	RunnerGroupVisibility   string `env:"ARC_GITHUB_APP_RUNNER_GROUP_VISIBILITY" json:"runner_group_visibility,omitempty"`
+	RunnerGroupRepositories string `env:"ARC_GITHUB_APP_RUNNER_GROUP_REPOSITORIES" json:"runner_group_repositories,omitempty"`
+	RunnerGroupWorkflows    string `env:"ARC_GITHUB_APP_RUNNER_GROUP_WORKFLOWS" json:"runner_group_workflows,omitempty"`
+	RunnerGroupPublicRepos  string `env:"ARC_GITHUB_APP_RUNNER_GROUP_PUBLIC_REPOS" json:"runner_group_public_repos,omitempty"`
+}
+
+func exportConfig(ctx context.Context, vars Vars) (exportedConfig, error) {
+	key, err := vars.privateKeyPEM(ctx)
+	if err != nil {
+		return exportedConfig{}, err
+	}
+
+	secret, err := vars.webhookSecret(ctx)
+	if err != nil {
+		return exportedConfig{}, fmt.Errorf("failed to read webhook secret: %w", err)
+	}
+
+	return exportedConfig{
+		EnterpriseURL:  vars.EnterpriseURL,
+		AppID:          vars.AppID,
+		InstallationID: vars.InstallationID,
+		Organization:   vars.Organization,
+		RunnerGroup:    vars.RunnerGroup,
+		ConfigURL:      vars.ConfigURL,
+		ScaleSets:      vars.ScaleSets,
+		PrivateKey:     string(key),
+		WebhookSecret:  secret,
+
+		RunnerGroupVisibility:   vars.RunnerGroupVisibility,
+		RunnerGroupRepositories: vars.RunnerGroupRepositories,
+		RunnerGroupWorkflows:    vars.RunnerGroupWorkflows,
+		RunnerGroupPublicRepos:  vars.RunnerGroupPublicRepos,
+	}, nil
+}
+
+// vars returns the non-secret part of c. The secrets are stored separately,
+// see storeAppSecrets.
+func (c exportedConfig) vars() Vars {
+	return Vars{
+		EnterpriseURL:  c.EnterpriseURL,
+		AppID:          c.AppID,
+		InstallationID: c.InstallationID,
+		Organization:   c.Organization,
+		RunnerGroup:    c.RunnerGroup,
+		ConfigURL:      c.ConfigURL,
+		ScaleSets:      c.ScaleSets,
+
+		RunnerGroupVisibility:   c.RunnerGroupVisibility,
+		RunnerGroupRepositories: c.RunnerGroupRepositories,
+		RunnerGroupWorkflows:    c.RunnerGroupWorkflows,
+		RunnerGroupPublicRepos:  c.RunnerGroupPublicRepos,
+	}
+}
+
+func (c exportedConfig) validate() error {
+	if _, err := strconv.Atoi(c.AppID); err != nil {
+		return fmt.Errorf("invalid App ID %q", c.AppID)
+	}
+	if _, err := strconv.Atoi(c.InstallationID); err != nil {
+		return fmt.Errorf("invalid installation ID %q", c.InstallationID)
+	}
+	if _, err := parsePrivateKey([]byte(c.PrivateKey)); err != nil {
+		return err
+	}
+	if _, err := c.vars().runnerGroupPolicy(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// environ returns c keyed by environment variable name, without empty values.
+func (c exportedConfig) environ() (map[string]string, error) {
+	es, err := env.Marshal(&c)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding to env: %w", err)
+	}
+
+	for k, v := range es {
+		if v == "" {
+			delete(es, k)
+		}
+	}
+
+	return es, nil
+}
+
+func configFromEnviron(es map[string]string) (exportedConfig, error) {
+	var c exportedConfig
+	if err := env.Unmarshal(es, &c); err != nil {
+		return c, fmt.Errorf("error decoding env: %w", err)
+	}
+
+	return c, nil
+}
+
+// AnnotationPrefix namespaces the settings the helm and secret formats carry
+// as annotations, as the charts have no values for them.
+const AnnotationPrefix = "arc-setup/"
+
+func (c *exportedConfig) annotated() map[string]*string {
+	return map[string]*string{
+		AnnotationPrefix + "enterprise-url": &c.EnterpriseURL,
+		AnnotationPrefix + "organization":   &c.Organization,
+		AnnotationPrefix + "runner-group":   &c.RunnerGroup,
+		AnnotationPrefix + "config-url":     &c.ConfigURL,
+		AnnotationPrefix + "scale-sets":     &c.ScaleSets,
+
+		AnnotationPrefix + "runner-group-visibility":   &c.RunnerGroupVisibility,
+		AnnotationPrefix + "runner-group-repositories": &c.RunnerGroupRepositories,
+		AnnotationPrefix + "runner-group-workflows":    &c.RunnerGroupWorkflows,
+		AnnotationPrefix + "runner-group-public-repos": &c.RunnerGroupPublicRepos,
+	}
+}
+
+func (c exportedConfig) annotations() map[string]string {
+	a := map[string]string{}
+	for k, v := range c.annotated() {
+		if *v != "" {
+			a[k] = *v
+		}
+	}
+
+	return a
+}
+
+func (c *exportedConfig) setAnnotations(a map[string]string) {
+	for k, v := range c.annotated() {
+		if s, ok := a[k]; ok {
+			*v = s
+		}
+	}
+}
+
+// configFormat encodes and decodes exportedConfig in one format.
+type configFormat struct {
+	encode func(c exportedConfig, namespace string) ([]byte, error)
+	decode func(b []byte) (exportedConfig, error)
+}
+
+var configFormats = map[string]configFormat{
+	"dotenv": {encode: encodeDotenv, decode: decodeDotenv},
+	"json":   {encode: encodeJSON, decode: decodeJSON},
+	"helm":   {encode: encodeHelmValues, decode: decodeHelmValues},
+	"secret": {encode: encodeSecretManifest, decode: decodeSecretManifest},
+	"envrc":  {encode: encodeEnvrc, decode: decodeEnvrc},
+}
+
+func configFormatFor(name string) (configFormat, error) {
+	f, ok := configFormats[name]
+	if !ok {
+		names := make([]string, 0, len(configFormats))
+		for n := range configFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return f, fmt.Errorf("unknown format %q (must be one of %v)", name, strings.Join(names, ", "))
+	}
+
+	return f, nil
+}
+
+func exportMain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "dotenv", "output format: dotenv, json, helm, secret or envrc")
+	output := flags.String("output", "-", "file to write to, - for stdout")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	f, err := configFormatFor(*format)
+	if err != nil {
+		return err
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		return err
+	}
+
+	c, err := exportConfig(ctx, vars)
+	if err != nil {
+		return err
+	}
+
+	b, err := f.encode(c, secretsNamespace(state.Mode))
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+
+	// The output contains the App's private key.
+	if err := os.WriteFile(*output, b, 0600); err != nil {
+		return fmt.Errorf("error writing %v: %w", *output, err)
+	}
+
+	return nil
+}
+
+func importMain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "dotenv", "input format: dotenv, json, helm, secret or envrc")
+	input := flags.String("input", "-", "file to read from, - for stdin")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	f, err := configFormatFor(*format)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	if *input == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(*input)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	c, err := f.decode(b)
+	if err != nil {
+		return err
+	}
+
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	backend, err := chooseSecretsBackend(state)
+	if err != nil {
+		return err
+	}
+
+	vars := c.vars()
+	if err := storeAppSecrets(ctx, backend, &vars, []byte(c.PrivateKey), c.WebhookSecret); err != nil {
+		return err
+	}
+	if err := storeAppIDs(ctx, backend, vars); err != nil {
+		return err
+	}
+
+	if err := saveVars(vars); err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Imported App %v into %v, with its credentials in the %v secrets backend.\n", c.AppID, VarFileName, backend.Name())
+
+	return nil
+}
+
+func encodeDotenv(c exportedConfig, _ string) ([]byte, error) {
+	es, err := c.environ()
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalDotenv(es, "Exported by arc-setup, contains secrets."), nil
+}
+
+func decodeDotenv(b []byte) (exportedConfig, error) {
+	es, err := unmarshalDotenv(b)
+	if err != nil {
+		return exportedConfig{}, err
+	}
+
+	return configFromEnviron(es)
+}
+
+func encodeJSON(c exportedConfig, _ string) ([]byte, error) {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding json: %w", err)
+	}
+
+	return append(b, '\n'), nil
+}
+
+func decodeJSON(b []byte) (exportedConfig, error) {
+	var c exportedConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("error decoding json: %w", err)
+	}
+
+	return c, nil
+}
+
+// helmValues is the part of the actions-runner-controller chart values that
+// holds the App's credentials.
+type helmValues struct {
+	GithubEnterpriseServerURL string `yaml:"githubEnterpriseServerURL,omitempty"`
+
+	AuthSecret struct {
+		Create                  bool              `yaml:"create"`
+		Name                    string            `yaml:"name"`
+		Annotations             map[string]string `yaml:"annotations,omitempty"`
+		GithubAppID             string            `yaml:"github_app_id"`
+		GithubAppInstallationID string            `yaml:"github_app_installation_id"`
+		GithubAppPrivateKey     string            `yaml:"github_app_private_key"`
+	} `yaml:"authSecret"`
+
+	GithubWebhookServer *helmWebhookServerValues `yaml:"githubWebhookServer,omitempty"`
+}
+
+type helmWebhookServerValues struct {
+	Secret struct {
+		Create                   bool   `yaml:"create"`
+		Name                     string `yaml:"name"`
+		GithubWebhookSecretToken string `yaml:"github_webhook_secret_token"`
+	} `yaml:"secret"`
+}
+
+func encodeHelmValues(c exportedConfig, _ string) ([]byte, error) {
+	var v helmValues
+	v.GithubEnterpriseServerURL = c.EnterpriseURL
+	v.AuthSecret.Create = true
+	v.AuthSecret.Name = "arc-github-app"
+	v.AuthSecret.Annotations = c.annotations()
+	v.AuthSecret.GithubAppID = c.AppID
+	v.AuthSecret.GithubAppInstallationID = c.InstallationID
+	v.AuthSecret.GithubAppPrivateKey = c.PrivateKey
+
+	if c.WebhookSecret != "" {
+		v.GithubWebhookServer = &helmWebhookServerValues{}
+		v.GithubWebhookServer.Secret.Create = true
+		v.GithubWebhookServer.Secret.Name = "arc-webhook-server"
+		v.GithubWebhookServer.Secret.GithubWebhookSecretToken = c.WebhookSecret
+	}
+
+	return marshalYAML(v)
+}
+
+func decodeHelmValues(b []byte) (exportedConfig, error) {
+	var v helmValues
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return exportedConfig{}, fmt.Errorf("error decoding helm values: %w", err)
+	}
+
+	var c exportedConfig
+	c.setAnnotations(v.AuthSecret.Annotations)
+	if v.GithubEnterpriseServerURL != "" {
+		c.EnterpriseURL = v.GithubEnterpriseServerURL
+	}
+	c.AppID = v.AuthSecret.GithubAppID
+	c.InstallationID = v.AuthSecret.GithubAppInstallationID
+	c.PrivateKey = v.AuthSecret.GithubAppPrivateKey
+	if v.GithubWebhookServer != nil {
+		c.WebhookSecret = v.GithubWebhookServer.Secret.GithubWebhookSecretToken
+	}
+
+	return c, nil
+}
+
+type secretManifest struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name        string            `yaml:"name"`
+		Namespace   string            `yaml:"namespace,omitempty"`
+		Annotations map[string]string `yaml:"annotations,omitempty"`
+	} `yaml:"metadata"`
+	Type       string            `yaml:"type"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+}
+
+// value returns key from either stringData or data, as a Secret read back
+// from the cluster only has the latter.
+func (s secretManifest) value(key string) (string, error) {
+	if v, ok := s.StringData[key]; ok {
+		return v, nil
+	}
+
+	v, ok := s.Data[key]
+	if !ok {
+		return "", nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 in %v.%v: %w", s.Metadata.Name, key, err)
+	}
+
+	return string(b), nil
+}
+
+func newSecretManifest(namespace, name string, data map[string]string) secretManifest {
+	s := secretManifest{APIVersion: "v1", Kind: "Secret", Type: "Opaque", StringData: data}
+	s.Metadata.Name = name
+	s.Metadata.Namespace = namespace
+
+	return s
+}
+
+// encodeSecretManifest writes the Secrets the kubernetes secrets backend
+// would create, for applying with kubectl.
+func encodeSecretManifest(c exportedConfig, namespace string) ([]byte, error) {
+	app := newSecretManifest(namespace, kubernetesSecretNames[secretPrivateKey], map[string]string{
+		secretAppID:          c.AppID,
+		secretInstallationID: c.InstallationID,
+		secretPrivateKey:     c.PrivateKey,
+	})
+	app.Metadata.Annotations = c.annotations()
+
+	docs := []secretManifest{app}
+	if c.WebhookSecret != "" {
+		docs = append(docs, newSecretManifest(namespace, kubernetesSecretNames[secretWebhookSecret], map[string]string{
+			secretWebhookSecret: c.WebhookSecret,
+		}))
+	}
+
+	var out []byte
+	for i, d := range docs {
+		b, err := marshalYAML(d)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			out = append(out, "---\n"...)
+		}
+		out = append(out, b...)
+	}
+
+	return out, nil
+}
+
+func decodeSecretManifest(b []byte) (exportedConfig, error) {
+	var c exportedConfig
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var s secretManifest
+		err := dec.Decode(&s)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return c, fmt.Errorf("error decoding secret manifest: %w", err)
+		}
+
+		if s.Kind != "Secret" {
+			continue
+		}
+
+		var fields map[string]*string
+		switch s.Metadata.Name {
+		case kubernetesSecretNames[secretPrivateKey]:
+			c.setAnnotations(s.Metadata.Annotations)
+			fields = map[string]*string{
+				secretAppID:          &c.AppID,
+				secretInstallationID: &c.InstallationID,
+				secretPrivateKey:     &c.PrivateKey,
+			}
+		case kubernetesSecretNames[secretWebhookSecret]:
+			fields = map[string]*string{secretWebhookSecret: &c.WebhookSecret}
+		}
+
+		for key, field := range fields {
+			v, err := s.value(key)
+			if err != nil {
+				return c, err
+			}
+			*field = v
+		}
+	}
+
+	return c, nil
+}
+
+// encodeEnvrc writes a direnv .envrc, single quoting values so the shell
+// takes them literally.
+func encodeEnvrc(c exportedConfig, _ string) ([]byte, error) {
+	es, err := c.environ()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by arc-setup export, contains secrets.\n")
+	for _, k := range sortedEnvKeys(es) {
+		fmt.Fprintf(&buf, "export %v='%v'\n", k, strings.ReplaceAll(es[k], "'", `'\''`))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeEnvrc reads the subset of shell encodeEnvrc writes: comments and
+// export assignments of quoted or unquoted words, with no expansion.
+func decodeEnvrc(b []byte) (exportedConfig, error) {
+	es := map[string]string{}
+	s := string(b)
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\n':
+			i++
+			continue
+		case s[i] == '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			continue
+		}
+
+		if strings.HasPrefix(s[i:], "export ") {
+			i += len("export ")
+		}
+
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 || !envNameRe.MatchString(s[i:i+eq]) {
+			return exportedConfig{}, fmt.Errorf("invalid .envrc line at offset %v", i)
+		}
+		name := s[i : i+eq]
+		i += eq + 1
+
+		var v strings.Builder
+	word:
+		for i < len(s) {
+			switch c := s[i]; c {
+			case ' ', '\t', '\n':
+				break word
+			case '\'':
+				end := strings.IndexByte(s[i+1:], '\'')
+				if end < 0 {
+					return exportedConfig{}, fmt.Errorf("unterminated quote in %v", name)
+				}
+				v.WriteString(s[i+1 : i+1+end])
+				i += end + 2
+			case '\\':
+				if i+1 < len(s) {
+					v.WriteByte(s[i+1])
+				}
+				i += 2
+			case '"', '$', '`':
+				return exportedConfig{}, fmt.Errorf("unsupported %q in %v, only single quoted values can be imported", c, name)
+			default:
+				v.WriteByte(c)
+				i++
+			}
+		}
+
+		es[name] = v.String()
+	}
+
+	return configFromEnviron(es)
+}
+
+func marshalYAML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("error encoding yaml: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding yaml: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func sortedEnvKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
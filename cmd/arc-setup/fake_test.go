@@ -0,0 +1,671 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/AlecAivazis/survey/v2/terminal"
+)
+
+// fakeGitHub is an httptest server playing both gamf, under /gamf, and a
+// GHES instance, under /api/v3. Its fields script how it misbehaves.
+type fakeGitHub struct {
+	*httptest.Server
+	t *testing.T
+
+	// CodeAfter is how many polls of /gamf/code return 404 before the
+	// exchange code is ready.
+	CodeAfter int
+
+	// ConversionStatuses are returned, in order, by the first conversion
+	// attempts before one succeeds. A 403 is a secondary rate limit.
+	ConversionStatuses []int
+
+	// ConversionBody replaces the conversion response, e.g. with bad JSON.
+	ConversionBody string
+
+	// InstalledAfter is how many polls of /app/installations return none.
+	InstalledAfter int
+
+	// Version is the GHES version reported by /meta.
+	Version string
+
+	// RateLimitReset is when the budget reported in X-RateLimit headers
+	// resets. GHES with rate limiting disabled is played by leaving it zero.
+	RateLimitReset time.Time
+
+	// TokenScopes are the bodies of every installation token request.
+	TokenScopes []tokenScope
+
+	// Runners are the org's self-hosted runners.
+	Runners []githubRunner
+
+	// Deliveries are the App's webhook deliveries, newest first, and
+	// HookConfigStatus, if set, fails updates to its webhook with it.
+	Deliveries       []hookDelivery
+	HookConfigStatus int
+
+	// RunnerGroups are the org's runner groups, GroupRepositories the IDs
+	// of the repositories selected to use each, and Repositories the org's
+	// repository IDs by name.
+	RunnerGroups      []runnerGroup
+	GroupRepositories map[int64][]int64
+	Repositories      map[string]int64
+
+	AppID   int
+	Slug    string
+	Org     string
+	Key     *rsa.PrivateKey
+	Secret  string
+	Install int64
+
+	mu       sync.Mutex
+	requests []string
+	payload  gamfPayload
+	codes    int
+	installs int
+	apiCalls int
+}
+
+const (
+	fakeExchangeCode      = "c0de"
+	fakeInstallationToken = "ghs_fake"
+)
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeGitHub{
+		t:       t,
+		Version: "3.12.0",
+		AppID:   42,
+		Slug:    "arc-test",
+		Org:     "acme",
+		Key:     key,
+		Secret:  "webhook-secret",
+		Install: 7,
+
+		RateLimitReset: time.Now().Add(time.Hour),
+
+		RunnerGroups:      []runnerGroup{{ID: 1, Name: "Default", Visibility: "all", AllowsPublicRepositories: true}},
+		GroupRepositories: map[int64][]int64{},
+		Repositories:      map[string]int64{"api": 101, "web": 102, "infra": 103},
+	}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// PEM is the App's private key, as the conversion returns it.
+func (f *fakeGitHub) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(f.Key)})
+}
+
+// Host is the fake's address, as written to data/github_host.txt.
+func (f *fakeGitHub) Host() string {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return u.Host
+}
+
+// Requests are the method and path of every request made so far.
+func (f *fakeGitHub) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeGitHub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set("X-GitHub-Request-Id", fmt.Sprintf("FAKE:%v", len(f.requests)))
+	if strings.HasPrefix(r.URL.Path, "/api/v3/") && !f.RateLimitReset.IsZero() {
+		f.apiCalls++
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(5000-f.apiCalls))
+		w.Header().Set("X-RateLimit-Used", strconv.Itoa(f.apiCalls))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(f.RateLimitReset.Unix(), 10))
+		w.Header().Set("X-RateLimit-Resource", "core")
+	}
+
+	switch path := r.URL.Path; {
+	case r.Method == http.MethodPost && path == "/gamf/start":
+		if err := json.NewDecoder(r.Body).Decode(&f.payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{"key": "k3y", "url": f.URL + "/gamf/k3y"})
+
+	case r.Method == http.MethodPost && path == "/gamf/code/k3y":
+		f.codes++
+		if f.codes <= f.CodeAfter {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, map[string]string{"code": fakeExchangeCode})
+
+	case r.Method == http.MethodGet && path == "/api/v3/meta":
+		w.Header().Set("X-GitHub-Enterprise-Version", f.Version)
+		writeJSON(w, map[string]interface{}{"installed_version": f.Version, "verifiable_password_authentication": true})
+
+	case r.Method == http.MethodPost && path == "/api/v3/app-manifests/"+fakeExchangeCode+"/conversions":
+		if len(f.ConversionStatuses) > 0 {
+			status := f.ConversionStatuses[0]
+			f.ConversionStatuses = f.ConversionStatuses[1:]
+			if status == http.StatusForbidden {
+				w.Header().Set("Retry-After", "0")
+			}
+			message := http.StatusText(status)
+			if status == http.StatusForbidden {
+				message = "You have exceeded a secondary rate limit. Please wait a few minutes before you try again."
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			writeJSON(w, map[string]interface{}{
+				"message":           message,
+				"errors":            []interface{}{map[string]string{"resource": "Integration", "code": "custom", "message": "fake failure"}},
+				"documentation_url": "https://docs.github.com/rest",
+			})
+			return
+		}
+		if f.ConversionBody != "" {
+			io.WriteString(w, f.ConversionBody)
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"id":             f.AppID,
+			"slug":           f.Slug,
+			"webhook_secret": f.Secret,
+			"pem":            string(f.PEM()),
+		})
+
+	case r.Method == http.MethodGet && path == "/api/v3/app":
+		if !f.authorized(w, r) {
+			return
+		}
+		writeJSON(w, githubApp{ID: f.AppID, Slug: f.Slug, Events: f.payload.Manifest.DefaultEvents})
+
+	case r.Method == http.MethodGet && path == "/api/v3/app/installations":
+		if !f.authorized(w, r) {
+			return
+		}
+		f.installs++
+		installations := []interface{}{}
+		if f.installs > f.InstalledAfter {
+			installations = append(installations, map[string]interface{}{"id": f.Install, "account": map[string]string{"login": f.Org}})
+		}
+		etag := fmt.Sprintf(`"installations-%v"`, len(installations))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, installations)
+
+	case r.Method == http.MethodPost && path == fmt.Sprintf("/api/v3/app/installations/%v/access_tokens", f.Install):
+		if !f.authorized(w, r) {
+			return
+		}
+		var scope tokenScope
+		if err := json.NewDecoder(r.Body).Decode(&scope); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.TokenScopes = append(f.TokenScopes, scope)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(installationToken{Token: fakeInstallationToken, ExpiresAt: time.Now().Add(time.Hour).UTC(), Permissions: scope.Permissions})
+
+	case r.Method == http.MethodGet && path == "/api/v3/orgs/"+f.Org+"/actions/runners":
+		if !f.installationAuthorized(w, r) {
+			return
+		}
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if perPage < 1 {
+			perPage = 30
+		}
+		if page < 1 {
+			page = 1
+		}
+		runners := []githubRunner{}
+		for i := (page - 1) * perPage; i < len(f.Runners) && i < page*perPage; i++ {
+			runners = append(runners, f.Runners[i])
+		}
+		writeJSON(w, map[string]interface{}{"total_count": len(f.Runners), "runners": runners})
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/api/v3/orgs/"+f.Org+"/actions/runners/"):
+		if !f.installationAuthorized(w, r) {
+			return
+		}
+		id, _ := strconv.ParseInt(strings.TrimPrefix(path, "/api/v3/orgs/"+f.Org+"/actions/runners/"), 10, 64)
+		for i, runner := range f.Runners {
+			if runner.ID == id {
+				f.Runners = append(f.Runners[:i], f.Runners[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.NotFound(w, r)
+
+	case r.Method == http.MethodPatch && path == "/api/v3/app/hook/config":
+		if !f.authorized(w, r) {
+			return
+		}
+		if f.HookConfigStatus != 0 {
+			http.Error(w, `{"message":"Validation Failed"}`, f.HookConfigStatus)
+			return
+		}
+		var cfg hookConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.Secret != "" {
+			f.Secret = cfg.Secret
+		}
+		writeJSON(w, hookConfig{URL: cfg.URL, ContentType: "json"})
+
+	case r.Method == http.MethodGet && path == "/api/v3/app/hook/deliveries":
+		if !f.authorized(w, r) {
+			return
+		}
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		cursor, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		if perPage < 1 {
+			perPage = 30
+		}
+		end := cursor + perPage
+		if end >= len(f.Deliveries) {
+			end = len(f.Deliveries)
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`<%v%v?per_page=%v&cursor=%v>; rel="next"`, f.URL, path, perPage, end))
+		}
+		deliveries := []hookDelivery{}
+		if cursor < end {
+			deliveries = f.Deliveries[cursor:end]
+		}
+		writeJSON(w, deliveries)
+
+	case r.Method == http.MethodGet && path == "/api/v3/orgs/"+f.Org+"/actions/runner-groups":
+		if !f.installationAuthorized(w, r) {
+			return
+		}
+		writeJSON(w, map[string]interface{}{"total_count": len(f.RunnerGroups), "runner_groups": f.RunnerGroups})
+
+	case strings.HasPrefix(path, "/api/v3/orgs/"+f.Org+"/actions/runner-groups/"):
+		if !f.installationAuthorized(w, r) {
+			return
+		}
+		rest := strings.TrimPrefix(path, "/api/v3/orgs/"+f.Org+"/actions/runner-groups/")
+		idPart, sub, _ := cut(rest, "/")
+		id, _ := strconv.ParseInt(idPart, 10, 64)
+		var group *runnerGroup
+		for i := range f.RunnerGroups {
+			if f.RunnerGroups[i].ID == id {
+				group = &f.RunnerGroups[i]
+			}
+		}
+		if group == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPatch && sub == "":
+			var update runnerGroup
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			update.ID = id
+			if !update.RestrictedToWorkflows {
+				update.SelectedWorkflows = nil
+			}
+			*group = update
+			writeJSON(w, group)
+		case r.Method == http.MethodGet && sub == "repositories":
+			repos := []groupRepository{}
+			for _, repoID := range f.GroupRepositories[id] {
+				for name, rid := range f.Repositories {
+					if rid == repoID {
+						repos = append(repos, groupRepository{ID: rid, Name: name})
+					}
+				}
+			}
+			writeJSON(w, map[string]interface{}{"total_count": len(repos), "repositories": repos})
+		case r.Method == http.MethodPut && sub == "repositories":
+			if group.Visibility != "selected" {
+				http.Error(w, `{"message":"Visibility must be selected"}`, http.StatusUnprocessableEntity)
+				return
+			}
+			var body struct {
+				IDs []int64 `json:"selected_repository_ids"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			f.GroupRepositories[id] = body.IDs
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/api/v3/repos/"+f.Org+"/"):
+		if !f.installationAuthorized(w, r) {
+			return
+		}
+		name := strings.TrimPrefix(path, "/api/v3/repos/"+f.Org+"/")
+		id, ok := f.Repositories[name]
+		if !ok {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, groupRepository{ID: id, Name: name})
+
+	case r.Method == http.MethodGet && path == "/api/v3/rate_limit":
+		if f.RateLimitReset.IsZero() {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, `{"message":"Requires authentication"}`, http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"resources": map[string]interface{}{}})
+
+	case r.Method == http.MethodDelete && path == fmt.Sprintf("/api/v3/app/installations/%v", f.Install):
+		if !f.authorized(w, r) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized checks the request carries a JWT signed by the App's key.
+func (f *fakeGitHub) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		http.Error(w, `{"message":"A JSON web token could not be decoded"}`, http.StatusUnauthorized)
+		return false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		http.Error(w, `{"message":"A JSON web token could not be decoded"}`, http.StatusUnauthorized)
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&f.Key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// installationAuthorized checks the request carries the installation token.
+func (f *fakeGitHub) installationAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+fakeInstallationToken {
+		http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// memFileSystem is a fileSystem in memory.
+type memFileSystem struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+}
+
+func newMemFileSystem() *memFileSystem { return &memFileSystem{files: fstest.MapFS{}} }
+
+func (m *memFileSystem) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.files.ReadFile(name)
+}
+
+func (m *memFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[name] = &fstest.MapFile{Data: append([]byte(nil), data...), Mode: perm, ModTime: time.Now()}
+
+	return nil
+}
+
+func (m *memFileSystem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.files.Stat(name)
+}
+
+func (m *memFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+
+	return nil
+}
+
+// scriptedPrompter answers prompts whose message contains a key of answers,
+// running their validators as survey would.
+type scriptedPrompter struct {
+	answers map[string]string
+	asked   []string
+	enters  int
+
+	// onEnter runs when the user would press enter, e.g. to interrupt.
+	onEnter func()
+
+	// interruptAt is a prompt the user presses ctrl-c at.
+	interruptAt string
+}
+
+func (s *scriptedPrompter) ask(p survey.Prompt, t interface{}, opts ...survey.AskOpt) error {
+	var message string
+	switch p := p.(type) {
+	case *survey.Input:
+		message = p.Message
+	case *survey.Select:
+		message = p.Message
+	case *survey.Password:
+		message = p.Message
+	default:
+		return fmt.Errorf("unexpected prompt %T", p)
+	}
+	s.asked = append(s.asked, message)
+
+	if s.interruptAt != "" && strings.Contains(message, s.interruptAt) {
+		s.interruptAt = ""
+		return handleSurveryErr(terminal.InterruptErr)
+	}
+
+	for k, answer := range s.answers {
+		if !strings.Contains(message, k) {
+			continue
+		}
+
+		var options survey.AskOptions
+		for _, opt := range opts {
+			if err := opt(&options); err != nil {
+				return err
+			}
+		}
+		for _, v := range options.Validators {
+			if err := v(answer); err != nil {
+				return fmt.Errorf("%q: %w", message, err)
+			}
+		}
+
+		out, ok := t.(*string)
+		if !ok {
+			return fmt.Errorf("unexpected answer type %T", t)
+		}
+		*out = answer
+
+		return nil
+	}
+
+	return fmt.Errorf("unexpected prompt %q", message)
+}
+
+func (s *scriptedPrompter) waitForEnter(ctx context.Context) error {
+	s.enters++
+	if s.onEnter != nil {
+		s.onEnter()
+	}
+
+	return ctx.Err()
+}
+
+// fakeKube is an API server holding Namespaces and Secrets, pointed at by a
+// kubeconfig in KUBECONFIG. Services are known but never found.
+type fakeKube struct {
+	*httptest.Server
+
+	mu sync.Mutex
+
+	// Secrets are the data of each Secret, by namespace/name.
+	Secrets map[string]map[string]string
+}
+
+func newFakeKube(t *testing.T) *fakeKube {
+	t.Helper()
+
+	k := &fakeKube{Secrets: map[string]map[string]string{}}
+	k.Server = httptest.NewServer(http.HandlerFunc(k.serveHTTP))
+	t.Cleanup(k.Close)
+
+	config := filepath.Join(t.TempDir(), "config")
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: fake
+contexts:
+- name: fake
+  context: {cluster: fake, user: fake}
+clusters:
+- name: fake
+  cluster: {server: "` + k.URL + `"}
+users:
+- name: fake
+  user: {token: fake}
+`
+	if err := os.WriteFile(config, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", config)
+
+	return k
+}
+
+// Secret returns the decoded value of key in Secret namespace/name.
+func (k *fakeKube) Secret(namespace, name, key string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	b, _ := base64.StdEncoding.DecodeString(k.Secrets[namespace+"/"+name][key])
+
+	return string(b)
+}
+
+func (k *fakeKube) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1":
+		writeJSON(w, map[string]interface{}{"resources": []apiResource{
+			{Name: "namespaces", Kind: "Namespace"},
+			{Name: "secrets", Kind: "Secret", Namespaced: true},
+			{Name: "services", Kind: "Service", Namespaced: true},
+		}})
+
+	case r.Method == http.MethodPatch && len(parts) == 3 && parts[1] == "namespaces":
+		writeJSON(w, map[string]interface{}{})
+
+	case len(parts) == 5 && parts[1] == "namespaces" && parts[3] == "secrets":
+		key := parts[2] + "/" + parts[4]
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := k.Secrets[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				writeJSON(w, map[string]interface{}{"reason": "NotFound", "message": "secrets " + parts[4] + " not found"})
+				return
+			}
+			writeJSON(w, map[string]interface{}{"data": data})
+		case http.MethodPatch:
+			var secret struct {
+				Data map[string]string `json:"data"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			k.Secrets[key] = secret.Data
+			writeJSON(w, secret)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]interface{}{"reason": "NotFound"})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestGofmt fails on any file gofmt would change, so no commit can leave one
+// unformatted.
+func TestGofmt(t *testing.T) {
+	names, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		formatted, err := format.Source(b)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(b, formatted) {
+			t.Errorf("%v is not gofmt-formatted, run gofmt -w %v", name, name)
+		}
+	}
+}
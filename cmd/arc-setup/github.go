@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// appJWT mints a short lived JWT authenticating as the GitHub App appID,
+// signed with the PEM encoded privateKey.
+func appJWT(appID string, privateKey []byte) (string, error) {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return signJWT(appID, key, time.Now())
+}
+
+func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+// signJWT builds an RS256 JWT for appID. iat is backdated to allow for clock
+// drift, and exp is within GitHub's ten minute limit.
+func signJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("error signing jwt: %w", err)
+	}
+
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// githubError is a non-2xx response from the GitHub API, with the details
+// from its error body.
+type githubError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+
+	Message          string
+	Errors           []githubFieldError
+	DocumentationURL string
+
+	// RequestID is X-GitHub-Request-Id, which GitHub support asks for.
+	RequestID string
+
+	// RetryAfter is how long Retry-After asks to wait, if it was set, or
+	// until the rate limit resets.
+	RetryAfter time.Duration
+
+	// RateLimited is set when the request hit a primary or secondary rate
+	// limit.
+	RateLimited bool
+
+	// AfterServerError is set when an earlier attempt failed with a server
+	// error, so a request that isn't idempotent may already have taken
+	// effect.
+	AfterServerError bool
+}
+
+// githubFieldError is an entry of a 422's errors, saying what was wrong with
+// which field.
+type githubFieldError struct {
+	Resource string `json:"resource"`
+	Field    string `json:"field"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// UnmarshalJSON also accepts the plain strings some endpoints use as errors.
+func (e *githubFieldError) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*e = githubFieldError{Message: s}
+		return nil
+	}
+
+	type plain githubFieldError
+
+	return json.Unmarshal(b, (*plain)(e))
+}
+
+func (e githubFieldError) String() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if e.Field == "" {
+		return e.Code
+	}
+
+	return fmt.Sprintf("%v %v", e.Field, e.Code)
+}
+
+func (e *githubError) Error() string {
+	msg := fmt.Sprintf("%v %v: got status %v", e.Method, e.URL, e.Status)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if len(e.Errors) > 0 {
+		details := make([]string, len(e.Errors))
+		for i, fe := range e.Errors {
+			details[i] = fe.String()
+		}
+		msg += " (" + strings.Join(details, "; ") + ")"
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" [request ID %v]", e.RequestID)
+	}
+
+	return msg
+}
+
+// transient reports whether the request may succeed if retried: server
+// errors, and rate limits that say when to come back.
+func (e *githubError) transient() bool {
+	switch {
+	case e.StatusCode >= 500:
+		return true
+	case e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode == http.StatusForbidden:
+		return e.RetryAfter > 0 || e.RateLimited
+	default:
+		return false
+	}
+}
+
+// newGitHubError reads a failed response into a githubError. Bodies which
+// aren't GitHub's error JSON, e.g. from a proxy, leave Message empty.
+func newGitHubError(method, url string, res *http.Response) *githubError {
+	e := &githubError{
+		Method:     method,
+		URL:        url,
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		RequestID:  res.Header.Get("X-GitHub-Request-Id"),
+	}
+
+	var body struct {
+		Message          string             `json:"message"`
+		Errors           []githubFieldError `json:"errors"`
+		DocumentationURL string             `json:"documentation_url"`
+	}
+	if json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body) == nil {
+		e.Message, e.Errors, e.DocumentationURL = body.Message, body.Errors, body.DocumentationURL
+	}
+
+	retryAfter := res.Header.Get("Retry-After")
+	if retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil && secs >= 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		}
+	}
+
+	if e.StatusCode != http.StatusForbidden && e.StatusCode != http.StatusTooManyRequests {
+		return e
+	}
+
+	secondary := strings.Contains(strings.ToLower(e.Message), "secondary rate limit")
+	reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	primary := res.Header.Get("X-RateLimit-Remaining") == "0" && err == nil
+	e.RateLimited = secondary || primary
+
+	switch {
+	case retryAfter != "":
+		// GitHub said how long to wait.
+	case primary:
+		// The primary rate limit is lifted at reset.
+		if d := time.Until(time.Unix(reset, 0)); d > 0 {
+			e.RetryAfter = d
+		}
+	case secondary:
+		e.RetryAfter = secondaryRateLimitDelay
+	}
+
+	return e
+}
+
+// githubMaxAttempts is how many times githubRequest tries a request which
+// keeps failing transiently, and githubRetryDelay the delay before the first
+// retry, doubling after, when GitHub doesn't say how long to wait.
+var (
+	githubMaxAttempts = 4
+	githubRetryDelay  = 2 * time.Second
+)
+
+// secondaryRateLimitDelay is how long to back off from a secondary rate limit
+// which doesn't say, as GitHub's docs recommend.
+var secondaryRateLimitDelay = time.Minute
+
+// githubRetry is which transient failures a request is retried after. A rate
+// limited request wasn't acted on, but one that failed with a server error
+// may have been.
+type githubRetry int
+
+const (
+	// retryIdempotent retries server errors only for methods that are safe
+	// to repeat.
+	retryIdempotent githubRetry = iota
+
+	// retryServerErrors retries server errors whatever the method, for
+	// requests the caller knows are safe to repeat.
+	retryServerErrors
+
+	// retryNever makes a single attempt.
+	retryNever
+)
+
+// allows reports whether a request with method may be retried after gerr.
+func (r githubRetry) allows(method string, gerr *githubError) bool {
+	switch {
+	case r == retryNever || !gerr.transient():
+		return false
+	case gerr.StatusCode >= 500:
+		return r == retryServerErrors || idempotent(method)
+	default:
+		return true
+	}
+}
+
+// idempotent reports whether making a request with method twice has the same
+// effect as making it once.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// githubRequest makes a GitHub API request, authenticated with token if it is
+// set, decoding a JSON response into out if it is not nil. Transient
+// failures are retried, server errors only if method is idempotent; others
+// fail at once with GitHub's explanation.
+func githubRequest(ctx context.Context, method, url, token string, body, out interface{}) error {
+	return githubRequestWith(ctx, retryIdempotent, method, url, token, body, out)
+}
+
+// githubRequestWith is githubRequest, retrying as retry says.
+func githubRequestWith(ctx context.Context, retry githubRetry, method, url, token string, body, out interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("error encoding request: %w", err)
+		}
+	}
+
+	delay := githubRetryDelay
+	afterServerError := false
+	for attempt := 1; ; attempt++ {
+		gerr, err := githubAttempt(ctx, method, url, token, b, out)
+		if err != nil || gerr == nil {
+			return err
+		}
+		gerr.AfterServerError = afterServerError
+
+		if !retry.allows(method, gerr) || attempt >= githubMaxAttempts {
+			return gerr
+		}
+		afterServerError = afterServerError || gerr.StatusCode >= 500
+
+		wait := delay
+		if gerr.RetryAfter > 0 {
+			wait = gerr.RetryAfter
+		}
+		logWarnf("%v, retrying in %v (attempt %v of %v)...", gerr, wait, attempt, githubMaxAttempts)
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// githubAttempt makes a single githubRequest, returning a non-2xx response as
+// a githubError and anything else that went wrong as err.
+func githubAttempt(ctx context.Context, method, url, token string, body []byte, out interface{}) (*githubError, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	key := credentialKey(req.URL.Host, token)
+	if err := githubLimits.wait(ctx, key); err != nil {
+		return nil, err
+	}
+
+	// The cache keeps bodies, not the Link header linked pages need.
+	_, linked := out.(*linkedPage)
+
+	cacheKey := key + " " + url
+	cached, conditional := githubETags.get(cacheKey)
+	conditional = conditional && method == http.MethodGet && out != nil && !linked
+	if conditional {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request to GitHub: %w", err)
+	}
+	defer res.Body.Close()
+
+	if id := res.Header.Get("X-GitHub-Request-Id"); id != "" {
+		logDebugf("%v %v: request ID %v", method, url, id)
+	}
+	githubLimits.update(key, res.Header)
+
+	if res.StatusCode == http.StatusNotModified && conditional {
+		logDebugf("%v %v: not modified", method, url)
+		return nil, decodeGitHubResponse(cached.body, out)
+	}
+
+	if res.StatusCode > 399 || res.StatusCode < 200 {
+		return newGitHubError(method, url, res), nil
+	}
+
+	if out == nil {
+		return nil, nil
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	if etag := res.Header.Get("ETag"); etag != "" && method == http.MethodGet && !linked {
+		githubETags.put(cacheKey, etag, b)
+	}
+	if p, ok := out.(*linkedPage); ok {
+		p.next = nextLink(res.Header.Get("Link"))
+	}
+
+	return nil, decodeGitHubResponse(b, out)
+}
+
+// linkedPage decodes a page of a cursor paginated list into out, keeping the
+// URL of the next page from the Link header.
+type linkedPage struct {
+	out  interface{}
+	next string
+}
+
+func (p *linkedPage) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, p.out)
+}
+
+// nextLink returns the rel="next" URL of a Link header, or "" on the last
+// page.
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+
+		return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(target), "<"), ">")
+	}
+
+	return ""
+}
+
+func decodeGitHubResponse(b []byte, out interface{}) error {
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return nil
+}
+
+// githubApp is the subset of GET /app arc-setup checks.
+type githubApp struct {
+	ID          int               `json:"id"`
+	Slug        string            `json:"slug"`
+	Events      []string          `json:"events"`
+	Permissions map[string]string `json:"permissions"`
+}
+
+type hookConfig struct {
+	URL         string `json:"url,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Secret      string `json:"secret,omitempty"`
+}
+
+// appClient talks to the GitHub API as the App from arc.env.
+type appClient struct {
+	apiURL string
+	jwt    string
+}
+
+func newAppClient(ctx context.Context, githubHost githubInstance, vars Vars) (*appClient, error) {
+	if _, err := strconv.Atoi(vars.AppID); err != nil {
+		return nil, fmt.Errorf("invalid App ID %q", vars.AppID)
+	}
+
+	key, err := vars.privateKeyPEM(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	jwt, err := appJWT(vars.AppID, key)
+	if err != nil {
+		return nil, authError(err, "The App's private key is unusable; generate a new one with `arc-setup rotate private-key`.")
+	}
+
+	return &appClient{apiURL: githubHost.APIURL(), jwt: jwt}, nil
+}
+
+func (c *appClient) app(ctx context.Context) (githubApp, error) {
+	var app githubApp
+	err := githubRequest(ctx, http.MethodGet, c.apiURL+"/app", c.jwt, nil, &app)
+
+	return app, err
+}
+
+func (c *appClient) hookConfig(ctx context.Context) (hookConfig, error) {
+	var cfg hookConfig
+	err := githubRequest(ctx, http.MethodGet, c.apiURL+"/app/hook/config", c.jwt, nil, &cfg)
+
+	return cfg, err
+}
+
+func (c *appClient) updateHookConfig(ctx context.Context, cfg hookConfig) error {
+	// Setting the same config twice is harmless.
+	return githubRequestWith(ctx, retryServerErrors, http.MethodPatch, c.apiURL+"/app/hook/config", c.jwt, cfg, nil)
+}
+
+// hookDelivery is the subset of a webhook delivery arc-setup inspects.
+type hookDelivery struct {
+	ID          int64     `json:"id"`
+	GUID        string    `json:"guid"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	Redelivery  bool      `json:"redelivery"`
+	StatusCode  int       `json:"status_code"`
+	Event       string    `json:"event"`
+}
+
+// hookDeliveries lists the App's webhook deliveries, newest first, back to
+// the first page reaching before since.
+func (c *appClient) hookDeliveries(ctx context.Context, since time.Time) ([]hookDelivery, error) {
+	var deliveries []hookDelivery
+	for url := c.apiURL + "/app/hook/deliveries?per_page=100"; url != ""; {
+		var page []hookDelivery
+		linked := &linkedPage{out: &page}
+		if err := githubRequest(ctx, http.MethodGet, url, c.jwt, nil, linked); err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, page...)
+		if len(page) == 0 || page[len(page)-1].DeliveredAt.Before(since) {
+			break
+		}
+		url = linked.next
+	}
+
+	return deliveries, nil
+}
+
+func (c *appClient) redeliver(ctx context.Context, id int64) error {
+	// Retrying could deliver the event twice.
+	return githubRequestWith(ctx, retryNever, http.MethodPost, fmt.Sprintf("%v/app/hook/deliveries/%v/attempts", c.apiURL, id), c.jwt, nil, nil)
+}
+
+// installation is the subset of an App installation arc-setup reads.
+type installation struct {
+	ID      int64 `json:"id"`
+	Account struct {
+		Login string `json:"login"`
+	} `json:"account"`
+}
+
+// orgInstallation returns the App's installation on org, or nil if it has
+// not been installed there yet.
+func (c *appClient) orgInstallation(ctx context.Context, org string) (*installation, error) {
+	var installations []installation
+	if err := githubRequest(ctx, http.MethodGet, c.apiURL+"/app/installations?per_page=100", c.jwt, nil, &installations); err != nil {
+		return nil, err
+	}
+
+	for _, i := range installations {
+		if strings.EqualFold(i.Account.Login, org) {
+			return &i, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// installationToken is an access token acting as the App on one installation.
+type installationToken struct {
+	Token       string            `json:"token"`
+	ExpiresAt   time.Time         `json:"expires_at"`
+	Permissions map[string]string `json:"permissions"`
+}
+
+// tokenScope narrows an installation token to some of the installation's
+// repositories and a subset of the App's permissions. The zero value asks for
+// everything.
+type tokenScope struct {
+	Repositories []string          `json:"repositories,omitempty"`
+	Permissions  map[string]string `json:"permissions,omitempty"`
+}
+
+// installationToken creates an installation access token for installation
+// id, which GitHub expires after an hour.
+func (c *appClient) installationToken(ctx context.Context, id int64, scope tokenScope) (installationToken, error) {
+	var token installationToken
+	// A second token is harmless, the first just goes unused.
+	err := githubRequestWith(ctx, retryServerErrors, http.MethodPost, fmt.Sprintf("%v/app/installations/%v/access_tokens", c.apiURL, id), c.jwt, scope, &token)
+
+	return token, err
+}
+
+// deleteInstallation uninstalls the App from the account of installation id.
+func (c *appClient) deleteInstallation(ctx context.Context, id int64) error {
+	return githubRequest(ctx, http.MethodDelete, fmt.Sprintf("%v/app/installations/%v", c.apiURL, id), c.jwt, nil, nil)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewGitHubError(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		header    map[string]string
+		body      string
+		want      string
+		transient bool
+		limited   bool
+	}{
+		{
+			name:   "validation",
+			status: http.StatusUnprocessableEntity,
+			header: map[string]string{"X-GitHub-Request-Id": "ABCD:1234"},
+			body:   `{"message":"Validation Failed","errors":[{"resource":"Hook","field":"url","code":"invalid"}],"documentation_url":"https://docs.github.com/rest"}`,
+			want:   "PATCH https://api.github.com/app/hook/config: got status 422 Unprocessable Entity: Validation Failed (url invalid) [request ID ABCD:1234]",
+		},
+		{
+			name:   "string errors",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"message":"Validation Failed","errors":["name already taken"]}`,
+			want:   "PATCH https://api.github.com/app/hook/config: got status 422 Unprocessable Entity: Validation Failed (name already taken)",
+		},
+		{
+			name:      "not JSON",
+			status:    http.StatusBadGateway,
+			body:      "<html>bad gateway</html>",
+			want:      "PATCH https://api.github.com/app/hook/config: got status 502 Bad Gateway",
+			transient: true,
+		},
+		{
+			name:      "secondary rate limit",
+			status:    http.StatusForbidden,
+			header:    map[string]string{"Retry-After": "30"},
+			body:      `{"message":"You have exceeded a secondary rate limit."}`,
+			want:      "PATCH https://api.github.com/app/hook/config: got status 403 Forbidden: You have exceeded a secondary rate limit.",
+			transient: true,
+			limited:   true,
+		},
+		{
+			name:      "secondary rate limit without Retry-After",
+			status:    http.StatusForbidden,
+			body:      `{"message":"You have exceeded a secondary rate limit."}`,
+			want:      "PATCH https://api.github.com/app/hook/config: got status 403 Forbidden: You have exceeded a secondary rate limit.",
+			transient: true,
+			limited:   true,
+		},
+		{
+			name:      "primary rate limit",
+			status:    http.StatusForbidden,
+			header:    map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)},
+			body:      `{"message":"API rate limit exceeded for installation ID 7."}`,
+			want:      "PATCH https://api.github.com/app/hook/config: got status 403 Forbidden: API rate limit exceeded for installation ID 7.",
+			transient: true,
+			limited:   true,
+		},
+		{
+			name:   "forbidden",
+			status: http.StatusForbidden,
+			body:   `{"message":"Resource not accessible by integration"}`,
+			want:   "PATCH https://api.github.com/app/hook/config: got status 403 Forbidden: Resource not accessible by integration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			for k, v := range tt.header {
+				rec.Header().Set(k, v)
+			}
+			rec.WriteHeader(tt.status)
+			rec.WriteString(tt.body)
+
+			gerr := newGitHubError(http.MethodPatch, "https://api.github.com/app/hook/config", rec.Result())
+			if got := gerr.Error(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if gerr.transient() != tt.transient {
+				t.Errorf("got transient %v, want %v", gerr.transient(), tt.transient)
+			}
+			if gerr.RateLimited != tt.limited {
+				t.Errorf("got rate limited %v, want %v", gerr.RateLimited, tt.limited)
+			}
+			switch {
+			case tt.header["Retry-After"] == "30":
+				if gerr.RetryAfter != 30*time.Second {
+					t.Errorf("got Retry-After %v, want 30s", gerr.RetryAfter)
+				}
+			case tt.header["X-RateLimit-Reset"] != "":
+				if gerr.RetryAfter < 59*time.Minute {
+					t.Errorf("got Retry-After %v, want until the reset", gerr.RetryAfter)
+				}
+			case tt.limited:
+				if gerr.RetryAfter != secondaryRateLimitDelay {
+					t.Errorf("got Retry-After %v, want %v", gerr.RetryAfter, secondaryRateLimitDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestGitHubRequestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		retry    githubRetry
+		status   int
+		requests int
+	}{
+		{name: "GET after a server error", method: http.MethodGet, retry: retryIdempotent, status: http.StatusBadGateway, requests: 2},
+		{name: "POST after a server error", method: http.MethodPost, retry: retryIdempotent, status: http.StatusBadGateway, requests: 1},
+		{name: "POST opted in", method: http.MethodPost, retry: retryServerErrors, status: http.StatusBadGateway, requests: 2},
+		{name: "POST after a rate limit", method: http.MethodPost, retry: retryIdempotent, status: http.StatusTooManyRequests, requests: 2},
+		{name: "never", method: http.MethodPost, retry: retryNever, status: http.StatusTooManyRequests, requests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 1 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				io.WriteString(w, `{}`)
+			}))
+			defer srv.Close()
+
+			savedClient, savedLimits, savedDelay, savedLog := httpClient, githubLimits, githubRetryDelay, log.w
+			httpClient, githubLimits, githubRetryDelay, log.w = srv.Client(), newRateLimiter(), 0, io.Discard
+			defer func() {
+				httpClient, githubLimits, githubRetryDelay, log.w = savedClient, savedLimits, savedDelay, savedLog
+			}()
+
+			err := githubRequestWith(context.Background(), tt.retry, tt.method, srv.URL+"/app", "token", nil, nil)
+			if requests != tt.requests {
+				t.Errorf("got %v requests, want %v", requests, tt.requests)
+			}
+			if (err == nil) != (tt.requests > 1) {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// helmRelease is a chart installed by arc-setup, pinned to a version and
+// configured from typed values.
+type helmRelease struct {
+	Name      string
+	Namespace string
+
+	// Repo is the chart repository URL. It is empty for OCI charts, where
+	// Chart is the full oci:// reference.
+	Repo    string
+	Chart   string
+	Version string
+	Values  interface{}
+
+	// Deployments are waited on after install, so that failures surface
+	// with the events and logs explaining them.
+	Deployments []string
+}
+
+// deployed reports whether the release is installed and healthy.
+func (r helmRelease) deployed(ctx context.Context) bool {
+	return helmReleaseDeployed(ctx, r.Namespace, r.Name)
+}
+
+// install installs or upgrades the release, then waits for its deployments to
+// roll out.
+func (r helmRelease) install(ctx context.Context, w io.Writer) error {
+	values, err := json.Marshal(r.Values)
+	if err != nil {
+		return fmt.Errorf("error encoding %v values: %w", r.Name, err)
+	}
+
+	// values may contain the App's private key.
+	f, err := os.CreateTemp("", "arc-setup-values-*.json")
+	if err != nil {
+		return fmt.Errorf("failed creating a temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(values); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing to tmpfile: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing values file: %w", err)
+	}
+
+	if err := runCommandTo(ctx, w, "helm", r.installArgs(f.Name())...); err != nil {
+		return err
+	}
+	defer emit(event{
+		Type:      eventHelmInstalled,
+		Message:   fmt.Sprintf("Installed %v %v into %v", r.Chart, r.Version, r.Namespace),
+		Release:   r.Name,
+		Namespace: r.Namespace,
+		Chart:     r.Chart,
+		Version:   r.Version,
+	})
+
+	if len(r.Deployments) == 0 {
+		return nil
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, d := range r.Deployments {
+		fmt.Fprintf(w, "ℹ Waiting for deployment %v/%v to roll out...\n", r.Namespace, d)
+		if err := kube.waitForDeployment(ctx, r.Namespace, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// installArgs are the helm arguments install runs, reading values from
+// valuesFile.
+func (r helmRelease) installArgs(valuesFile string) []string {
+	args := []string{
+		"upgrade", "--install",
+		"--namespace", r.Namespace,
+		"--create-namespace",
+		"--version", r.Version,
+		"--values", valuesFile,
+	}
+	if r.Repo != "" {
+		args = append(args, "--repo", r.Repo)
+	}
+
+	return append(args, r.Name, r.Chart)
+}
+
+func helmReleaseDeployed(ctx context.Context, namespace, release string) bool {
+	out, err := commandOutput(ctx, "helm", "status", release, "--namespace", namespace, "--output", "json")
+	if err != nil {
+		return false
+	}
+
+	var status struct {
+		Info struct {
+			Status string `json:"status"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal([]byte(out), &status); err != nil {
+		return false
+	}
+
+	return status.Info.Status == "deployed"
+}
+
+func ingressNginxRelease() helmRelease {
+	return helmRelease{
+		Name:        "ingress-nginx",
+		Namespace:   "ingress-nginx",
+		Repo:        "https://kubernetes.github.io/ingress-nginx",
+		Chart:       "ingress-nginx",
+		Version:     "4.10.1",
+		Values:      map[string]interface{}{},
+		Deployments: []string{"ingress-nginx-controller"},
+	}
+}
+
+type certManagerValues struct {
+	InstallCRDs bool `json:"installCRDs"`
+}
+
+func certManagerRelease() helmRelease {
+	return helmRelease{
+		Name:        "cert-manager",
+		Namespace:   "cert-manager",
+		Repo:        "https://charts.jetstack.io",
+		Chart:       "cert-manager",
+		Version:     "v1.6.1",
+		Values:      certManagerValues{InstallCRDs: true},
+		Deployments: []string{"cert-manager", "cert-manager-cainjector", "cert-manager-webhook"},
+	}
+}
+
+// arcValues are the actions-runner-controller chart values arc-setup sets.
+type arcValues struct {
+	GithubEnterpriseServerURL string `json:"githubEnterpriseServerURL,omitempty"`
+
+	AuthSecret struct {
+		Create                  bool              `json:"create"`
+		Name                    string            `json:"name"`
+		Annotations             map[string]string `json:"annotations"`
+		GithubAppID             string            `json:"github_app_id,omitempty"`
+		GithubAppInstallationID string            `json:"github_app_installation_id,omitempty"`
+		GithubAppPrivateKey     string            `json:"github_app_private_key,omitempty"`
+	} `json:"authSecret"`
+
+	ServiceAccount struct {
+		Create bool   `json:"create"`
+		Name   string `json:"name"`
+	} `json:"serviceAccount"`
+
+	Service struct {
+		Type        string            `json:"type"`
+		Port        int               `json:"port"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"service"`
+
+	Metrics struct {
+		ServiceMonitor bool `json:"serviceMonitor"`
+		Proxy          struct {
+			Enabled bool `json:"enabled"`
+		} `json:"proxy"`
+	} `json:"metrics"`
+
+	Scope struct {
+		SingleNamespace bool   `json:"singleNamespace"`
+		WatchNamespace  string `json:"watchNamespace"`
+	} `json:"scope"`
+
+	GithubWebhookServer struct {
+		Enabled      bool   `json:"enabled"`
+		ReplicaCount int    `json:"replicaCount"`
+		SyncPeriod   string `json:"syncPeriod"`
+		Secret       struct {
+			Create                   bool   `json:"create"`
+			Name                     string `json:"name"`
+			GithubWebhookSecretToken string `json:"github_webhook_secret_token,omitempty"`
+		} `json:"secret"`
+		Service struct {
+			Type  string        `json:"type"`
+			Ports []servicePort `json:"ports"`
+		} `json:"service"`
+	} `json:"githubWebhookServer"`
+
+	Ingress struct {
+		Enabled bool `json:"enabled"`
+	} `json:"ingress"`
+
+	// AdditionalVolumes and AdditionalVolumeMounts mount the CA bundle into
+	// the controller.
+	AdditionalVolumes      []interface{} `json:"additionalVolumes,omitempty"`
+	AdditionalVolumeMounts []interface{} `json:"additionalVolumeMounts,omitempty"`
+}
+
+type servicePort struct {
+	Port       int    `json:"port"`
+	TargetPort string `json:"targetPort"`
+	Protocol   string `json:"protocol"`
+	Name       string `json:"name"`
+}
+
+// buildARCValues builds the chart values for vars. When the credentials are
+// already in the cluster the chart is pointed at those Secrets instead of
+// creating its own.
+func buildARCValues(ctx context.Context, vars Vars) (arcValues, error) {
+	var v arcValues
+
+	v.GithubEnterpriseServerURL = vars.EnterpriseURL
+
+	v.AuthSecret.Name = "arc-github-app"
+	v.AuthSecret.Annotations = map[string]string{}
+	v.GithubWebhookServer.Secret.Name = "arc-webhook-server"
+
+	if !vars.inClusterSecrets() {
+		key, err := vars.privateKeyPEM(ctx)
+		if err != nil {
+			return v, err
+		}
+
+		secret, err := vars.webhookSecret(ctx)
+		if err != nil {
+			return v, fmt.Errorf("failed to read webhook secret: %w", err)
+		}
+
+		v.AuthSecret.Create = true
+		v.AuthSecret.GithubAppID = vars.AppID
+		v.AuthSecret.GithubAppInstallationID = vars.InstallationID
+		v.AuthSecret.GithubAppPrivateKey = string(key)
+		v.GithubWebhookServer.Secret.Create = true
+		v.GithubWebhookServer.Secret.GithubWebhookSecretToken = secret
+	}
+
+	v.ServiceAccount.Create = true
+	v.ServiceAccount.Name = "arc-svc-account"
+
+	v.Service.Type = "ClusterIP"
+	v.Service.Port = 443
+	v.Service.Annotations = map[string]string{}
+
+	v.Scope.SingleNamespace = true
+	v.Scope.WatchNamespace = "arc-runners"
+
+	v.GithubWebhookServer.Enabled = true
+	v.GithubWebhookServer.ReplicaCount = 1
+	v.GithubWebhookServer.SyncPeriod = "10m"
+	v.GithubWebhookServer.Service.Type = "ClusterIP"
+	v.GithubWebhookServer.Service.Ports = []servicePort{
+		{Port: 80, TargetPort: "http", Protocol: "TCP", Name: "http"},
+	}
+
+	if len(caBundle) > 0 {
+		v.AdditionalVolumes = []interface{}{caBundleVolume()}
+		v.AdditionalVolumeMounts = []interface{}{caBundleVolumeMount()}
+	}
+
+	return v, nil
+}
+
+func arcRelease(ctx context.Context, vars Vars) (helmRelease, error) {
+	values, err := buildARCValues(ctx, vars)
+	if err != nil {
+		return helmRelease{}, err
+	}
+
+	return helmRelease{
+		Name:        "actions-runner-controller",
+		Namespace:   "actions-runner-system",
+		Repo:        "https://actions-runner-controller.github.io/actions-runner-controller",
+		Chart:       "actions-runner-controller",
+		Version:     "0.23.7",
+		Values:      values,
+		Deployments: []string{"actions-runner-controller", "actions-runner-controller-github-webhook-server"},
+	}, nil
+}
+
+const (
+	scaleSetControllerRelease   = "arc"
+	scaleSetControllerNamespace = "arc-systems"
+	scaleSetNamespace           = "arc-runners"
+	scaleSetChartVersion        = "0.9.3"
+)
+
+func scaleSetControllerHelmRelease() helmRelease {
+	return helmRelease{
+		Name:        scaleSetControllerRelease,
+		Namespace:   scaleSetControllerNamespace,
+		Chart:       "oci://ghcr.io/actions/actions-runner-controller-charts/gha-runner-scale-set-controller",
+		Version:     scaleSetChartVersion,
+		Values:      map[string]interface{}{},
+		Deployments: []string{scaleSetControllerRelease + "-gha-rs-controller"},
+	}
+}
+
+// scaleSetValues are the gha-runner-scale-set chart values arc-setup sets.
+type scaleSetValues struct {
+	GithubConfigURL string `json:"githubConfigUrl"`
+
+	// GithubConfigSecret is either a scaleSetAppSecret, or the name of an
+	// existing Secret holding the same keys.
+	GithubConfigSecret interface{} `json:"githubConfigSecret"`
+
+	GithubServerTLS          *scaleSetTLS `json:"githubServerTLS,omitempty"`
+	RunnerGroup              string       `json:"runnerGroup,omitempty"`
+	ControllerServiceAccount struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"controllerServiceAccount"`
+}
+
+// scaleSetTLS points the listener and runners at the CA bundle ConfigMap.
+type scaleSetTLS struct {
+	CertificateFrom struct {
+		ConfigMapKeyRef struct {
+			Name string `json:"name"`
+			Key  string `json:"key"`
+		} `json:"configMapKeyRef"`
+	} `json:"certificateFrom"`
+	RunnerMountPath string `json:"runnerMountPath"`
+}
+
+type scaleSetAppSecret struct {
+	GithubAppID             string `json:"github_app_id"`
+	GithubAppInstallationID string `json:"github_app_installation_id"`
+	GithubAppPrivateKey     string `json:"github_app_private_key"`
+}
+
+func scaleSetHelmRelease(ctx context.Context, vars Vars, name string) (helmRelease, error) {
+	var v scaleSetValues
+	v.GithubConfigURL = vars.ConfigURL
+	if vars.inClusterSecrets() {
+		v.GithubConfigSecret = "arc-github-app"
+	} else {
+		key, err := vars.privateKeyPEM(ctx)
+		if err != nil {
+			return helmRelease{}, err
+		}
+
+		v.GithubConfigSecret = scaleSetAppSecret{
+			GithubAppID:             vars.AppID,
+			GithubAppInstallationID: vars.InstallationID,
+			GithubAppPrivateKey:     string(key),
+		}
+	}
+	v.RunnerGroup = vars.RunnerGroup
+	if len(caBundle) > 0 {
+		v.GithubServerTLS = &scaleSetTLS{RunnerMountPath: "/usr/local/share/ca-certificates/"}
+		v.GithubServerTLS.CertificateFrom.ConfigMapKeyRef.Name = CABundleName
+		v.GithubServerTLS.CertificateFrom.ConfigMapKeyRef.Key = caBundleKey
+	}
+	v.ControllerServiceAccount.Namespace = scaleSetControllerNamespace
+	v.ControllerServiceAccount.Name = scaleSetControllerRelease + "-gha-rs-controller"
+
+	return helmRelease{
+		Name:      name,
+		Namespace: scaleSetNamespace,
+		Chart:     "oci://ghcr.io/actions/actions-runner-controller-charts/gha-runner-scale-set",
+		Version:   scaleSetChartVersion,
+		Values:    v,
+	}, nil
+}
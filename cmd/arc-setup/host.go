@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DataResidencySuffix is the domain GHE.com tenants live under, e.g.
+// octocorp.ghe.com, with their API at api.octocorp.ghe.com.
+const DataResidencySuffix = ".ghe.com"
+
+// githubInstance is a GitHub instance: github.com, a GHE.com tenant or a GHES
+// appliance, possibly on a non-standard port. Every GitHub URL arc-setup
+// builds comes from here.
+type githubInstance struct {
+	// host is the web host, with a port if it is not the default.
+	host string
+}
+
+// parseGitHubHost accepts a host, web URL or API URL for an instance.
+func parseGitHubHost(s string) (githubInstance, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return githubInstance{}, fmt.Errorf("GitHub host is empty")
+	}
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return githubInstance{}, fmt.Errorf("invalid GitHub host %q: %w", s, err)
+	}
+	if u.Host == "" {
+		return githubInstance{}, fmt.Errorf("invalid GitHub host %q", s)
+	}
+
+	host := strings.ToLower(u.Host)
+	if u.Port() == "443" {
+		host = strings.ToLower(u.Hostname())
+	}
+
+	// github.com and GHE.com serve their API from an api. subdomain, GHES
+	// from /api/v3 on the web host.
+	if host == "api."+GitHubDotcomHost || (strings.HasPrefix(host, "api.") && strings.HasSuffix(host, DataResidencySuffix)) {
+		host = strings.TrimPrefix(host, "api.")
+	}
+
+	return githubInstance{host: host}, nil
+}
+
+// Name is the host, with a port if it has one.
+func (h githubInstance) Name() string { return h.host }
+
+func (h githubInstance) IsDotcom() bool { return h.host == GitHubDotcomHost }
+
+func (h githubInstance) IsDataResidency() bool {
+	return strings.HasSuffix(h.host, DataResidencySuffix)
+}
+
+// IsGHES reports whether the host is a GitHub Enterprise Server appliance.
+func (h githubInstance) IsGHES() bool { return !h.IsDotcom() && !h.IsDataResidency() }
+
+func (h githubInstance) WebURL() string { return "https://" + h.host }
+
+// APIURL is the REST API base URL.
+func (h githubInstance) APIURL() string {
+	if h.IsGHES() {
+		return h.WebURL() + "/api/v3"
+	}
+
+	return "https://api." + h.host
+}
+
+// UploadURL is the base URL for release asset uploads.
+func (h githubInstance) UploadURL() string {
+	if h.IsGHES() {
+		return h.WebURL() + "/api/uploads"
+	}
+
+	return "https://uploads." + h.host
+}
+
+// EnterpriseURL is the value of ARC_GITHUB_ENTERPRISE_URL, which the
+// actions-runner-controller chart only understands for GHES.
+func (h githubInstance) EnterpriseURL() string {
+	if h.IsGHES() {
+		return h.WebURL()
+	}
+
+	return ""
+}
+
+// OrgURL is the organization's page, which is also the runner scale set
+// config URL.
+func (h githubInstance) OrgURL(org string) string {
+	return h.WebURL() + "/" + url.PathEscape(org)
+}
+
+// AppURL is the App's public page.
+func (h githubInstance) AppURL(slug string) string {
+	if h.IsGHES() {
+		return h.WebURL() + "/github-apps/" + url.PathEscape(slug)
+	}
+
+	return h.WebURL() + "/apps/" + url.PathEscape(slug)
+}
+
+// AppInstallURL installs the App onto the account targetID.
+func (h githubInstance) AppInstallURL(slug string, targetID int) string {
+	return fmt.Sprintf("%v/installations/new/permissions?target_id=%v", h.AppURL(slug), targetID)
+}
+
+// AppSettingsURL is the settings page of an organization owned App, or the
+// list of the organization's Apps when slug is empty.
+func (h githubInstance) AppSettingsURL(org, slug string) string {
+	u := h.WebURL() + "/organizations/" + url.PathEscape(org) + "/settings/apps"
+	if slug != "" {
+		u += "/" + url.PathEscape(slug)
+	}
+
+	return u
+}
+
+// AppPermissionsURL is where an organization owned App's events and
+// permissions are edited.
+func (h githubInstance) AppPermissionsURL(org, slug string) string {
+	return h.AppSettingsURL(org, slug) + "/permissions"
+}
+
+// AppAdvancedURL is where an organization owned App is deleted.
+func (h githubInstance) AppAdvancedURL(org, slug string) string {
+	return h.AppSettingsURL(org, slug) + "/advanced"
+}
+
+// NewAppURL registers an organization owned App, prefilled from query.
+func (h githubInstance) NewAppURL(org string, query url.Values) string {
+	return h.AppSettingsURL(org, "new") + "?" + query.Encode()
+}
+
+// InstallationsURL is the organization's installed Apps, which the
+// installation ID can be read from.
+func (h githubInstance) InstallationsURL(org string) string {
+	return h.WebURL() + "/organizations/" + url.PathEscape(org) + "/settings/installations"
+}
+
+// RunnersURL is the organization's runner and runner group settings.
+func (h githubInstance) RunnersURL(org string) string {
+	return h.WebURL() + "/organizations/" + url.PathEscape(org) + "/settings/actions/runners"
+}
+
+// ManifestConversionURL exchanges an App manifest code for the App.
+func (h githubInstance) ManifestConversionURL(code string) string {
+	return h.APIURL() + "/app-manifests/" + url.PathEscape(code) + "/conversions"
+}
+
+// githubMeta is the subset of GET /meta arc-setup uses.
+type githubMeta struct {
+	VerifiablePasswordAuthentication *bool  `json:"verifiable_password_authentication"`
+	InstalledVersion                 string `json:"installed_version"`
+}
+
+// verify checks the API URL is a GitHub API by fetching /meta, which needs
+// no authentication.
+func (h githubInstance) verify(ctx context.Context) (githubMeta, error) {
+	meta, header, err := h.meta(ctx)
+	if err != nil {
+		return meta, fmt.Errorf("%v does not look like a GitHub instance: %w", h.host, err)
+	}
+	if meta.VerifiablePasswordAuthentication == nil {
+		return meta, fmt.Errorf("%v does not look like a GitHub instance: unexpected /meta response", h.host)
+	}
+	if h.IsGHES() && meta.InstalledVersion == "" && header == "" {
+		return meta, fmt.Errorf("%v does not report a GHES version in /meta", h.host)
+	}
+
+	return meta, nil
+}
+
+func (h githubInstance) String() string { return h.host }
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestParseGitHubHost(t *testing.T) {
+	tests := []struct {
+		in         string
+		name       string
+		api        string
+		uploads    string
+		app        string
+		enterprise string
+	}{
+		{
+			in:      "github.com",
+			name:    "github.com",
+			api:     "https://api.github.com",
+			uploads: "https://uploads.github.com",
+			app:     "https://github.com/apps/arc",
+		},
+		{
+			in:      "https://api.github.com/user",
+			name:    "github.com",
+			api:     "https://api.github.com",
+			uploads: "https://uploads.github.com",
+			app:     "https://github.com/apps/arc",
+		},
+		{
+			in:      "api.octocorp.ghe.com",
+			name:    "octocorp.ghe.com",
+			api:     "https://api.octocorp.ghe.com",
+			uploads: "https://uploads.octocorp.ghe.com",
+			app:     "https://octocorp.ghe.com/apps/arc",
+		},
+		{
+			in:         "https://GHES.example.com/api/v3/user",
+			name:       "ghes.example.com",
+			api:        "https://ghes.example.com/api/v3",
+			uploads:    "https://ghes.example.com/api/uploads",
+			app:        "https://ghes.example.com/github-apps/arc",
+			enterprise: "https://ghes.example.com",
+		},
+		{
+			in:         "ghes.example.com:8443",
+			name:       "ghes.example.com:8443",
+			api:        "https://ghes.example.com:8443/api/v3",
+			uploads:    "https://ghes.example.com:8443/api/uploads",
+			app:        "https://ghes.example.com:8443/github-apps/arc",
+			enterprise: "https://ghes.example.com:8443",
+		},
+		{
+			in:         "https://ghes.example.com:443",
+			name:       "ghes.example.com",
+			api:        "https://ghes.example.com/api/v3",
+			uploads:    "https://ghes.example.com/api/uploads",
+			app:        "https://ghes.example.com/github-apps/arc",
+			enterprise: "https://ghes.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			h, err := parseGitHubHost(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct{ what, got, want string }{
+				{"name", h.Name(), tt.name},
+				{"api", h.APIURL(), tt.api},
+				{"uploads", h.UploadURL(), tt.uploads},
+				{"app", h.AppURL("arc"), tt.app},
+				{"enterprise", h.EnterpriseURL(), tt.enterprise},
+			} {
+				if c.got != c.want {
+					t.Errorf("%v: got %q, want %q", c.what, c.got, c.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	env "github.com/Netflix/go-env"
+)
+
+// httpConfig configures the client arc-setup talks to GitHub, gamf and Vault
+// with, for GHES instances behind an internal CA or a proxy.
+type httpConfig struct {
+	// CABundles is a comma separated list of PEM files trusted in addition
+	// to the system roots.
+	CABundles string `env:"ARC_CA_BUNDLE"`
+
+	// Insecure skips TLS verification entirely. It is only meant for labs.
+	Insecure bool `env:"ARC_INSECURE_SKIP_VERIFY"`
+
+	// Proxy overrides HTTPS_PROXY and friends.
+	Proxy string `env:"ARC_HTTP_PROXY"`
+
+	Timeout   time.Duration `env:"ARC_HTTP_TIMEOUT"`
+	UserAgent string        `env:"ARC_USER_AGENT"`
+}
+
+const defaultUserAgent = "arc-setup"
+
+var (
+	// httpClient is used for every request arc-setup makes, other than to
+	// the Kubernetes API. run configures it from the environment.
+	httpClient = http.DefaultClient
+
+	// caBundle is the PEM encoded extra CAs from ARC_CA_BUNDLE, which are
+	// also mounted into the controller and runner pods.
+	caBundle []byte
+)
+
+func loadHTTPConfig() (httpConfig, error) {
+	cfg := httpConfig{Timeout: 30 * time.Second, UserAgent: defaultUserAgent}
+	if _, err := env.UnmarshalFromEnviron(&cfg); err != nil {
+		return cfg, fmt.Errorf("error reading HTTP settings from the environment: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// configureHTTP sets httpClient and caBundle from the environment.
+func configureHTTP() error {
+	cfg, err := loadHTTPConfig()
+	if err != nil {
+		return err
+	}
+
+	client, bundle, err := newHTTPClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	httpClient, caBundle = client, bundle
+
+	return nil
+}
+
+// newHTTPClient builds a client from cfg, returning it along with the extra
+// CAs it trusts.
+func newHTTPClient(cfg httpConfig) (*http.Client, []byte, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+
+	var bundle []byte
+	if cfg.CABundles != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		for _, path := range strings.Split(cfg.CABundles, ",") {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				continue
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, nil, fmt.Errorf("no PEM certificates found in CA bundle %v", path)
+			}
+
+			bundle = append(bundle, bytes.TrimSpace(b)...)
+			bundle = append(bundle, '\n')
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid proxy URL %q: %w", cfg.Proxy, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: userAgentTransport{userAgent: cfg.UserAgent, next: traceTransport{next: transport}},
+	}, bundle, nil
+}
+
+// userAgentTransport sets the User-Agent on requests which have none.
+type userAgentTransport struct {
+	userAgent string
+	next      http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+const (
+	// CABundleName names the ConfigMap holding caBundle in each namespace
+	// that needs it, and the volume it is mounted from.
+	CABundleName = "arc-ca-bundle"
+	caBundleKey  = "ca.crt"
+
+	// caBundleMountPath is in the directory Go loads every root from, so
+	// the controllers trust it as is. OpenSSL, and so curl, git and .NET,
+	// only finds certificates there by their hashed names, so it ignores the
+	// bundle until update-ca-certificates or c_rehash runs in the container.
+	// SSL_CERT_FILE isn't set to it instead, as that would drop the public
+	// roots GitHub.com needs.
+	caBundleMountPath = "/etc/ssl/certs/" + CABundleName + ".crt"
+)
+
+// applyCABundle writes caBundle to a ConfigMap in each namespace, so pods
+// there can mount it. It does nothing when no CA bundle is configured.
+func applyCABundle(ctx context.Context, w io.Writer, namespaces ...string) error {
+	if len(caBundle) == 0 {
+		return nil
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, ns := range namespaces {
+		objs := []kubeObject{
+			{
+				"apiVersion": "v1",
+				"kind":       "Namespace",
+				"metadata":   map[string]interface{}{"name": ns},
+			},
+			{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]interface{}{"name": CABundleName, "namespace": ns},
+				"data":       map[string]interface{}{caBundleKey: string(caBundle)},
+			},
+		}
+		if err := kube.applyObjects(w, objs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// caBundleVolume and caBundleVolumeMount mount the CA bundle ConfigMap.
+func caBundleVolume() map[string]interface{} {
+	return map[string]interface{}{
+		"name":      CABundleName,
+		"configMap": map[string]interface{}{"name": CABundleName},
+	}
+}
+
+func caBundleVolumeMount() map[string]interface{} {
+	return map[string]interface{}{
+		"name":      CABundleName,
+		"mountPath": caBundleMountPath,
+		"subPath":   caBundleKey,
+		"readOnly":  true,
+	}
+}
+
+// withCABundle mounts the CA bundle into the runners of any RunnerDeployment
+// in objs. NODE_EXTRA_CA_CERTS covers JavaScript actions, which ignore the
+// system roots.
+func withCABundle(objs []kubeObject) {
+	if len(caBundle) == 0 {
+		return
+	}
+
+	for _, obj := range objs {
+		if obj.kind() != "RunnerDeployment" {
+			continue
+		}
+
+		spec := nestedMap(obj, "spec", "template", "spec")
+		spec["volumes"] = append(asSlice(spec["volumes"]), caBundleVolume())
+		spec["volumeMounts"] = append(asSlice(spec["volumeMounts"]), caBundleVolumeMount())
+		spec["env"] = append(asSlice(spec["env"]), map[string]interface{}{
+			"name":  "NODE_EXTRA_CA_CERTS",
+			"value": caBundleMountPath,
+		})
+	}
+}
+
+// nestedMap returns the map at path in m, creating any missing maps.
+func nestedMap(m map[string]interface{}, path ...string) map[string]interface{} {
+	for _, key := range path {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[key] = next
+		}
+		m = next
+	}
+
+	return m
+}
+
+func asSlice(v interface{}) []interface{} {
+	s, _ := v.([]interface{})
+	return s
+}
@@ -0,0 +1,801 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldManager is the server-side apply field manager arc-setup owns fields
+// as.
+const FieldManager = "arc-setup"
+
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+			Exec                  *struct {
+				APIVersion string   `yaml:"apiVersion"`
+				Command    string   `yaml:"command"`
+				Args       []string `yaml:"args"`
+				Env        []struct {
+					Name  string `yaml:"name"`
+					Value string `yaml:"value"`
+				} `yaml:"env"`
+			} `yaml:"exec"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// kubeClient is a minimal Kubernetes API client, covering just what
+// arc-setup needs: server-side apply, reads, and rollout diagnostics.
+type kubeClient struct {
+	ctx       context.Context
+	server    string
+	namespace string
+	client    *http.Client
+	token     string
+	username  string
+	password  string
+
+	mu        sync.Mutex
+	resources map[string]apiResource
+}
+
+type apiResource struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Namespaced bool   `json:"namespaced"`
+}
+
+// kubeError is a non-2xx response from the API server, decoded from its
+// Status body.
+type kubeError struct {
+	StatusCode int
+	Reason     string
+	Message    string
+}
+
+func (e *kubeError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("kubernetes api returned %v", e.StatusCode)
+	}
+
+	return fmt.Sprintf("kubernetes api returned %v: %v", e.StatusCode, e.Message)
+}
+
+// errNoResource is returned when the API server does not serve a kind,
+// usually because its CRD is not installed yet.
+var errNoResource = errors.New("no resource")
+
+// isNotFound reports whether err means the object, or its kind, does not
+// exist.
+func isNotFound(err error) bool {
+	var kerr *kubeError
+	if errors.As(err, &kerr) && kerr.StatusCode == http.StatusNotFound {
+		return true
+	}
+
+	return errors.Is(err, errNoResource)
+}
+
+func kubeConfigPath() string {
+	if v := os.Getenv("KUBECONFIG"); v != "" {
+		return filepath.SplitList(v)[0]
+	}
+
+	home, _ := os.UserHomeDir()
+
+	return filepath.Join(home, ".kube", "config")
+}
+
+// newKubeClient builds a client for kubeContext from the kubeconfig, or the
+// current context if kubeContext is empty. Its requests are made with ctx.
+func newKubeClient(ctx context.Context, kubeContext string) (*kubeClient, error) {
+	path := kubeConfigPath()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, clusterUnavailableError(fmt.Errorf("failed to read kubeconfig: %w", err))
+	}
+
+	var cfg kubeConfig
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("error decoding kubeconfig %v: %w", path, err)
+	}
+
+	if kubeContext == "" {
+		kubeContext = cfg.CurrentContext
+	}
+	if kubeContext == "" {
+		return nil, fmt.Errorf("kubeconfig %v has no current context", path)
+	}
+
+	rel := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+
+		return filepath.Join(filepath.Dir(path), p)
+	}
+
+	c := &kubeClient{ctx: ctx, namespace: "default", resources: map[string]apiResource{}}
+	tlsConfig := &tls.Config{}
+
+	var clusterName, userName string
+	found := false
+	for _, named := range cfg.Contexts {
+		if named.Name == kubeContext {
+			found = true
+			clusterName, userName = named.Context.Cluster, named.Context.User
+			if named.Context.Namespace != "" {
+				c.namespace = named.Context.Namespace
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %v", kubeContext, path)
+	}
+
+	for _, cl := range cfg.Clusters {
+		if cl.Name != clusterName {
+			continue
+		}
+
+		c.server = strings.TrimSuffix(cl.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = cl.Cluster.InsecureSkipTLSVerify
+
+		ca, err := dataOrFile(cl.Cluster.CertificateAuthorityData, rel(cl.Cluster.CertificateAuthority))
+		if err != nil {
+			return nil, fmt.Errorf("error loading cluster certificate authority: %w", err)
+		}
+		if ca != nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("cluster %v certificate authority contains no certificates", clusterName)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if c.server == "" {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig %v", clusterName, path)
+	}
+
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+
+		cert, err := dataOrFile(u.User.ClientCertificateData, rel(u.User.ClientCertificate))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		key, err := dataOrFile(u.User.ClientKeyData, rel(u.User.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client key: %w", err)
+		}
+
+		c.token = u.User.Token
+		if u.User.TokenFile != "" {
+			b, err := os.ReadFile(rel(u.User.TokenFile))
+			if err != nil {
+				return nil, fmt.Errorf("error reading token file: %w", err)
+			}
+			c.token = strings.TrimSpace(string(b))
+		}
+		c.username, c.password = u.User.Username, u.User.Password
+
+		if u.User.Exec != nil {
+			cmd := exec.CommandContext(ctx, u.User.Exec.Command, u.User.Exec.Args...)
+			cmd.Env = os.Environ()
+			for _, e := range u.User.Exec.Env {
+				cmd.Env = append(cmd.Env, e.Name+"="+e.Value)
+			}
+			cmd.Env = append(cmd.Env, fmt.Sprintf(`KUBERNETES_EXEC_INFO={"apiVersion":%q,"kind":"ExecCredential","spec":{"interactive":false}}`, u.User.Exec.APIVersion))
+			cmd.Stderr = os.Stderr
+
+			out, err := cmd.Output()
+			if err != nil {
+				return nil, fmt.Errorf("error running credential plugin %v: %w", u.User.Exec.Command, err)
+			}
+
+			var cred struct {
+				Status struct {
+					Token                 string `json:"token"`
+					ClientCertificateData string `json:"clientCertificateData"`
+					ClientKeyData         string `json:"clientKeyData"`
+				} `json:"status"`
+			}
+			if err := json.Unmarshal(out, &cred); err != nil {
+				return nil, fmt.Errorf("error decoding credential plugin output: %w", err)
+			}
+
+			if cred.Status.Token != "" {
+				c.token = cred.Status.Token
+			}
+			if cred.Status.ClientCertificateData != "" {
+				cert, key = []byte(cred.Status.ClientCertificateData), []byte(cred.Status.ClientKeyData)
+			}
+		}
+
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("error loading client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	c.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}
+
+	return c, nil
+}
+
+// dataOrFile returns the base64 decoded data, or the contents of file if data
+// is empty. Both being empty returns nil.
+func dataOrFile(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(file)
+	}
+
+	return nil, nil
+}
+
+func (c *kubeClient) do(method, path, contentType string, body []byte, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, method, c.server+path, r)
+	if err != nil {
+		return fmt.Errorf("error building request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return clusterUnavailableError(fmt.Errorf("failed to make request to %v: %w", c.server, err))
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+
+	if res.StatusCode > 299 || res.StatusCode < 200 {
+		kerr := &kubeError{StatusCode: res.StatusCode}
+
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &status) == nil {
+			kerr.Reason, kerr.Message = status.Reason, status.Message
+		}
+
+		return kerr
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if s, ok := out.(*string); ok {
+		*s = string(b)
+		return nil
+	}
+
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return nil
+}
+
+// ready reports whether the API server is reachable and healthy.
+func (c *kubeClient) ready() bool {
+	return c.do(http.MethodGet, "/readyz", "", nil, nil) == nil
+}
+
+// resource discovers the API resource serving kind in apiVersion.
+func (c *kubeClient) resource(apiVersion, kind string) (apiResource, error) {
+	key := apiVersion + "/" + kind
+
+	c.mu.Lock()
+	r, ok := c.resources[key]
+	c.mu.Unlock()
+	if ok {
+		return r, nil
+	}
+
+	path := "/apis/" + apiVersion
+	if !strings.Contains(apiVersion, "/") {
+		path = "/api/" + apiVersion
+	}
+
+	var list struct {
+		Resources []apiResource `json:"resources"`
+	}
+	if err := c.do(http.MethodGet, path, "", nil, &list); err != nil {
+		return apiResource{}, fmt.Errorf("discovering %v: %w", apiVersion, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, res := range list.Resources {
+		// skip subresources such as deployments/status
+		if strings.Contains(res.Name, "/") {
+			continue
+		}
+
+		c.resources[apiVersion+"/"+res.Kind] = res
+	}
+
+	r, ok = c.resources[key]
+	if !ok {
+		return apiResource{}, fmt.Errorf("%w for kind %v in %v, is its CRD installed?", errNoResource, kind, apiVersion)
+	}
+
+	return r, nil
+}
+
+func (c *kubeClient) resourcePath(apiVersion, kind, namespace, name string) (string, error) {
+	r, err := c.resource(apiVersion, kind)
+	if err != nil {
+		return "", err
+	}
+
+	path := "/apis/" + apiVersion
+	if !strings.Contains(apiVersion, "/") {
+		path = "/api/" + apiVersion
+	}
+
+	if r.Namespaced {
+		if namespace == "" {
+			namespace = c.namespace
+		}
+		path += "/namespaces/" + url.PathEscape(namespace)
+	}
+
+	path += "/" + r.Name
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+
+	return path, nil
+}
+
+// get fetches a single object into out.
+func (c *kubeClient) get(apiVersion, kind, namespace, name string, out interface{}) error {
+	path, err := c.resourcePath(apiVersion, kind, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	return c.do(http.MethodGet, path, "", nil, out)
+}
+
+// exists reports whether the object exists.
+func (c *kubeClient) exists(apiVersion, kind, namespace, name string) (bool, error) {
+	err := c.get(apiVersion, kind, namespace, name, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// apply server-side applies obj, taking ownership of any conflicting fields.
+func (c *kubeClient) apply(obj kubeObject) error {
+	path, err := c.resourcePath(obj.apiVersion(), obj.kind(), obj.namespace(), obj.name())
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding %v: %w", obj, err)
+	}
+
+	q := url.Values{"fieldManager": {FieldManager}, "force": {"true"}}
+	if err := c.do(http.MethodPatch, path+"?"+q.Encode(), "application/apply-patch+yaml", body, nil); err != nil {
+		return fmt.Errorf("applying %v: %w", obj, err)
+	}
+
+	return nil
+}
+
+// applyObjects server-side applies objs in order, writing progress to w.
+func (c *kubeClient) applyObjects(w io.Writer, objs []kubeObject) error {
+	for _, obj := range objs {
+		if err := c.apply(obj); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%v applied\n", obj)
+	}
+
+	return nil
+}
+
+// canI asks the API server whether we may perform verb on resource (which
+// may be qualified with its group, e.g. deployments.apps) in all namespaces.
+func (c *kubeClient) canI(verb, resource string) (bool, error) {
+	parts := strings.SplitN(resource, ".", 2)
+	name, group := parts[0], ""
+	if len(parts) == 2 {
+		group = parts[1]
+	}
+
+	review := map[string]interface{}{
+		"apiVersion": "authorization.k8s.io/v1",
+		"kind":       "SelfSubjectAccessReview",
+		"spec": map[string]interface{}{
+			"resourceAttributes": map[string]string{
+				"verb":     verb,
+				"group":    group,
+				"resource": name,
+			},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		return false, err
+	}
+
+	var result struct {
+		Status struct {
+			Allowed bool `json:"allowed"`
+		} `json:"status"`
+	}
+	if err := c.do(http.MethodPost, "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", "application/json", body, &result); err != nil {
+		return false, err
+	}
+
+	return result.Status.Allowed, nil
+}
+
+// rolloutTimeout is how long waitForDeployment waits before giving up.
+var rolloutTimeout = 5 * time.Minute
+
+type deployment struct {
+	Metadata struct {
+		Generation int64 `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas *int32 `json:"replicas"`
+		Selector struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration int64 `json:"observedGeneration"`
+		UpdatedReplicas    int32 `json:"updatedReplicas"`
+		AvailableReplicas  int32 `json:"availableReplicas"`
+		Conditions         []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// rolledOut reports whether the deployment's latest generation is fully
+// updated and available, or an error if its progress deadline passed.
+func (d deployment) rolledOut() (bool, error) {
+	for _, cond := range d.Status.Conditions {
+		if cond.Type == "Progressing" && cond.Reason == "ProgressDeadlineExceeded" {
+			return false, fmt.Errorf("rollout stalled: %v", cond.Message)
+		}
+	}
+
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+
+	return d.Status.ObservedGeneration >= d.Metadata.Generation &&
+		d.Status.UpdatedReplicas == replicas &&
+		d.Status.AvailableReplicas == replicas, nil
+}
+
+// deploymentAvailable reports whether the deployment exists and has rolled
+// out.
+func (c *kubeClient) deploymentAvailable(namespace, name string) (bool, error) {
+	var d deployment
+	err := c.get("apps/v1", "Deployment", namespace, name, &d)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ok, _ := d.rolledOut()
+
+	return ok, nil
+}
+
+// livePods returns the names of the pods in namespace which haven't
+// finished.
+func (c *kubeClient) livePods(namespace string) (map[string]bool, error) {
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Phase string `json:"phase"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := c.do(http.MethodGet, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods", "", nil, &pods); err != nil {
+		return nil, err
+	}
+
+	live := map[string]bool{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Succeeded" && pod.Status.Phase != "Failed" {
+			live[pod.Metadata.Name] = true
+		}
+	}
+
+	return live, nil
+}
+
+// restartDeployment rolls the deployment's pods, like kubectl rollout
+// restart, by stamping its pod template.
+func (c *kubeClient) restartDeployment(namespace, name string) error {
+	path, err := c.resourcePath("apps/v1", "Deployment", namespace, name)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						"kubectl.kubernetes.io/restartedAt": time.Now().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.do(http.MethodPatch, path+"?fieldManager="+FieldManager, "application/strategic-merge-patch+json", patch, nil)
+}
+
+// waitForDeployment blocks until the deployment has rolled out, or ctx is
+// cancelled. On failure the error includes recent warning events and logs from
+// unready pods.
+func (c *kubeClient) waitForDeployment(ctx context.Context, namespace, name string) error {
+	deadline := time.Now().Add(rolloutTimeout)
+
+	for {
+		var d deployment
+		err := c.get("apps/v1", "Deployment", namespace, name, &d)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+
+		if err == nil {
+			ok, err := d.rolledOut()
+			if ok {
+				return nil
+			}
+			if err != nil {
+				return c.rolloutFailure(namespace, name, d, err)
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return c.rolloutFailure(namespace, name, d, fmt.Errorf("timed out after %v", rolloutTimeout))
+		}
+
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *kubeClient) rolloutFailure(namespace, name string, d deployment, cause error) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "deployment %v/%v did not roll out: %v", namespace, name, cause)
+
+	var events struct {
+		Items []struct {
+			Reason         string `json:"reason"`
+			Message        string `json:"message"`
+			InvolvedObject struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"involvedObject"`
+		} `json:"items"`
+	}
+	q := url.Values{"fieldSelector": {"type=Warning"}}
+	if err := c.do(http.MethodGet, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/events?"+q.Encode(), "", nil, &events); err == nil {
+		for _, e := range events.Items {
+			if strings.HasPrefix(e.InvolvedObject.Name, name) {
+				fmt.Fprintf(&b, "\n  event %v/%v: %v: %v", e.InvolvedObject.Kind, e.InvolvedObject.Name, e.Reason, e.Message)
+			}
+		}
+	}
+
+	if len(d.Spec.Selector.MatchLabels) == 0 {
+		return errors.New(b.String())
+	}
+
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				ContainerStatuses []struct {
+					Name         string `json:"name"`
+					Ready        bool   `json:"ready"`
+					RestartCount int    `json:"restartCount"`
+				} `json:"containerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	q = url.Values{"labelSelector": {labelSelector(d.Spec.Selector.MatchLabels)}}
+	if err := c.do(http.MethodGet, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods?"+q.Encode(), "", nil, &pods); err != nil {
+		return errors.New(b.String())
+	}
+
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Ready {
+				continue
+			}
+
+			q := url.Values{"container": {cs.Name}, "tailLines": {"20"}}
+			if cs.RestartCount > 0 {
+				q.Set("previous", "true")
+			}
+
+			var logs string
+			path := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods/" + url.PathEscape(pod.Metadata.Name) + "/log?" + q.Encode()
+			if err := c.do(http.MethodGet, path, "", nil, &logs); err != nil {
+				continue
+			}
+
+			fmt.Fprintf(&b, "\n  logs %v/%v (restarts: %v):", pod.Metadata.Name, cs.Name, cs.RestartCount)
+			for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+				fmt.Fprintf(&b, "\n    %v", line)
+			}
+		}
+	}
+
+	return errors.New(b.String())
+}
+
+func labelSelector(labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for k, v := range labels {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, ",")
+}
+
+// kubeObject is a decoded manifest.
+type kubeObject map[string]interface{}
+
+func (o kubeObject) apiVersion() string { s, _ := o["apiVersion"].(string); return s }
+func (o kubeObject) kind() string       { s, _ := o["kind"].(string); return s }
+
+func (o kubeObject) metadata() map[string]interface{} {
+	m, _ := o["metadata"].(map[string]interface{})
+	return m
+}
+
+func (o kubeObject) name() string      { s, _ := o.metadata()["name"].(string); return s }
+func (o kubeObject) namespace() string { s, _ := o.metadata()["namespace"].(string); return s }
+
+func (o kubeObject) String() string {
+	if ns := o.namespace(); ns != "" {
+		return fmt.Sprintf("%v %v/%v", o.kind(), ns, o.name())
+	}
+
+	return fmt.Sprintf("%v %v", o.kind(), o.name())
+}
+
+// parseManifests decodes every document in a multi-document YAML string,
+// skipping empty ones.
+func parseManifests(manifests string) ([]kubeObject, error) {
+	dec := yaml.NewDecoder(strings.NewReader(manifests))
+
+	var objs []kubeObject
+	for {
+		// Decoding into kubeObject directly would make nested maps
+		// kubeObjects too, which the accessors don't expect.
+		var m map[string]interface{}
+		err := dec.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding manifests: %w", err)
+		}
+		if len(m) == 0 {
+			continue
+		}
+		obj := kubeObject(m)
+
+		if obj.apiVersion() == "" || obj.kind() == "" || obj.name() == "" {
+			return nil, fmt.Errorf("manifest is missing apiVersion, kind or metadata.name: %v", obj)
+		}
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestParseManifests(t *testing.T) {
+	objs, err := parseManifests("apiVersion: v1\nkind: Service\nmetadata:\n  name: gamf\n  namespace: default\n---\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: arc\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objs) != 2 {
+		t.Fatalf("got %v objects, want 2", len(objs))
+	}
+	if got := objs[0].String(); got != "Service default/gamf" {
+		t.Errorf("got %q, want %q", got, "Service default/gamf")
+	}
+	if got := objs[1].String(); got != "ConfigMap arc" {
+		t.Errorf("got %q, want %q", got, "ConfigMap arc")
+	}
+}
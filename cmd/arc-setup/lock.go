@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// LockFileName guards data/ against two arc-setup processes changing it at
+// once, e.g. both deciding arc.env is missing and creating two Apps.
+const LockFileName = "data/.arc-setup.lock"
+
+// lockPollInterval is how often --wait checks whether the lock is free.
+var lockPollInterval = 500 * time.Millisecond
+
+// lockWriteGrace is how long a lock file may be empty or partly written while
+// its owner writes it, before it is reported as unreadable.
+var lockWriteGrace = time.Second
+
+// waitForLock is set by --wait, to wait for another arc-setup to finish
+// rather than failing.
+var waitForLock bool
+
+// lockOwner is written into the lock file, identifying who holds it.
+type lockOwner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Command  string    `json:"command"`
+	Started  time.Time `json:"started"`
+}
+
+func (o lockOwner) String() string {
+	return fmt.Sprintf("%q (pid %v on %v, since %v)", o.Command, o.PID, o.Hostname, o.Started.Local().Format(time.Kitchen))
+}
+
+// same reports whether o and other are the same acquisition of the lock.
+func (o lockOwner) same(other lockOwner) bool {
+	return o.PID == other.PID && o.Hostname == other.Hostname && o.Command == other.Command && o.Started.Equal(other.Started)
+}
+
+// stale reports whether the owner has exited without releasing the lock.
+// Processes on other hosts, e.g. sharing data/ over a mount, can't be
+// checked, so are assumed to be running.
+func (o lockOwner) stale(hostname string) bool {
+	if o.Hostname != hostname {
+		return false
+	}
+
+	p, err := os.FindProcess(o.PID)
+	if err != nil {
+		return true
+	}
+
+	err = p.Signal(syscall.Signal(0))
+
+	return err != nil && !errors.Is(err, syscall.EPERM)
+}
+
+// dataLock is a held LockFileName.
+type dataLock struct {
+	path  string
+	owner lockOwner
+}
+
+// lockData takes the data directory lock for command, breaking it if its
+// owner has died. If another process holds it, it fails, or with wait polls
+// until it is released or ctx is done.
+func lockData(ctx context.Context, path, command string, wait bool) (*dataLock, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error getting hostname: %w", err)
+	}
+
+	owner := lockOwner{PID: os.Getpid(), Hostname: hostname, Command: command, Started: time.Now().UTC()}
+	b, err := json.Marshal(owner)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding lock: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating %v: %w", filepath.Dir(path), err)
+	}
+
+	waiting := false
+	for {
+		err := createExclusive(path, b)
+		if err == nil {
+			return &dataLock{path: path, owner: owner}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("error creating %v: %w", path, err)
+		}
+
+		held, err := readLockOwner(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Released between us trying and reading it.
+			continue
+		}
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// Created, but perhaps not yet written by its owner.
+			if info, serr := os.Stat(path); serr == nil && time.Since(info.ModTime()) < lockWriteGrace {
+				if err := sleepContext(ctx, 10*time.Millisecond); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if held.stale(hostname) {
+			// Only break the lock we judged stale, not one another process
+			// has just taken after breaking it first.
+			if again, err := readLockOwner(path); err == nil && again.same(held) {
+				logWarnf("Breaking the lock on data/ left by %v, which is no longer running.", held)
+				if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("error removing stale %v: %w", path, err)
+				}
+			}
+			continue
+		}
+
+		if !wait {
+			return nil, fmt.Errorf("data/ is locked by %v; rerun with --wait to wait for it, or remove %v if it is not running", held, path)
+		}
+		if !waiting {
+			logInfof("Waiting for %v to finish...", held)
+			waiting = true
+		}
+		if err := sleepContext(ctx, lockPollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// createExclusive writes b to a new file at path, failing with fs.ErrExist
+// if it already exists.
+func createExclusive(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+func readLockOwner(path string) (lockOwner, error) {
+	var owner lockOwner
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return owner, err
+	}
+
+	if err := json.Unmarshal(b, &owner); err != nil {
+		return owner, fmt.Errorf("%v is unreadable, remove it if arc-setup is not running: %w", path, err)
+	}
+
+	return owner, nil
+}
+
+// release removes the lock, if it is still ours.
+func (l *dataLock) release() {
+	held, err := readLockOwner(l.path)
+	if err != nil || !held.same(l.owner) {
+		return
+	}
+
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logWarnf("Could not remove %v: %v", l.path, err)
+	}
+}
+
+// mutatingCommand reports whether the command in args changes data/, and so
+// must hold the lock. Long running readers, like the ingress tunnel, don't.
+// up and runners prune take the lock themselves, once they know it isn't a
+// dry run.
+func mutatingCommand(args []string) bool {
+	if len(args) == 0 {
+		return !dryRun
+	}
+
+	switch args[0] {
+	case "mode", "reconcile", "import", "rotate":
+		return true
+	case "cluster":
+		return len(args) > 1 && (args[1] == "create" || args[1] == "delete")
+	default:
+		return false
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockData(t *testing.T) {
+	saved := log.w
+	log.w = io.Discard
+	defer func() { log.w = saved }()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "data", ".arc-setup.lock")
+
+	first, err := lockData(ctx, path, "arc-setup", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lockData(ctx, path, "arc-setup up", false); err == nil || !strings.Contains(err.Error(), `locked by "arc-setup"`) {
+		t.Fatalf("got error %v, want locked by arc-setup", err)
+	}
+
+	first.release()
+	second, err := lockData(ctx, path, "arc-setup up", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing a lock that has since been taken by another leaves it be.
+	first.release()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("released another's lock: %v", err)
+	}
+	second.release()
+}
+
+func TestLockDataStale(t *testing.T) {
+	saved := log.w
+	log.w = io.Discard
+	defer func() { log.w = saved }()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skipf("can't run true: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		owner lockOwner
+		stale bool
+	}{
+		{name: "exited", owner: lockOwner{PID: exited.ProcessState.Pid(), Hostname: hostname}, stale: true},
+		{name: "running", owner: lockOwner{PID: os.Getppid(), Hostname: hostname}},
+		{name: "other host", owner: lockOwner{PID: exited.ProcessState.Pid(), Hostname: hostname + "-other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".arc-setup.lock")
+			b, err := json.Marshal(tt.owner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := lockData(context.Background(), path, "arc-setup", false)
+			if tt.stale {
+				if err != nil {
+					t.Fatalf("stale lock was not broken: %v", err)
+				}
+				l.release()
+				return
+			}
+			if err == nil {
+				t.Fatal("took a lock held by a running process")
+			}
+		})
+	}
+}
+
+func TestLockDataWait(t *testing.T) {
+	saved, savedInterval := log.w, lockPollInterval
+	log.w, lockPollInterval = io.Discard, time.Millisecond
+	defer func() { log.w, lockPollInterval = saved, savedInterval }()
+
+	path := filepath.Join(t.TempDir(), ".arc-setup.lock")
+	first, err := lockData(context.Background(), path, "arc-setup", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := lockData(ctx, path, "arc-setup", true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want to wait until the deadline", err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, first.release)
+	second, err := lockData(context.Background(), path, "arc-setup", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.release()
+}
+
+func TestLockDataPartlyWritten(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := json.Marshal(lockOwner{PID: os.Getppid(), Hostname: hostname, Command: "arc-setup up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process has created the lock, but not yet written its owner.
+	path := filepath.Join(t.TempDir(), ".arc-setup.lock")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, func() { _ = os.WriteFile(path, held, 0644) })
+
+	if _, err := lockData(context.Background(), path, "arc-setup", false); err == nil || !strings.Contains(err.Error(), `locked by "arc-setup up"`) {
+		t.Errorf("got error %v, want locked by arc-setup up", err)
+	}
+
+	// One left partly written for longer is reported, not waited on forever.
+	if err := os.WriteFile(path, held[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockData(context.Background(), path, "arc-setup", false); err == nil || !strings.Contains(err.Error(), "is unreadable") {
+		t.Errorf("got error %v, want the lock reported unreadable", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "arc.env")
+
+	for _, content := range []string{"first\n", "second\n"} {
+		if err := writeFileAtomic(name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("got %q, want %q", b, content)
+		}
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want 0600", info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("left temporary files behind: %v", entries)
+	}
+}
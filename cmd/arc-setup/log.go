@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// logLevelPrefixes mark each level in text output.
+var logLevelPrefixes = map[logLevel]string{
+	levelDebug: "· ",
+	levelInfo:  "ℹ ",
+	levelWarn:  "⚠ ",
+	levelError: "✖ ",
+}
+
+// logger writes leveled messages to stderr as text or JSON lines. Everything
+// is redacted before it is written.
+type logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level logLevel
+	json  bool
+}
+
+var log = &logger{w: os.Stderr, level: levelInfo}
+
+func (l *logger) enabled(level logLevel) bool { return level >= l.level }
+
+func (l *logger) logf(level logLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	msg := redact(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.json {
+		b, _ := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}{time.Now().UTC().Format(time.RFC3339Nano), logLevelNames[level], msg})
+		fmt.Fprintf(l.w, "%s\n", b)
+		return
+	}
+
+	fmt.Fprintf(l.w, "%v%v\n", logLevelPrefixes[level], msg)
+}
+
+func logDebugf(format string, args ...interface{}) { log.logf(levelDebug, format, args...) }
+func logInfof(format string, args ...interface{})  { log.logf(levelInfo, format, args...) }
+func logWarnf(format string, args ...interface{})  { log.logf(levelWarn, format, args...) }
+func logErrorf(format string, args ...interface{}) { log.logf(levelError, format, args...) }
+
+const redacted = "[REDACTED]"
+
+var (
+	pemRe   = regexp.MustCompile(`-----BEGIN [A-Z ]+-----[\s\S]*?-----END [A-Z ]+-----`)
+	jwtRe   = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+	tokenRe = regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9_]+|github_pat_[A-Za-z0-9_]+|v1\.[0-9a-f]{40})\b`)
+
+	// codePathRe matches the manifest exchange code in a conversion URL, and
+	// the gamf key it is fetched with.
+	codePathRe = regexp.MustCompile(`(/app-manifests/|/code/)[^/?\s"]+`)
+
+	// escapedPEMRe matches PEM blocks inside JSON strings, with \n escapes.
+	escapedPEMRe = regexp.MustCompile(`-----BEGIN [A-Z ]+-----(\\n|[^"])*?-----END [A-Z ]+-----`)
+)
+
+// sensitiveKeys are JSON keys whose values are always redacted.
+var sensitiveKeys = map[string]bool{
+	"pem":                         true,
+	"private_key":                 true,
+	"github_app_private_key":      true,
+	"webhook_secret":              true,
+	"secret":                      true,
+	"github_webhook_secret_token": true,
+	"token":                       true,
+	"client_secret":               true,
+	"code":                        true,
+}
+
+// sensitiveEnv are environment variables, and dotenv keys, whose values are
+// always redacted.
+var sensitiveEnv = map[string]bool{
+	"ARC_GITHUB_APP_WEBHOOK_SECRET": true,
+	"ARC_GITHUB_APP_PRIVATE_KEY":    true,
+	"ARC_SECRETS_PASSPHRASE":        true,
+	"VAULT_TOKEN":                   true,
+}
+
+// redact removes PEM blocks, JWTs, GitHub tokens and manifest exchange codes
+// from s.
+func redact(s string) string {
+	s = pemRe.ReplaceAllString(s, redacted)
+	s = escapedPEMRe.ReplaceAllString(s, redacted)
+	s = jwtRe.ReplaceAllString(s, redacted)
+	s = tokenRe.ReplaceAllString(s, redacted)
+	s = codePathRe.ReplaceAllString(s, "${1}"+redacted)
+
+	return s
+}
+
+// redactDotenv redacts the values of sensitiveEnv in a dotenv file, returning
+// other files unchanged. It also returns the values it redacted, so they can
+// be scrubbed wherever else they turn up.
+func redactDotenv(b []byte) ([]byte, []string) {
+	es, err := unmarshalDotenv(b)
+	if err != nil {
+		return b, nil
+	}
+
+	var values []string
+	for k, v := range es {
+		if sensitiveEnv[k] && v != "" && v != redacted {
+			values = append(values, v)
+			es[k] = redacted
+		}
+	}
+	if len(values) == 0 {
+		return b, nil
+	}
+
+	return marshalDotenv(es, "Secrets redacted by arc-setup --record."), values
+}
+
+// redactJSON redacts the values of sensitiveKeys anywhere in a JSON body,
+// returning other bodies unchanged.
+func redactJSON(body []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+
+	b, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return body
+	}
+
+	return b
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if sensitiveKeys[k] {
+				if s, ok := val.(string); !ok || s != "" {
+					v[k] = redacted
+				}
+				continue
+			}
+			v[k] = redactValue(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = redactValue(val)
+		}
+	}
+
+	return v
+}
+
+// sensitiveHeaders are redacted when tracing.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"X-Vault-Token":       true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Hub-Signature-256": true,
+}
+
+// traceTransport logs requests and responses at debug level, redacted.
+type traceTransport struct {
+	next http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !log.enabled(levelDebug) {
+		return t.next.RoundTrip(req)
+	}
+
+	reqBody, err := peekBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	logDebugf("→ %v %v%v%v", req.Method, req.URL, formatHeaders(req.Header), formatBody(reqBody))
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		logDebugf("← %v %v: %v", req.Method, req.URL, err)
+		return nil, err
+	}
+
+	resBody, err := peekBody(&res.Body)
+	if err != nil {
+		return nil, err
+	}
+	logDebugf("← %v %v: %v in %v%v%v", req.Method, req.URL, res.Status, time.Since(start).Round(time.Millisecond), formatHeaders(res.Header), formatBody(resBody))
+
+	return res, nil
+}
+
+// peekBody reads *body and replaces it so it can be read again.
+func peekBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+	*body = io.NopCloser(bytes.NewReader(b))
+
+	return b, nil
+}
+
+func formatHeaders(h http.Header) string {
+	var b strings.Builder
+	for _, k := range sortedKeys(headerMap(h)) {
+		v := strings.Join(h.Values(k), ", ")
+		if sensitiveHeaders[k] {
+			v = redacted
+		}
+		fmt.Fprintf(&b, "\n    %v: %v", k, v)
+	}
+
+	return b.String()
+}
+
+func headerMap(h http.Header) map[string]interface{} {
+	m := make(map[string]interface{}, len(h))
+	for k := range h {
+		m[k] = nil
+	}
+
+	return m
+}
+
+func formatBody(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+
+	const limit = 4096
+	s := string(redactJSON(b))
+	if len(s) > limit {
+		s = s[:limit] + "..."
+	}
+
+	return "\n    " + s
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -56,30 +58,255 @@ type Vars struct {
 	EnterpriseURL  string `env:"ARC_GITHUB_ENTERPRISE_URL"`
 	AppID          string `env:"ARC_GITHUB_APP_ID"`
 	InstallationID string `env:"ARC_GITHUB_APP_INSTALLATION_ID"`
-	PrivateKey     string `env:"ARC_GITHUB_APP_PEM_FILE_PATH"`
-	WebhookSecret  string `env:"ARC_GITHUB_APP_WEBHOOK_SECRET"`
 	Organization   string `env:"ARC_GITHUB_APP_ORGANIZATION"`
 	RunnerGroup    string `env:"ARC_GITHUB_APP_RUNNER_GROUP"`
+	ConfigURL      string `env:"ARC_GITHUB_CONFIG_URL"`
+	ScaleSets      string `env:"ARC_RUNNER_SCALE_SETS"`
+
+	// RunnerGroupVisibility, when set, is who may use RunnerGroup: all,
+	// selected or private repositories. RunnerGroupRepositories and
+	// RunnerGroupWorkflows are comma separated, and RunnerGroupPublicRepos is
+	// true or false.
+	RunnerGroupVisibility   string `env:"ARC_GITHUB_APP_RUNNER_GROUP_VISIBILITY"`
+	RunnerGroupRepositories string `env:"ARC_GITHUB_APP_RUNNER_GROUP_REPOSITORIES"`
+	RunnerGroupWorkflows    string `env:"ARC_GITHUB_APP_RUNNER_GROUP_WORKFLOWS"`
+	RunnerGroupPublicRepos  string `env:"ARC_GITHUB_APP_RUNNER_GROUP_PUBLIC_REPOS"`
+
+	// PrivateKeyRef and WebhookSecretRef point into the secrets backend.
+	PrivateKeyRef    string `env:"ARC_GITHUB_APP_PRIVATE_KEY_REF"`
+	WebhookSecretRef string `env:"ARC_GITHUB_APP_WEBHOOK_SECRET_REF"`
+
+	// PrivateKey and WebhookSecret are the plaintext key path and secret
+	// written before secrets backends existed. They are still read, but no
+	// longer written.
+	PrivateKey    string `env:"ARC_GITHUB_APP_PEM_FILE_PATH"`
+	WebhookSecret string `env:"ARC_GITHUB_APP_WEBHOOK_SECRET"`
+}
+
+// privateKeyPEM returns the App's private key.
+func (v Vars) privateKeyPEM(ctx context.Context) ([]byte, error) {
+	if v.PrivateKeyRef != "" {
+		return resolveSecret(ctx, v.PrivateKeyRef)
+	}
+
+	if v.PrivateKey == "" {
+		return nil, fmt.Errorf("%v has no private key", VarFileName)
+	}
+
+	b, err := files.ReadFile(v.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	return b, nil
+}
+
+// webhookSecret returns the App's webhook secret, which is empty for apps
+// without a webhook.
+func (v Vars) webhookSecret(ctx context.Context) (string, error) {
+	if v.WebhookSecretRef == "" {
+		return v.WebhookSecret, nil
+	}
+
+	b, err := resolveSecret(ctx, v.WebhookSecretRef)
+
+	return string(b), err
+}
+
+// inClusterSecrets reports whether the credentials live in the Secrets the
+// charts read, rather than needing to be passed in as values.
+func (v Vars) inClusterSecrets() bool {
+	return strings.HasPrefix(v.PrivateKeyRef, "kubernetes:")
 }
 
 func main() {
-	if err := realMain(); err != nil {
-		fmt.Printf("error: %v\n", err)
-		os.Exit(1)
+	ctx, stop := signalContext()
+	err := run(ctx, os.Args[1:])
+	stop()
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	var cerr *commandExitError
+	if errors.As(err, &cerr) {
+		// The command has said what went wrong itself.
+		os.Exit(cerr.code)
+	}
+	if err != nil {
+		serr := classifyError(err)
+		emit(event{
+			Type:     eventError,
+			Error:    err.Error(),
+			Kind:     string(serr.Kind),
+			Hint:     serr.Hint,
+			Docs:     serr.Docs,
+			ExitCode: serr.ExitCode(),
+		})
+		os.Exit(serr.ExitCode())
 	}
 }
 
-func realMain() error {
-	githubHost, err := loadHost()
+func run(ctx context.Context, args []string) (err error) {
+	args, err = parseGlobalFlags(args)
 	if err != nil {
 		return err
 	}
 
-	baseURL := "https://" + githubHost
+	if err := configureHTTP(); err != nil {
+		return err
+	}
+
+	if replayPath != "" {
+		if len(args) > 0 || dryRun || recordPath != "" {
+			return usageError("--replay only replays setup, and can't be combined with a command, --dry-run or --record")
+		}
+
+		return replayMain(ctx, replayPath, os.Stdout)
+	}
+
+	if mutatingCommand(args) {
+		lock, err := lockData(ctx, LockFileName, commandName(args), waitForLock)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	if recordPath != "" {
+		r := startRecording()
+		defer func() {
+			if saveErr := r.save(recordPath); err == nil {
+				err = saveErr
+			}
+		}()
+	}
+
+	if len(args) == 0 {
+		if dryRun {
+			return planMain(ctx, os.Stdout, nil)
+		}
+
+		return realMain(ctx)
+	}
+
+	if dryRun && args[0] != "up" && args[0] != "runners" {
+		return usageError("--dry-run is only supported by setup, up and runners prune")
+	}
+
+	switch args[0] {
+	case "mode":
+		return modeMain(ctx, args[1:])
+	case "cluster":
+		return clusterMain(ctx, args[1:])
+	case "up":
+		return upMain(ctx, args[1:])
+	case "diff":
+		return diffMain(ctx, args[1:])
+	case "reconcile":
+		return reconcileMain(ctx, args[1:])
+	case "export":
+		return exportMain(ctx, args[1:])
+	case "import":
+		return importMain(ctx, args[1:])
+	case "render":
+		return renderMain(args[1:])
+	case "rotate":
+		return rotateMain(ctx, args[1:])
+	case "ratelimit":
+		return ratelimitMain(ctx, args[1:])
+	case "token":
+		return tokenMain(ctx, args[1:])
+	case "exec":
+		return execMain(ctx, args[1:])
+	case "runners":
+		return runnersMain(ctx, args[1:])
+	case "status":
+		return statusMain(ctx, args[1:])
+	default:
+		return usageError("unknown command %q", args[0])
+	}
+}
+
+// commandName names the command in args, for the data/ lock.
+func commandName(args []string) string {
+	if len(args) == 0 {
+		return "arc-setup"
+	}
+	if args[0] == "cluster" && len(args) > 1 {
+		return "arc-setup cluster " + args[1]
+	}
+
+	return "arc-setup " + args[0]
+}
+
+// parseGlobalFlags handles the flags before the command, which configure
+// logging, output, --dry-run, --wait and cassettes, falling back to ARC_LOG_LEVEL,
+// ARC_LOG_FORMAT and ARC_OUTPUT. It returns the remaining args.
+func parseGlobalFlags(args []string) ([]string, error) {
+	flags := flag.NewFlagSet("arc-setup", flag.ContinueOnError)
+	verbose := flags.Bool("verbose", false, "log debug messages, including HTTP requests and responses")
+	quiet := flags.Bool("quiet", false, "only log warnings and errors")
+	format := flags.String("log-format", os.Getenv("ARC_LOG_FORMAT"), "log format: text or json")
+	out := flags.String("output", os.Getenv("ARC_OUTPUT"), "progress output on stdout: text or ndjson")
+	flags.BoolVar(&dryRun, "dry-run", false, "print what setup, up or runners prune would do, without doing it")
+	flags.BoolVar(&waitForLock, "wait", false, "wait for another arc-setup changing data/ to finish, rather than failing")
+	flags.StringVar(&recordPath, "record", "", "record HTTP requests, prompts and files read to a sanitized cassette at `path`")
+	flags.StringVar(&replayPath, "replay", "", "run setup against the cassette at `path` instead of GitHub, in memory")
+	if err := parseFlags(flags, args); err != nil {
+		return nil, err
+	}
+
+	o, err := parseOutputFormat(*out)
+	if err != nil {
+		return nil, &setupError{Kind: kindUsage, Err: err}
+	}
+	output = o
+
+	level := levelInfo
+	if name := os.Getenv("ARC_LOG_LEVEL"); name != "" {
+		found := false
+		for l, n := range logLevelNames {
+			if n == name {
+				level, found = l, true
+			}
+		}
+		if !found {
+			return nil, usageError("unknown ARC_LOG_LEVEL %q (must be debug, info, warn or error)", name)
+		}
+	}
+
+	switch {
+	case *verbose && *quiet:
+		return nil, usageError("--verbose and --quiet are mutually exclusive")
+	case *verbose:
+		level = levelDebug
+	case *quiet:
+		level = levelWarn
+	}
+
+	switch *format {
+	case "", "text":
+		log.json = false
+	case "json":
+		log.json = true
+	default:
+		return nil, usageError("unknown log format %q (must be text or json)", *format)
+	}
+	log.level = level
+
+	return flags.Args(), nil
+}
+
+// realMain sets up the GitHub App. If ctx is cancelled part way, what was
+// created so far is rolled back or kept for the next run to resume.
+func realMain(ctx context.Context) (err error) {
+	githubHost, err := loadHost()
+	if err != nil {
+		return err
+	}
 
 	githubOrganizations, err := loadOrgs()
 	if err != nil {
-		return nil
+		return err
 	}
 	githubOrganizationNames := make([]string, 0, len(githubOrganizations))
 	for name := range githubOrganizations {
@@ -88,17 +315,39 @@ func realMain() error {
 
 	namePrefix, err := randomName()
 	if err != nil {
-		return nil
+		return err
 	}
 
-	isGhes := githubHost != GitHubDotcomHost
-	codespaceName := os.Getenv("CODESPACE_NAME")
-	if codespaceName == "" {
-		return fmt.Errorf("CODESPACE_NAME is empty")
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	if state.Mode == "" {
+		if err := chooseMode(ctx, state); err != nil {
+			return err
+		}
 	}
 
-	codespacesURL := fmt.Sprintf("https://%v-80.githubpreview.dev", codespaceName)
-	gamfHost := fmt.Sprintf("%v/gamf", codespacesURL)
+	caps, err := detectCapabilities(ctx, githubHost)
+	if err != nil {
+		return err
+	}
+	if err := caps.checkMode(state.Mode); err != nil {
+		return err
+	}
+	if state.Mode.NeedsWebhook() && !caps.WorkflowJob {
+		logWarnf("GHES %v has no workflow_job webhook event, runners will be scaled by polling instead.", caps.Version)
+	}
+
+	backend, err := chooseSecretsBackend(state)
+	if err != nil {
+		return err
+	}
+
+	pending, err := resumePending(state, githubHost)
+	if err != nil {
+		return err
+	}
 
 	githubOrg := &survey.Select{
 		Message: "Which GitHub Org should Actions Runner Controller be installed on?",
@@ -117,30 +366,144 @@ func realMain() error {
 		Message: "Actions Runner Controller GitHub App Installation ID:",
 	}
 
-	vars := Vars{}
+	vars := Vars{EnterpriseURL: githubHost.EnterpriseURL()}
+	if pending != nil {
+		vars = pending.vars(githubHost)
+	} else {
+		if err := ask(githubOrg, &vars.Organization); err != nil {
+			return err
+		}
+		vars.ConfigURL = githubHost.OrgURL(vars.Organization)
+		pending = &pendingSetup{Organization: vars.Organization}
+	}
+	orgID := githubOrganizations[vars.Organization]
+
+	defer func() {
+		if errors.Is(err, context.Canceled) {
+			err = interrupted(state, githubHost, pending, err)
+		}
+	}()
+
+	if pending.AppID == "" {
+		if state.Mode.NeedsWebhook() {
+			pending.AppSlug, err = createManifestApp(ctx, &vars, backend, githubHost, caps, namePrefix)
+		} else {
+			pending.AppSlug, pending.KeyFile, err = registerApp(ctx, &vars, backend, githubHost, namePrefix)
+		}
+		if err != nil {
+			return err
+		}
+		if err := pending.record(state, vars); err != nil {
+			return err
+		}
+	}
+	appSlug := pending.AppSlug
+
+	switch {
+	case vars.InstallationID != "":
+		// Resuming a setup which got this far.
+	case output == outputNDJSON:
+		emit(event{
+			Type:         eventActionRequired,
+			Message:      fmt.Sprintf("Please install the newly created GitHub App onto %v", vars.Organization),
+			URL:          githubHost.AppInstallURL(appSlug, orgID),
+			Organization: vars.Organization,
+		})
+		if vars.InstallationID, err = waitForInstallation(ctx, githubHost, vars); err != nil {
+			return err
+		}
+	default:
+		fmt.Printf("ℹ Please install the newly created GitHub App Installation ID onto %v here: %v\n", vars.Organization, githubHost.AppInstallURL(appSlug, orgID))
+		fmt.Printf("ℹ After installation, you should be redirected to a URL that looks like this: %v/{id}\n", githubHost.InstallationsURL(vars.Organization))
+		fmt.Printf("ℹ Please enter the {id} of the installation below.\n")
+		if err := ask(installationID, &vars.InstallationID); err != nil {
+			return err
+		}
+	}
+	if err := pending.record(state, vars); err != nil {
+		return err
+	}
+	emit(event{
+		Type:           eventInstallationDetected,
+		Message:        fmt.Sprintf("Using installation %v on %v", vars.InstallationID, vars.Organization),
+		Organization:   vars.Organization,
+		InstallationID: vars.InstallationID,
+	})
+
+	if err := storeAppIDs(ctx, backend, vars); err != nil {
+		return err
+	}
+
+	emit(event{
+		Type:    eventActionRequired,
+		Message: "We need to tell Actions Runner Controller which Runner Group to create runners in. You can see and create new GitHub Actions Runner Groups here",
+		URL:     githubHost.RunnersURL(vars.Organization),
+		Input:   "prompt",
+	})
+	if err := ask(runnerGroup, &vars.RunnerGroup); err != nil {
+		return err
+	}
+	warnRunnerGroup(ctx, githubHost, caps, vars)
+	if err := askRunnerGroupPolicy(&vars, caps); err != nil {
+		return err
+	}
+	applyRunnerGroupPolicy(ctx, githubHost, vars)
 
-	if isGhes {
-		vars.EnterpriseURL = baseURL
+	if state.Mode == ModeScaleSet {
+		scaleSets := &survey.Input{
+			Message: "Which runner scale sets should be created? (comma separated)",
+			Default: "arc-runner-set",
+			Help:    "Each name becomes a gha-runner-scale-set release, and the label workflows use in `runs-on` to target it.",
+		}
+		if err := ask(scaleSets, &vars.ScaleSets, survey.WithValidator(scaleSetsValidator())); err != nil {
+			return err
+		}
+		vars.ScaleSets = strings.Join(splitScaleSets(vars.ScaleSets), ",")
 	}
 
-	if err := ask(githubOrg, &vars.Organization); err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	orgID := githubOrganizations[vars.Organization]
+	if err := saveVars(vars); err != nil {
+		return err
+	}
+
+	state.Pending = nil
+
+	return state.save()
+}
+
+// codePollInterval is the delay between polls of gamf for the exchange code,
+// and installationPollInterval between checks for the App's installation.
+var (
+	codePollInterval         = time.Second
+	installationPollInterval = 5 * time.Second
+)
+
+// createManifestApp creates the GitHub App via the manifest flow, using the
+// gamf service running in the cluster to receive the exchange code.
+func createManifestApp(ctx context.Context, vars *Vars, backend SecretsBackend, githubHost githubInstance, caps capabilities, namePrefix string) (string, error) {
+	codespacesURL, err := codespacesURL()
+	if err != nil {
+		return "", err
+	}
+
+	gamfHost := fmt.Sprintf("%v/gamf", codespacesURL)
 
 	hookUrl := fmt.Sprintf("%v/webhook", codespacesURL)
-	manifestPayload, err := json.Marshal(buildGamfPayload(namePrefix, vars.Organization, githubHost, hookUrl))
+	manifestPayload, err := json.Marshal(buildGamfPayload(namePrefix, vars.Organization, githubHost.Name(), hookUrl, caps))
 	if err != nil {
-		return fmt.Errorf("failed to encode gamf payload: %w", err)
+		return "", fmt.Errorf("failed to encode gamf payload: %w", err)
 	}
 
-	res, err := http.DefaultClient.Post(gamfHost+"/start", "application/json", bytes.NewReader(manifestPayload))
+	res, err := postContext(ctx, gamfHost+"/start", "application/json", bytes.NewReader(manifestPayload))
 	if err != nil {
-		return fmt.Errorf("failed to make request to %v/start: %w", gamfHost, err)
+		return "", fmt.Errorf("failed to make request to %v/start: %w", gamfHost, err)
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode > 399 || res.StatusCode < 200 {
-		return fmt.Errorf("failed to make request, got status: %v", res.StatusCode)
+		return "", fmt.Errorf("failed to make request, got status: %v", res.StatusCode)
 	}
 
 	var startResponse struct {
@@ -148,129 +511,166 @@ func realMain() error {
 		URL string `json:"url"`
 	}
 	if err := json.NewDecoder(res.Body).Decode(&startResponse); err != nil {
-		return fmt.Errorf("failed to decode start body: %w", err)
+		return "", fmt.Errorf("failed to decode start body: %w", err)
 	}
 
-	fmt.Printf("ℹ Please continue to this URL to create a new GitHub Application for Actions Runner Controller: %v\n", startResponse.URL)
-	fmt.Printf("ℹ Press the enter key once you have finished creating the application.\n")
-	input := bufio.NewScanner(os.Stdin)
-	input.Scan()
+	emit(event{Type: eventManifestStarted, Message: "Started the App manifest flow", Organization: vars.Organization})
+	emit(event{
+		Type:    eventActionRequired,
+		Message: "Please continue to this URL to create a new GitHub Application for Actions Runner Controller",
+		URL:     startResponse.URL,
+		Input:   "enter",
+	})
+	fmt.Fprintf(humanOutput(), "ℹ Press the enter key once you have finished creating the application.\n")
+	if err := prompts.waitForEnter(ctx); err != nil {
+		return "", err
+	}
 
-	fmt.Printf("ℹ Polling for completiong of App creation token\n")
+	logInfof("Polling for completion of App creation token")
 	var doneResponse struct {
 		Code string `json:"code"`
 	}
-	for i := 0; i < 10; i++ {
-		res, err := http.DefaultClient.Post(gamfHost+"/code/"+startResponse.Key, "", nil)
+	for i := 0; i < 10 && doneResponse.Code == ""; i++ {
+		if i > 0 {
+			if err := sleepContext(ctx, codePollInterval); err != nil {
+				return "", err
+			}
+		}
+
+		res, err := postContext(ctx, gamfHost+"/code/"+startResponse.Key, "", nil)
 		if err != nil {
-			return fmt.Errorf("failed to make request to %v/start: %w", gamfHost, err)
+			return "", fmt.Errorf("failed to make request to %v/code: %w", gamfHost, err)
 		}
 
 		if res.StatusCode > 399 || res.StatusCode < 200 {
+			res.Body.Close()
 			continue
 		}
 
-		if err := json.NewDecoder(res.Body).Decode(&doneResponse); err != nil {
-			return fmt.Errorf("error decoding response: %w", err)
+		err = json.NewDecoder(res.Body).Decode(&doneResponse)
+		res.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("error decoding response: %w", err)
 		}
 	}
 	if doneResponse.Code == "" {
-		return fmt.Errorf("failed to fetch exchange token for app creation")
+		return "", conversionExpiredError(
+			fmt.Errorf("failed to fetch exchange token for app creation"),
+			"gamf never received the code GitHub redirects with after the App is created. Check the App was created and that the public URL reaches gamf, then run arc-setup again.",
+		)
 	}
+	emit(event{Type: eventExchangeCodeReceived, Message: "Received the manifest exchange code"})
 
-	fmt.Printf("ℹ Converting manifest into App\n")
+	logInfof("Converting manifest into App")
 	var conversionResponse struct {
 		ID            int    `json:"id"`
 		Slug          string `json:"slug"`
 		WebhookSecret string `json:"webhook_secret"`
 		PrivateKey    string `json:"pem"`
 	}
-	for i := 0; i < 10; i++ {
-		var url string
-		if isGhes {
-			url = "https://" + githubHost + "/api/v3/app-manifests/" + doneResponse.Code + "/conversions"
-		} else {
-			url = "https://api.github.com/app-manifests/" + doneResponse.Code + "/conversions"
+	// Retried after a server error so a blip doesn't lose the App, but the
+	// code can only be used once.
+	err = githubRequestWith(ctx, retryServerErrors, http.MethodPost, githubHost.ManifestConversionURL(doneResponse.Code), "", nil, &conversionResponse)
+	var gerr *githubError
+	if errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound && gerr.AfterServerError {
+		// The attempt that failed may have used the code, creating the App
+		// without us receiving its credentials.
+		return "", &setupError{
+			Kind: kindUnknown,
+			Err:  fmt.Errorf("failed to convert app manifest into application, it may have been created: %w", err),
+			Hint: fmt.Sprintf("GitHub failed while converting the manifest. If the App was created anyway, delete it at %v, then run arc-setup again.", githubHost.AppSettingsURL(vars.Organization, "")),
 		}
-
-		res, err := http.DefaultClient.Post(url, "", nil)
-		if err != nil {
-			return fmt.Errorf("failed to make request to GitHub: %w", err)
-		}
-
-		if res.StatusCode > 399 || res.StatusCode < 200 {
-			fmt.Printf("Got %s during conversion, retrying in 5s...\n", res.Status)
-			time.Sleep(5 * time.Second)
-			continue
-		}
-
-		if err := json.NewDecoder(res.Body).Decode(&conversionResponse); err != nil {
-			return fmt.Errorf("error decoding response: %w", err)
-		}
-
-		break
+	}
+	if errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound {
+		// Retrying can't help: the code has expired or was already used.
+		return "", conversionExpiredError(
+			fmt.Errorf("failed to convert app manifest into application: %w", err),
+			"Manifest codes can only be used once, within an hour of creating the App. Delete the App and run arc-setup again.",
+		)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to convert app manifest into application: %w", err)
 	}
 	if conversionResponse.ID == 0 {
-		return fmt.Errorf("failed to convert app manifest into application")
+		return "", fmt.Errorf("failed to convert app manifest into application: no App in the response")
 	}
 
-	fmt.Printf("ℹ App Created!\n")
-	fmt.Printf("ID: %v\n", conversionResponse.ID)
-	fmt.Printf("Slug: %v\n", conversionResponse.Slug)
+	emit(event{
+		Type:    eventAppConverted,
+		Message: fmt.Sprintf("App created: %v (ID %v)", conversionResponse.Slug, conversionResponse.ID),
+		AppID:   conversionResponse.ID,
+		AppSlug: conversionResponse.Slug,
+	})
 
-	vars.WebhookSecret = conversionResponse.WebhookSecret
 	vars.AppID = strconv.Itoa(conversionResponse.ID)
 
-	tmp, err := ioutil.TempFile("", "")
-	if err != nil {
-		return fmt.Errorf("failed creating a temporary file: %v", err)
+	if err := storeAppSecrets(ctx, backend, vars, []byte(conversionResponse.PrivateKey), conversionResponse.WebhookSecret); err != nil {
+		return "", err
 	}
-	defer tmp.Close()
+	logInfof("Stored the App's private key and webhook secret in the %v secrets backend.", backend.Name())
 
-	if _, err := tmp.WriteString(conversionResponse.PrivateKey); err != nil {
-		return fmt.Errorf("error writing to tmpfile: %v", err)
-	}
-	if err := tmp.Close(); err != nil {
-		return fmt.Errorf("error closing private key file")
-	}
+	return conversionResponse.Slug, nil
+}
 
-	vars.PrivateKey = tmp.Name()
+// registerApp creates the GitHub App via the App registration URL parameters.
+// It needs no redirect endpoint, so works without gamf or a public URL, but
+// the user has to generate and download the private key themselves. It
+// returns the App's slug and the path of the downloaded key.
+func registerApp(ctx context.Context, vars *Vars, backend SecretsBackend, githubHost githubInstance, namePrefix string) (string, string, error) {
+	emit(event{
+		Type:    eventActionRequired,
+		Message: "Please continue to this URL to create a new GitHub Application for Actions Runner Controller, then generate a private key from the App settings page and download it",
+		URL:     buildRegistrationURL(githubHost, vars.Organization, namePrefix),
+		Input:   "prompt",
+	})
 
-	var appsURL string
-	if isGhes {
-		appsURL = baseURL + "/github-apps"
-	} else {
-		appsURL = baseURL + "/apps"
+	appID := &survey.Input{
+		Message: "Actions Runner Controller GitHub App ID:",
+	}
+	if err := ask(appID, &vars.AppID); err != nil {
+		return "", "", err
 	}
 
-	fmt.Printf("ℹ Please install the newly created GitHub App Installation ID onto %v here: %v/%v/installations/new/permissions?target_id=%v\n", vars.Organization, appsURL, conversionResponse.Slug, orgID)
-	fmt.Printf("ℹ After installation, you should be redirected to a URL that looks like this: %v/organizations/%v/settings/installations/{id}\n", baseURL, vars.Organization)
-	fmt.Printf("ℹ Please enter the {id} of the installation below.\n")
-	if err := ask(installationID, &vars.InstallationID); err != nil {
-		return err
+	appSlug := &survey.Input{
+		Message: "Actions Runner Controller GitHub App slug:",
+		Default: namePrefix,
+		Help:    "The last segment of the App's public page URL.",
+	}
+	var slug string
+	if err := ask(appSlug, &slug); err != nil {
+		return "", "", err
 	}
 
-	fmt.Printf("ℹ We need to tell Actions Runner Controller which Runner Group to create runners in...\n")
-	fmt.Printf("ℹ You can see and create new GitHub Actions Runner Groups here: %v/organizations/%v/settings/actions/runners\n", baseURL, vars.Organization)
-	if err := ask(runnerGroup, &vars.RunnerGroup); err != nil {
-		return err
+	privateKey := &survey.Input{
+		Message: "Path to the downloaded private key (.pem):",
+	}
+	var keyPath string
+	if err := ask(privateKey, &keyPath, survey.WithValidator(fileValidator())); err != nil {
+		return "", "", err
 	}
 
-	es, err := env.Marshal(&vars)
+	key, err := files.ReadFile(keyPath)
 	if err != nil {
-		return fmt.Errorf("error encoding to env: %\n", err)
+		return "", "", fmt.Errorf("failed to read private key: %w", err)
+	}
+	if _, err := parsePrivateKey(key); err != nil {
+		return "", "", authError(err, "Generate and download a new private key from the App's settings page.")
 	}
 
-	s := strings.Join(env.EnvSetToEnviron(es), "\n") + "\n"
-	if err := os.WriteFile(VarFileName, []byte(s), 0600); err != nil {
-		return fmt.Errorf("error writing %v: %w\n", VarFileName, err)
+	if err := storeAppSecrets(ctx, backend, vars, key, ""); err != nil {
+		return "", "", err
 	}
+	logInfof("Stored the App's private key in the %v secrets backend, you can now delete %v.", backend.Name(), keyPath)
 
-	return nil
+	if id, err := strconv.Atoi(vars.AppID); err == nil {
+		emit(event{Type: eventAppConverted, Message: fmt.Sprintf("App registered: %v (ID %v)", slug, id), AppID: id, AppSlug: slug})
+	}
+
+	return slug, keyPath, nil
 }
 
 func ask(p survey.Prompt, t interface{}, opts ...survey.AskOpt) error {
-	return handleSurveryErr(survey.AskOne(p, t, append(opts, survey.WithValidator(survey.Required))...))
+	return prompts.ask(p, t, opts...)
 }
 
 func handleSurveryErr(err error) error {
@@ -279,7 +679,7 @@ func handleSurveryErr(err error) error {
 	}
 
 	if errors.Is(err, terminal.InterruptErr) {
-		return fmt.Errorf("ctrl-c")
+		return fmt.Errorf("ctrl-c: %w", context.Canceled)
 	} else {
 		return err
 	}
@@ -300,7 +700,26 @@ func urlValidator() survey.Validator {
 	}
 }
 
-func buildGamfPayload(appName, org, ghHost, hookUrl string) gamfPayload {
+func fileValidator() survey.Validator {
+	return func(answer interface{}) error {
+		str, ok := answer.(string)
+		if !ok {
+			return fmt.Errorf("answer must be a string")
+		}
+
+		info, err := files.Stat(str)
+		if err != nil {
+			return fmt.Errorf("answer must be a readable file: %w", err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("answer must be a file, got a directory")
+		}
+
+		return nil
+	}
+}
+
+func buildGamfPayload(appName, org, ghHost, hookUrl string, caps capabilities) gamfPayload {
 	return gamfPayload{
 		TargetType: "org",
 		TargetSlug: org,
@@ -311,7 +730,7 @@ func buildGamfPayload(appName, org, ghHost, hookUrl string) gamfPayload {
 			Description:   "Autocreated Actions Runner Controller Application",
 			Public:        false,
 			CallbackURLs:  []string{},
-			DefaultEvents: []string{"workflow_job", "check_run"},
+			DefaultEvents: caps.appEvents(),
 			DefaultPermissions: map[string]string{
 				"organization_self_hosted_runners": "write",
 				"actions":                          "read",
@@ -325,6 +744,52 @@ func buildGamfPayload(appName, org, ghHost, hookUrl string) gamfPayload {
 	}
 }
 
+// warnRunnerGroup warns if the instance has no runner groups, or vars' runner
+// group does not exist in its organization, as runners will fail to register
+// until it is created. Failing to check is not fatal.
+func warnRunnerGroup(ctx context.Context, githubHost githubInstance, caps capabilities, vars Vars) {
+	if warnings := caps.runnerGroupWarnings(nil); len(warnings) > 0 {
+		for _, w := range warnings {
+			logWarnf("%v.", w)
+		}
+		return
+	}
+
+	group, err := func() (*runnerGroup, error) {
+		c, err := newRunnerGroupClient(ctx, githubHost, vars)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.group(vars.RunnerGroup)
+	}()
+	if err != nil {
+		logWarnf("Could not list the runner groups of %v: %v", vars.Organization, err)
+		return
+	}
+	if group != nil {
+		return
+	}
+
+	logWarnf("Runner group %q does not exist in %v, create it at %v before runners can register.", vars.RunnerGroup, vars.Organization, githubHost.RunnersURL(vars.Organization))
+}
+
+// codespacesURL is the public URL of port 80 in this codespace, which ingress
+// routes to gamf and the webhook server. ARC_PUBLIC_URL overrides it outside
+// of Codespaces.
+func codespacesURL() (string, error) {
+	if u := os.Getenv("ARC_PUBLIC_URL"); u != "" {
+		return strings.TrimSuffix(u, "/"), nil
+	}
+
+	codespaceName := os.Getenv("CODESPACE_NAME")
+	if codespaceName == "" {
+		return "", fmt.Errorf("CODESPACE_NAME is empty")
+	}
+
+	return fmt.Sprintf("https://%v-80.githubpreview.dev", codespaceName), nil
+}
+
 func randomName() (string, error) {
 	bytes := make([]byte, 8)
 	if _, err := rand.Read(bytes); err != nil {
@@ -334,17 +799,17 @@ func randomName() (string, error) {
 	return "arc-setup-" + hex.EncodeToString(bytes), nil
 }
 
-func loadHost() (string, error) {
-	b, err := ioutil.ReadFile(GitHubHostFile)
+func loadHost() (githubInstance, error) {
+	b, err := files.ReadFile(GitHubHostFile)
 	if err != nil {
-		return "", fmt.Errorf("failed to read file: %w", err)
+		return githubInstance{}, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	return strings.TrimPrefix(strings.TrimSpace(string(b)), "api."), nil
+	return parseGitHubHost(string(b))
 }
 
 func loadOrgs() (map[string]int, error) {
-	b, err := ioutil.ReadFile(GitHubOrgsFile)
+	b, err := files.ReadFile(GitHubOrgsFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
@@ -377,3 +842,127 @@ func loadOrgs() (map[string]int, error) {
 
 	return organizations, nil
 }
+
+func loadVars() (Vars, error) {
+	var vars Vars
+
+	b, err := files.ReadFile(VarFileName)
+	if err != nil {
+		return vars, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	es, err := unmarshalDotenv(b)
+	if err != nil {
+		return vars, fmt.Errorf("error parsing %v: %w", VarFileName, err)
+	}
+
+	if err := env.Unmarshal(es, &vars); err != nil {
+		return vars, fmt.Errorf("error decoding %v: %w", VarFileName, err)
+	}
+
+	return vars, nil
+}
+
+func saveVars(vars Vars) error {
+	es, err := env.Marshal(&vars)
+	if err != nil {
+		return fmt.Errorf("error encoding to env: %w", err)
+	}
+
+	b := marshalDotenv(es, "Written by arc-setup. Secrets are references into the secrets backend.")
+	if err := files.WriteFile(VarFileName, b, 0600); err != nil {
+		return fmt.Errorf("error writing %v: %w", VarFileName, err)
+	}
+	emit(event{Type: eventEnvWritten, Message: fmt.Sprintf("Wrote %v", VarFileName), Path: VarFileName})
+
+	return nil
+}
+
+// renderMain prints the template at args[0] rendered with arc.env, for the
+// scripts, so that they never source arc.env themselves.
+func renderMain(args []string) error {
+	if len(args) != 1 {
+		return usageError("usage: arc-setup render <file>")
+	}
+
+	vars, err := templateVars()
+	if err != nil {
+		return err
+	}
+
+	s, err := renderTemplate(args[0], vars)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Print(s)
+	return err
+}
+
+// renderTemplate substitutes ${VAR} references in the file at path like
+// envsubst does, taking values from vars and then the environment.
+// References which are not valid variable names, such as regex groups, are
+// left alone.
+func renderTemplate(path string, vars map[string]string) (string, error) {
+	b, err := files.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return os.Expand(string(b), func(name string) string {
+		if !envNameRe.MatchString(name) {
+			return "$" + name
+		}
+
+		if v, ok := vars[name]; ok {
+			return v
+		}
+
+		return os.Getenv(name)
+	}), nil
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// waitForInstallation polls until the App is installed on the organization,
+// for when nobody is at a prompt to type the installation ID in.
+func waitForInstallation(ctx context.Context, githubHost githubInstance, vars Vars) (string, error) {
+	const timeout = 15 * time.Minute
+
+	deadline := time.Now().Add(timeout)
+	for {
+		// App JWTs only last 10 minutes, so sign a new one each time.
+		client, err := newAppClient(ctx, githubHost, vars)
+		if err != nil {
+			return "", err
+		}
+
+		i, err := client.orgInstallation(ctx, vars.Organization)
+		if err != nil {
+			return "", err
+		}
+		if i != nil {
+			return strconv.FormatInt(i.ID, 10), nil
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("the App was not installed on %v within %v", vars.Organization, timeout)
+		}
+		if err := sleepContext(ctx, installationPollInterval); err != nil {
+			return "", err
+		}
+	}
+}
+
+// postContext is http.Post, cancelled with ctx.
+func postContext(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return httpClient.Do(req)
+}
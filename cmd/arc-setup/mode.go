@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2"
+)
+
+// modeMain records which Actions Runner Controller mode to install, so that
+// the scripts can decide whether they need ingress, gamf and a public port
+// before realMain runs.
+func modeMain(ctx context.Context, args []string) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	if state.Mode != "" {
+		logInfof("Actions Runner Controller mode is already known. (%v)", state.Mode)
+		return nil
+	}
+
+	return chooseMode(ctx, state)
+}
+
+// chooseMode picks the mode from ARC_MODE, or prompts for it, and saves it to
+// state.
+func chooseMode(ctx context.Context, state *State) error {
+	var answer string
+	if v := os.Getenv("ARC_MODE"); v != "" {
+		answer = v
+	} else {
+		mode := &survey.Select{
+			Message: "Which Actions Runner Controller mode should be installed?",
+			Help:    "legacy installs the summerwind chart with a webhook driven autoscaler, and needs a public URL. scale-set installs gha-runner-scale-set, which needs neither.",
+			Options: []string{string(ModeLegacy), string(ModeScaleSet)},
+			Default: string(ModeLegacy),
+		}
+		if err := ask(mode, &answer); err != nil {
+			return err
+		}
+	}
+
+	m, err := parseMode(answer)
+	if err != nil {
+		return err
+	}
+
+	// Only ctrl-c interrupts the prompt, so don't save an answer given after
+	// a SIGTERM.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	state.Mode = m
+
+	return state.save()
+}
+
+// scaleSetAppPermissions are the App permissions gha-runner-scale-set needs.
+// It subscribes to no events.
+var scaleSetAppPermissions = map[string]string{
+	"organization_self_hosted_runners": "write",
+}
+
+// buildRegistrationURL returns a URL which prefills the GitHub App creation
+// form for org with the permissions gha-runner-scale-set needs.
+func buildRegistrationURL(host githubInstance, org, appName string) string {
+	q := url.Values{}
+	q.Set("name", appName)
+	q.Set("description", "Autocreated Actions Runner Controller Application")
+	q.Set("url", "https://github.com/actions/actions-runner-controller")
+	q.Set("public", "false")
+	q.Set("webhook_active", "false")
+	for permission, access := range scaleSetAppPermissions {
+		q.Set(permission, access)
+	}
+
+	return host.NewAppURL(org, q)
+}
+
+// scaleSetNameRe matches a valid helm release name, which is also used as the
+// scale set's runs-on label.
+var scaleSetNameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+func splitScaleSets(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func scaleSetsValidator() survey.Validator {
+	return func(answer interface{}) error {
+		str, ok := answer.(string)
+		if !ok {
+			return fmt.Errorf("answer must be a string")
+		}
+
+		names := splitScaleSets(str)
+		if len(names) == 0 {
+			return fmt.Errorf("at least one scale set is required")
+		}
+
+		for _, name := range names {
+			if len(name) > 45 || !scaleSetNameRe.MatchString(name) {
+				return fmt.Errorf("%q must be lowercase alphanumeric or '-', and at most 45 characters", name)
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// step is a single node in the install pipeline.
+type step struct {
+	name string
+
+	// deps are the names of steps which must succeed before this one runs.
+	deps []string
+
+	// interactive steps prompt the user, so run with nothing else in
+	// flight, and write straight to stdout.
+	interactive bool
+
+	// retries is how many more times run is attempted after a failure.
+	retries int
+
+	// done checks live state, reporting whether run can be skipped.
+	done func() (bool, error)
+
+	run func(w io.Writer) error
+}
+
+type stepStatus string
+
+const (
+	stepRan      stepStatus = "ran"
+	stepUpToDate stepStatus = "up to date"
+	stepFailed   stepStatus = "failed"
+	stepSkipped  stepStatus = "skipped"
+)
+
+type stepResult struct {
+	name     string
+	status   stepStatus
+	attempts int
+	duration time.Duration
+	err      error
+}
+
+// retryBackoff is the delay before the first retry of a failed step, doubling
+// with every attempt after.
+var retryBackoff = 2 * time.Second
+
+// runPipeline runs steps in dependency order, running steps in parallel once
+// their dependencies have succeeded. Results are returned in the order steps
+// were given, along with the first failure. Once ctx is done no more steps
+// start or retry, and the steps left are skipped.
+func runPipeline(ctx context.Context, steps []step) ([]stepResult, error) {
+	if err := validatePipeline(steps); err != nil {
+		return nil, err
+	}
+
+	var (
+		// interactive steps take the write lock, so never overlap another
+		// step's output.
+		exclusive sync.RWMutex
+
+		mu       sync.Mutex
+		results  = map[string]*stepResult{}
+		finished = map[string]chan struct{}{}
+		wg       sync.WaitGroup
+	)
+
+	for _, s := range steps {
+		finished[s.name] = make(chan struct{})
+	}
+
+	for _, s := range steps {
+		s := s
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(finished[s.name])
+
+			result := &stepResult{name: s.name}
+			defer func() {
+				mu.Lock()
+				results[s.name] = result
+				mu.Unlock()
+			}()
+
+			for _, dep := range s.deps {
+				<-finished[dep]
+
+				mu.Lock()
+				depStatus := results[dep].status
+				mu.Unlock()
+
+				if depStatus == stepFailed || depStatus == stepSkipped {
+					result.status = stepSkipped
+					result.err = fmt.Errorf("dependency %v did not complete", dep)
+					return
+				}
+			}
+
+			if s.interactive {
+				exclusive.Lock()
+				defer exclusive.Unlock()
+			} else {
+				exclusive.RLock()
+				defer exclusive.RUnlock()
+			}
+
+			if err := ctx.Err(); err != nil {
+				result.status = stepSkipped
+				result.err = err
+				return
+			}
+
+			runStep(ctx, s, result)
+		}()
+	}
+
+	wg.Wait()
+
+	ordered := make([]stepResult, 0, len(steps))
+	var firstErr error
+	for _, s := range steps {
+		r := results[s.name]
+		if r.status == stepFailed && firstErr == nil {
+			firstErr = fmt.Errorf("step %v failed: %w", r.name, r.err)
+		}
+
+		ordered = append(ordered, *r)
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+
+	return ordered, firstErr
+}
+
+func runStep(ctx context.Context, s step, result *stepResult) {
+	start := time.Now()
+	defer func() { result.duration = time.Since(start) }()
+
+	emit(event{Type: eventStepStarted, Step: s.name})
+	defer func() {
+		e := event{
+			Type:     eventStepFinished,
+			Step:     s.name,
+			Status:   string(result.status),
+			Attempts: result.attempts,
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+		}
+		if result.err != nil {
+			e.Error = result.err.Error()
+		}
+		if output == outputNDJSON {
+			emit(e)
+		}
+	}()
+
+	var w io.Writer = humanOutput()
+	if !s.interactive {
+		pw := &prefixWriter{prefix: "[" + s.name + "] ", w: humanOutput()}
+		defer pw.Flush()
+
+		w = pw
+	}
+
+	if s.done != nil {
+		done, err := s.done()
+		if err != nil {
+			result.status = stepFailed
+			result.err = err
+			return
+		}
+		if done {
+			fmt.Fprintf(w, "ℹ %v is up to date.\n", s.name)
+			result.status = stepUpToDate
+			return
+		}
+	}
+
+	backoff := retryBackoff
+	for {
+		result.attempts++
+		err := s.run(w)
+		if err == nil {
+			result.status = stepRan
+			return
+		}
+
+		if result.attempts > s.retries || ctx.Err() != nil {
+			result.status = stepFailed
+			result.err = err
+			return
+		}
+
+		fmt.Fprintf(w, "%v failed (attempt %v of %v), retrying in %v: %v\n", s.name, result.attempts, s.retries+1, backoff, err)
+		if err := sleepContext(ctx, backoff); err != nil {
+			result.status = stepFailed
+			result.err = err
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// validatePipeline checks that every dependency exists and that there are no
+// cycles, which would otherwise deadlock runPipeline.
+func validatePipeline(steps []step) error {
+	byName := map[string]step{}
+	for _, s := range steps {
+		if _, ok := byName[s.name]; ok {
+			return fmt.Errorf("duplicate step %v", s.name)
+		}
+		byName[s.name] = s
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := map[string]int{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle through step %v", name)
+		case visited:
+			return nil
+		}
+
+		marks[name] = visiting
+		for _, dep := range byName[name].deps {
+			if _, ok := byName[dep]; !ok {
+				return fmt.Errorf("step %v depends on unknown step %v", name, dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+
+		return nil
+	}
+
+	for _, s := range steps {
+		if err := visit(s.name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printStepSummary(w io.Writer, results []stepResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "STEP\tSTATUS\tATTEMPTS\tDURATION\n")
+
+	var total time.Duration
+	for _, r := range results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", r.name, r.status, r.attempts, r.duration.Round(time.Millisecond))
+		total += r.duration
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "Total step time: %v\n", total.Round(time.Millisecond))
+}
+
+// stdoutMu serialises prefixWriter lines from parallel steps.
+var stdoutMu sync.Mutex
+
+// prefixWriter prefixes every complete line written to it, so that output
+// from parallel steps can be told apart.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	buf    bytes.Buffer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf.Write(b)
+
+	for {
+		i := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+
+		line := p.buf.Next(i + 1)
+		stdoutMu.Lock()
+		_, err := fmt.Fprintf(p.w, "%v%s", p.prefix, line)
+		stdoutMu.Unlock()
+		if err != nil {
+			return len(b), err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Flush writes any trailing partial line.
+func (p *prefixWriter) Flush() {
+	if p.buf.Len() == 0 {
+		return
+	}
+
+	stdoutMu.Lock()
+	fmt.Fprintf(p.w, "%v%s\n", p.prefix, p.buf.Bytes())
+	stdoutMu.Unlock()
+	p.buf.Reset()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stepRecorder records when fake steps start and finish.
+type stepRecorder struct {
+	mu     sync.Mutex
+	events []string
+	times  map[string][]time.Time
+}
+
+func (r *stepRecorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, event)
+	if r.times == nil {
+		r.times = map[string][]time.Time{}
+	}
+	r.times[event] = append(r.times[event], time.Now())
+}
+
+func (r *stepRecorder) index(event string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, e := range r.events {
+		if e == event {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// fakeStep is a step which fails its first failures attempts.
+type fakeStep struct {
+	name     string
+	deps     []string
+	retries  int
+	failures int
+	upToDate bool
+}
+
+func (f fakeStep) step(r *stepRecorder) step {
+	attempts := 0
+
+	return step{
+		name:    f.name,
+		deps:    f.deps,
+		retries: f.retries,
+		done: func() (bool, error) {
+			if f.upToDate {
+				r.record("end " + f.name)
+			}
+			return f.upToDate, nil
+		},
+		run: func(w io.Writer) error {
+			r.record("start " + f.name)
+			defer r.record("end " + f.name)
+
+			attempts++
+			if attempts <= f.failures {
+				return fmt.Errorf("%v attempt %v failed", f.name, attempts)
+			}
+
+			return nil
+		},
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	saved := retryBackoff
+	retryBackoff = time.Millisecond
+	defer func() { retryBackoff = saved }()
+
+	type want struct {
+		status   stepStatus
+		attempts int
+	}
+
+	cases := []struct {
+		name    string
+		steps   []fakeStep
+		want    []want
+		wantErr string
+	}{
+		{
+			name: "diamond",
+			steps: []fakeStep{
+				{name: "deploy", deps: []string{"left", "right"}},
+				{name: "left", deps: []string{"cluster"}},
+				{name: "right", deps: []string{"cluster"}},
+				{name: "cluster"},
+			},
+			want: []want{{stepRan, 1}, {stepRan, 1}, {stepRan, 1}, {stepRan, 1}},
+		},
+		{
+			name: "retried until it succeeds",
+			steps: []fakeStep{
+				{name: "flaky", retries: 2, failures: 2},
+				{name: "after", deps: []string{"flaky"}},
+			},
+			want: []want{{stepRan, 3}, {stepRan, 1}},
+		},
+		{
+			name: "retries exhausted",
+			steps: []fakeStep{
+				{name: "broken", retries: 1, failures: 5},
+				{name: "child", deps: []string{"broken"}},
+				{name: "grandchild", deps: []string{"child"}},
+				{name: "unrelated"},
+			},
+			want:    []want{{stepFailed, 2}, {stepSkipped, 0}, {stepSkipped, 0}, {stepRan, 1}},
+			wantErr: "step broken failed: broken attempt 2 failed",
+		},
+		{
+			name: "up to date",
+			steps: []fakeStep{
+				{name: "cluster", upToDate: true},
+				{name: "install", deps: []string{"cluster"}},
+			},
+			want: []want{{stepUpToDate, 0}, {stepRan, 1}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := &stepRecorder{}
+			var steps []step
+			for _, s := range c.steps {
+				steps = append(steps, s.step(r))
+			}
+
+			results, err := runPipeline(context.Background(), steps)
+			if c.wantErr == "" && err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if c.wantErr != "" && (err == nil || err.Error() != c.wantErr) {
+				t.Fatalf("got error %v, want %v", err, c.wantErr)
+			}
+
+			for i, s := range c.steps {
+				if results[i].name != s.name {
+					t.Errorf("result %v is %v, want %v", i, results[i].name, s.name)
+				}
+				if got := (want{results[i].status, results[i].attempts}); got != c.want[i] {
+					t.Errorf("%v: got %v after %v attempts, want %v after %v", s.name, got.status, got.attempts, c.want[i].status, c.want[i].attempts)
+				}
+
+				if results[i].status != stepRan {
+					continue
+				}
+				start := r.index("start " + s.name)
+				for _, dep := range s.deps {
+					if end := r.index("end " + dep); end < 0 || end > start {
+						t.Errorf("%v started before its dependency %v finished: %v", s.name, dep, r.events)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRunPipelineParallel(t *testing.T) {
+	// Each step waits for the other to start, so they only both finish if
+	// they run at the same time.
+	started := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	other := map[string]string{"a": "b", "b": "a"}
+
+	var steps []step
+	for _, name := range []string{"a", "b"} {
+		name := name
+		steps = append(steps, step{
+			name: name,
+			run: func(w io.Writer) error {
+				close(started[name])
+				select {
+				case <-started[other[name]]:
+					return nil
+				case <-time.After(5 * time.Second):
+					return errors.New("ran alone")
+				}
+			},
+		})
+	}
+
+	if _, err := runPipeline(context.Background(), steps); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunPipelineInteractive(t *testing.T) {
+	r := &stepRecorder{}
+	steps := []step{
+		fakeStep{name: "background"}.step(r),
+		fakeStep{name: "prompt"}.step(r),
+	}
+	steps[1].interactive = true
+
+	// The background step runs long enough for the prompt to start part way
+	// through, if they could overlap.
+	steps[0].run = func(w io.Writer) error {
+		r.record("start background")
+		time.Sleep(20 * time.Millisecond)
+		r.record("end background")
+		return nil
+	}
+
+	if _, err := runPipeline(context.Background(), steps); err != nil {
+		t.Fatal(err)
+	}
+
+	events := strings.Join(r.events, ",")
+	if events != "start background,end background,start prompt,end prompt" && events != "start prompt,end prompt,start background,end background" {
+		t.Errorf("interactive step overlapped another: %v", events)
+	}
+}
+
+func TestRunPipelineBackoff(t *testing.T) {
+	saved := retryBackoff
+	retryBackoff = 20 * time.Millisecond
+	defer func() { retryBackoff = saved }()
+
+	r := &stepRecorder{}
+	results, err := runPipeline(context.Background(), []step{fakeStep{name: "flaky", retries: 2, failures: 2}.step(r)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].attempts != 3 {
+		t.Fatalf("got %v attempts, want 3", results[0].attempts)
+	}
+
+	starts := r.times["start flaky"]
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if gap := starts[i+1].Sub(starts[i]); gap < want {
+			t.Errorf("retry %v came after %v, want at least %v", i+1, gap, want)
+		}
+	}
+}
+
+func TestValidatePipeline(t *testing.T) {
+	cases := []struct {
+		name    string
+		steps   []step
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			steps: []step{{name: "a"}, {name: "b", deps: []string{"a"}}, {name: "c", deps: []string{"a", "b"}}},
+		},
+		{
+			name:    "duplicate",
+			steps:   []step{{name: "a"}, {name: "a"}},
+			wantErr: "duplicate step a",
+		},
+		{
+			name:    "unknown dependency",
+			steps:   []step{{name: "a", deps: []string{"missing"}}},
+			wantErr: "step a depends on unknown step missing",
+		},
+		{
+			name:    "cycle",
+			steps:   []step{{name: "a", deps: []string{"c"}}, {name: "b", deps: []string{"a"}}, {name: "c", deps: []string{"b"}}},
+			wantErr: "dependency cycle through step a",
+		},
+		{
+			name:    "self dependency",
+			steps:   []step{{name: "a", deps: []string{"a"}}},
+			wantErr: "dependency cycle through step a",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validatePipeline(c.steps)
+			if c.wantErr == "" && err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if c.wantErr != "" && (err == nil || err.Error() != c.wantErr) {
+				t.Fatalf("got error %v, want %v", err, c.wantErr)
+			}
+
+			// runPipeline must refuse invalid pipelines rather than
+			// deadlocking on them.
+			if c.wantErr != "" {
+				if _, err := runPipeline(context.Background(), c.steps); err == nil {
+					t.Error("runPipeline ran an invalid pipeline")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2"
+	env "github.com/Netflix/go-env"
+	"gopkg.in/yaml.v3"
+)
+
+// dryRun is set by --dry-run, and makes setup and up print a plan of what
+// they would do instead of doing it.
+var dryRun bool
+
+// planScheme is the ref scheme of secrets a plan would have stored. They
+// resolve to a placeholder, so values containing them can be printed.
+const planScheme = "plan"
+
+func planRef(key string) string { return planScheme + ":#" + key }
+
+// planMain prints what setup, and up when provider is set, would do. It only
+// reads: settings come from data/ and the environment, falling back to
+// defaults, and the App's IDs are placeholders.
+func planMain(ctx context.Context, w io.Writer, provider ClusterProvider) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	mode := state.Mode
+	if mode == "" {
+		mode = ModeLegacy
+		if v := os.Getenv("ARC_MODE"); v != "" {
+			if mode, err = parseMode(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	githubHost, err := loadHost()
+	if err != nil {
+		githubHost, err = parseGitHubHost(GitHubDotcomHost)
+		if err != nil {
+			return err
+		}
+		logWarnf("%v is missing, planning against %v.", GitHubHostFile, githubHost)
+	}
+
+	caps, err := detectCapabilities(ctx, githubHost)
+	if err != nil {
+		return err
+	}
+	if err := caps.checkMode(mode); err != nil {
+		return err
+	}
+
+	backendName := state.SecretsBackend
+	if backendName == "" {
+		backendName = os.Getenv("ARC_SECRETS_BACKEND")
+	}
+	if backendName == "" {
+		backendName = "file"
+	}
+	backend, err := secretsBackend(backendName, secretsNamespace(mode))
+	if err != nil {
+		return err
+	}
+
+	var vars Vars
+	if _, err := env.UnmarshalFromEnviron(&vars); err != nil {
+		return fmt.Errorf("error reading settings from the environment: %w", err)
+	}
+
+	orgID := 0
+	if orgs, err := loadOrgs(); err == nil {
+		orgID = orgs[vars.Organization]
+		if vars.Organization == "" {
+			names := make([]string, 0, len(orgs))
+			for name := range orgs {
+				names = append(names, name)
+			}
+
+			prompt := &survey.Select{
+				Message: "Which GitHub Org should the plan be for?",
+				Options: names,
+			}
+			if err := ask(prompt, &vars.Organization); err != nil {
+				return err
+			}
+			orgID = orgs[vars.Organization]
+		}
+	}
+	if vars.Organization == "" {
+		return fmt.Errorf("set ARC_GITHUB_APP_ORGANIZATION to plan without %v", GitHubOrgsFile)
+	}
+
+	namePrefix, err := randomName()
+	if err != nil {
+		return err
+	}
+
+	vars.EnterpriseURL = githubHost.EnterpriseURL()
+	vars.ConfigURL = githubHost.OrgURL(vars.Organization)
+	if vars.AppID == "" {
+		vars.AppID = "<app-id>"
+	}
+	if vars.InstallationID == "" {
+		vars.InstallationID = "<installation-id>"
+	}
+	if vars.RunnerGroup == "" {
+		vars.RunnerGroup = "Default"
+	}
+	if mode == ModeScaleSet && vars.ScaleSets == "" {
+		vars.ScaleSets = "arc-runner-set"
+	}
+	vars.PrivateKey, vars.WebhookSecret = "", ""
+	vars.PrivateKeyRef = backend.Ref(secretPrivateKey)
+	if mode.NeedsWebhook() {
+		vars.WebhookSecretRef = backend.Ref(secretWebhookSecret)
+	}
+
+	section(w, "Plan")
+	fmt.Fprintf(w, "mode:            %v\n", mode)
+	fmt.Fprintf(w, "github:          %v\n", githubHost)
+	if caps.Version != "" {
+		fmt.Fprintf(w, "ghes version:    %v\n", caps.Version)
+	}
+	fmt.Fprintf(w, "organization:    %v\n", vars.Organization)
+	fmt.Fprintf(w, "secrets backend: %v\n", backend.Name())
+	if provider != nil {
+		fmt.Fprintf(w, "cluster:         %v\n", provider.Name())
+	}
+
+	hookURL, err := codespacesURL()
+	if err != nil {
+		hookURL = "https://${CODESPACE_NAME}-80.githubpreview.dev"
+	}
+	gamfHost := hookURL + "/gamf"
+
+	section(w, "Requests")
+	if mode.NeedsWebhook() {
+		payload, err := json.MarshalIndent(buildGamfPayload(namePrefix, vars.Organization, githubHost.Name(), hookURL+"/webhook", caps), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode gamf payload: %w", err)
+		}
+
+		fmt.Fprintf(w, "POST %v/start\n%s\n", gamfHost, payload)
+		fmt.Fprintf(w, "POST %v/code/{key}\n", gamfHost)
+		fmt.Fprintf(w, "POST %v\n", strings.NewReplacer("%7B", "{", "%7D", "}").Replace(githubHost.ManifestConversionURL("{code}")))
+	} else {
+		fmt.Fprintf(w, "(none: the App is registered in the browser at %v)\n", buildRegistrationURL(githubHost, vars.Organization, namePrefix))
+	}
+	fmt.Fprintf(w, "GET %v/orgs/%v/actions/runner-groups\n", githubHost.APIURL(), vars.Organization)
+	policy, err := vars.runnerGroupPolicy()
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		fmt.Fprintf(w, "PATCH %v/orgs/%v/actions/runner-groups/{id}\n", githubHost.APIURL(), vars.Organization)
+		if policy.Visibility == "selected" {
+			fmt.Fprintf(w, "PUT %v/orgs/%v/actions/runner-groups/{id}/repositories\n", githubHost.APIURL(), vars.Organization)
+		}
+	}
+
+	section(w, "Secrets")
+	fmt.Fprintf(w, "%v -> %v\n", secretPrivateKey, vars.PrivateKeyRef)
+	if mode.NeedsWebhook() {
+		fmt.Fprintf(w, "%v -> %v\n", secretWebhookSecret, vars.WebhookSecretRef)
+	}
+	fmt.Fprintf(w, "%v -> %v\n", secretAppID, backend.Ref(secretAppID))
+	fmt.Fprintf(w, "%v -> %v\n", secretInstallationID, backend.Ref(secretInstallationID))
+
+	section(w, "Install URL")
+	fmt.Fprintf(w, "%v\n", githubHost.AppInstallURL(namePrefix, orgID))
+
+	es, err := env.Marshal(&vars)
+	if err != nil {
+		return fmt.Errorf("error encoding to env: %w", err)
+	}
+
+	section(w, VarFileName)
+	fmt.Fprintf(w, "%s", redact(string(marshalDotenv(es, "Written by arc-setup. Secrets are references into the secrets backend."))))
+
+	// The plan has no secrets to put in values, so point at placeholders.
+	masked := vars
+	if !masked.inClusterSecrets() {
+		masked.PrivateKeyRef = planRef(secretPrivateKey)
+		if masked.WebhookSecretRef != "" {
+			masked.WebhookSecretRef = planRef(secretWebhookSecret)
+		}
+	}
+
+	releases, err := desiredReleases(ctx, &State{Mode: mode}, masked)
+	if err != nil {
+		return err
+	}
+	for _, r := range releases {
+		values, err := planYAML(r.Values)
+		if err != nil {
+			return fmt.Errorf("error encoding %v values: %w", r.Name, err)
+		}
+
+		section(w, "helm release "+r.Namespace+"/"+r.Name)
+		fmt.Fprintf(w, "$ helm %v\n", strings.Join(r.installArgs("values.json"), " "))
+		fmt.Fprintf(w, "# values.json\n%s", values)
+	}
+
+	if mode.NeedsWebhook() {
+		templateVars := map[string]string{}
+		for k, v := range es {
+			templateVars[k] = v
+		}
+
+		for _, path := range []string{"data/gamf.yml", "data/arc.yml"} {
+			objs, err := renderManifestsWith(path, templateVars, caps)
+			if err != nil {
+				return err
+			}
+
+			section(w, path)
+			for i, obj := range objs {
+				b, err := marshalYAML(obj)
+				if err != nil {
+					return err
+				}
+				if i > 0 {
+					fmt.Fprintf(w, "---\n")
+				}
+				fmt.Fprintf(w, "%s", redact(string(b)))
+			}
+		}
+	}
+
+	return nil
+}
+
+func section(w io.Writer, title string) {
+	fmt.Fprintf(w, "\n== %v\n", title)
+}
+
+// planYAML encodes helm values as YAML, via their JSON field names.
+func planYAML(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+
+	return marshalYAML(generic)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestPlanDryRun(t *testing.T) {
+	f := newFakeGitHub(t)
+	mem, _ := setupFake(t, f, ModeLegacy)
+	for _, path := range []string{"data/gamf.yml", "data/arc.yml"} {
+		b, err := os.ReadFile("../../" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mem.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Secrets in the environment must not reach the plan.
+	t.Setenv("ARC_GITHUB_APP_ORGANIZATION", f.Org)
+	t.Setenv("ARC_GITHUB_APP_WEBHOOK_SECRET", "hunter2")
+	t.Setenv("ARC_GITHUB_APP_PEM_FILE_PATH", string(f.PEM()))
+
+	before := snapshotFiles(mem)
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := planMain(context.Background(), &out, nil); err != nil {
+		t.Fatal(err)
+	}
+	plan := out.String()
+
+	if after := snapshotFiles(mem); !reflect.DeepEqual(after, before) {
+		t.Errorf("the plan wrote to the filesystem:\nbefore %v\nafter  %v", before, after)
+	}
+	if got, err := loadState(); err != nil || !reflect.DeepEqual(got, state) {
+		t.Errorf("got state %+v (error %v) after planning, want %+v", got, err, state)
+	}
+	for _, r := range f.Requests() {
+		if !strings.HasPrefix(r, "GET ") {
+			t.Errorf("the plan made a %v request", r)
+		}
+	}
+
+	// The manifest printed is the one setup would send to gamf.
+	_, rest, ok := cut(plan, "POST "+f.URL+"/gamf/start\n")
+	if !ok {
+		t.Fatalf("plan has no gamf request:\n%v", plan)
+	}
+	printed, _, _ := cut(rest, "\nPOST ")
+	var payload gamfPayload
+	if err := json.Unmarshal([]byte(printed), &payload); err != nil {
+		t.Fatalf("decoding the printed payload %v: %v", printed, err)
+	}
+	githubHost, err := loadHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps, err := detectCapabilities(context.Background(), githubHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.MarshalIndent(buildGamfPayload(payload.Manifest.Name, f.Org, githubHost.Name(), f.URL+"/webhook", caps), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printed != string(want) {
+		t.Errorf("got payload\n%v\nwant\n%s", printed, want)
+	}
+
+	_, env, ok := cut(plan, "== "+VarFileName+"\n")
+	if !ok {
+		t.Fatalf("plan has no %v:\n%v", VarFileName, plan)
+	}
+	env, _, _ = cut(env, "\n== ")
+	for _, line := range []string{
+		`ARC_GITHUB_APP_PEM_FILE_PATH=""`,
+		`ARC_GITHUB_APP_WEBHOOK_SECRET=""`,
+		`ARC_GITHUB_APP_PRIVATE_KEY_REF="file:` + SecretsFileName + "#" + secretPrivateKey + `"`,
+		`ARC_GITHUB_APP_WEBHOOK_SECRET_REF="file:` + SecretsFileName + "#" + secretWebhookSecret + `"`,
+	} {
+		if !strings.Contains(env, line) {
+			t.Errorf("%v does not contain %v:\n%v", VarFileName, line, env)
+		}
+	}
+	for _, secret := range []string{"hunter2", "PRIVATE KEY"} {
+		if strings.Contains(plan, secret) {
+			t.Errorf("plan contains %q:\n%v", secret, plan)
+		}
+	}
+}
+
+// snapshotFiles copies what is in mem, to compare with later.
+func snapshotFiles(mem *memFileSystem) map[string]string {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	snapshot := map[string]string{}
+	for name, file := range fstest.MapFS(mem.files) {
+		snapshot[name] = string(file.Data)
+	}
+
+	return snapshot
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/AlecAivazis/survey/v2"
+)
+
+// prompter asks the user for input. Tests replace it with scripted answers.
+type prompter interface {
+	// ask asks p, storing the answer in t, as survey.AskOne does.
+	ask(p survey.Prompt, t interface{}, opts ...survey.AskOpt) error
+
+	// waitForEnter blocks until the user presses enter or ctx is done.
+	waitForEnter(ctx context.Context) error
+}
+
+// prompts is the prompter in use.
+var prompts prompter = surveyPrompter{}
+
+// surveyPrompter prompts on the terminal.
+type surveyPrompter struct{}
+
+func (surveyPrompter) ask(p survey.Prompt, t interface{}, opts ...survey.AskOpt) error {
+	if output == outputNDJSON {
+		// Keep stdout for events.
+		opts = append(opts, survey.WithStdio(os.Stdin, os.Stderr, os.Stderr))
+	}
+
+	return handleSurveryErr(survey.AskOne(p, t, append(opts, survey.WithValidator(survey.Required))...))
+}
+
+func (surveyPrompter) waitForEnter(ctx context.Context) error {
+	// Reading stdin can't be interrupted, so a cancelled wait leaves the read
+	// behind. Nothing is created before the first wait, so arc-setup exits
+	// rather than prompting again.
+	read := make(chan error, 1)
+	go func() {
+		input := bufio.NewScanner(os.Stdin)
+		if !input.Scan() {
+			if err := input.Err(); err != nil {
+				read <- fmt.Errorf("error reading stdin: %w", err)
+				return
+			}
+		}
+		read <- nil
+	}()
+
+	select {
+	case err := <-read:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
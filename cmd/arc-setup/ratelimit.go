@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// rateBudget is what GitHub's X-RateLimit headers last said was left of a
+// credential's request budget.
+type rateBudget struct {
+	Resource  string
+	Limit     int
+	Remaining int
+	Used      int
+	Reset     time.Time
+}
+
+// rateLimiter tracks the budget of every credential arc-setup has used, so
+// that once one is spent requests pause until it resets rather than fail.
+type rateLimiter struct {
+	mu      sync.Mutex
+	budgets map[string]rateBudget
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{budgets: map[string]rateBudget{}}
+}
+
+// githubLimits is shared by every GitHub API request.
+var githubLimits = newRateLimiter()
+
+// credentialKey identifies the budget a request to host with token draws on.
+// Every JWT an App signs shares its budget, so they are keyed by App ID, and
+// other tokens by a hash, so they aren't kept in memory any longer than
+// needed.
+func credentialKey(host, token string) string {
+	if token == "" {
+		return host + " anonymous"
+	}
+
+	if parts := strings.Split(token, "."); len(parts) == 3 {
+		var claims struct {
+			Issuer interface{} `json:"iss"`
+		}
+		if b, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil && json.Unmarshal(b, &claims) == nil && claims.Issuer != nil {
+			return fmt.Sprintf("%v app %v", host, claims.Issuer)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(token))
+
+	return host + " token " + hex.EncodeToString(sum[:8])
+}
+
+// update records the budget from a response's headers. Responses without
+// them, e.g. from GHES with rate limiting disabled, leave it untracked.
+func (l *rateLimiter) update(key string, h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	b := rateBudget{Resource: h.Get("X-RateLimit-Resource"), Remaining: remaining}
+	b.Limit, _ = strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	b.Used, _ = strconv.Atoi(h.Get("X-RateLimit-Used"))
+	if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		b.Reset = time.Unix(reset, 0)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.budgets[key] = b
+}
+
+func (l *rateLimiter) budget(key string) (rateBudget, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.budgets[key]
+
+	return b, ok
+}
+
+// wait pauses until key's budget resets if it has been spent, returning early
+// with ctx's error if it is done.
+func (l *rateLimiter) wait(ctx context.Context, key string) error {
+	b, ok := l.budget(key)
+	if !ok || b.Remaining > 0 {
+		return nil
+	}
+
+	d := time.Until(b.Reset)
+	if d <= 0 {
+		return nil
+	}
+
+	logWarnf("GitHub API rate limit used up (%v of %v %v requests), pausing until %v...", b.Used, b.Limit, b.resource(), b.Reset.Local().Format(time.Kitchen))
+	if err := sleepContext(ctx, d); err != nil {
+		return err
+	}
+	logInfof("GitHub API rate limit reset, resuming.")
+
+	return nil
+}
+
+func (b rateBudget) resource() string {
+	if b.Resource == "" {
+		return "core"
+	}
+
+	return b.Resource
+}
+
+// etagCache keeps the last response to GET requests which had an ETag, so
+// that polling can ask GitHub only for what has changed. A 304 Not Modified
+// doesn't count against the rate limit.
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	etag string
+	body []byte
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{entries: map[string]cachedResponse{}}
+}
+
+// githubETags is shared by every GitHub API request.
+var githubETags = newETagCache()
+
+func (c *etagCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.entries[key]
+
+	return r, ok
+}
+
+func (c *etagCache) put(key, etag string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = cachedResponse{etag: etag, body: body}
+}
+
+// userToken returns the token gh is logged in to githubHost with.
+var userToken = func(ctx context.Context, githubHost githubInstance) (string, error) {
+	return ghOutput(ctx, "auth", "token", "--hostname", githubHost.Name())
+}
+
+// credentialBudget is a row of `arc-setup ratelimit`.
+type credentialBudget struct {
+	Credential string
+	Budget     rateBudget
+	Tracked    bool
+	Err        error
+}
+
+func ratelimitMain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("ratelimit", flag.ContinueOnError)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	githubHost, err := loadHost()
+	if err != nil {
+		return err
+	}
+
+	budgets := credentialBudgets(ctx, githubHost)
+	printRateLimits(os.Stdout, budgets)
+
+	for _, b := range budgets {
+		if b.Err != nil {
+			return fmt.Errorf("could not check the budget of every credential")
+		}
+	}
+
+	return nil
+}
+
+// credentialBudgets asks GitHub for the budget of the user's gh token, the
+// App's JWT and its installation token. /rate_limit is free, but the JWT is
+// checked with GET /app, which costs one request, and minting an installation
+// token when none is cached costs another.
+func credentialBudgets(ctx context.Context, githubHost githubInstance) []credentialBudget {
+	apiURL := githubHost.APIURL()
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return []credentialBudget{{Credential: "user token", Err: err}}
+	}
+
+	check := func(name, path, token string) credentialBudget {
+		err := githubRequest(ctx, http.MethodGet, apiURL+path, token, nil, nil)
+		var gerr *githubError
+		if errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound && path == "/rate_limit" {
+			// GHES with rate limiting disabled.
+			return credentialBudget{Credential: name}
+		}
+		if err != nil {
+			return credentialBudget{Credential: name, Err: err}
+		}
+
+		b, ok := githubLimits.budget(credentialKey(u.Host, token))
+
+		return credentialBudget{Credential: name, Budget: b, Tracked: ok}
+	}
+
+	var budgets []credentialBudget
+
+	if token, err := userToken(ctx, githubHost); err != nil {
+		budgets = append(budgets, credentialBudget{Credential: "user token", Err: err})
+	} else {
+		budgets = append(budgets, check("user token", "/rate_limit", token))
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		return append(budgets,
+			credentialBudget{Credential: "App JWT", Err: err},
+			credentialBudget{Credential: "installation token", Err: err},
+		)
+	}
+
+	client, err := newAppClient(ctx, githubHost, vars)
+	if err != nil {
+		return append(budgets,
+			credentialBudget{Credential: "App JWT", Err: err},
+			credentialBudget{Credential: "installation token", Err: err},
+		)
+	}
+	// /rate_limit doesn't accept a JWT, but every /app response says what is
+	// left.
+	budgets = append(budgets, check("App JWT", "/app", client.jwt))
+
+	token, err := cachedInstallationToken(ctx, githubHost, vars, tokenScope{})
+	if err != nil {
+		return append(budgets, credentialBudget{Credential: "installation token", Err: err})
+	}
+
+	return append(budgets, check("installation token", "/rate_limit", token.Token))
+}
+
+func printRateLimits(w io.Writer, budgets []credentialBudget) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "CREDENTIAL\tRESOURCE\tREMAINING\tUSED\tLIMIT\tRESETS\n")
+
+	for _, b := range budgets {
+		switch {
+		case b.Err != nil:
+			fmt.Fprintf(tw, "%v\t-\t-\t-\t-\t%v\n", b.Credential, b.Err)
+		case !b.Tracked:
+			fmt.Fprintf(tw, "%v\t-\t-\t-\t-\trate limiting is disabled\n", b.Credential)
+		default:
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", b.Credential, b.Budget.resource(), b.Budget.Remaining, b.Budget.Used, b.Budget.Limit, b.Budget.Reset.Local().Format(time.Kitchen))
+		}
+	}
+
+	tw.Flush()
+}
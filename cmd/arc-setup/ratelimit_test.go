@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	saved := log.w
+	log.w = io.Discard
+	defer func() { log.w = saved }()
+
+	l := newRateLimiter()
+	l.update("spent", http.Header{
+		"X-Ratelimit-Remaining": {"0"},
+		"X-Ratelimit-Reset":     {strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)},
+	})
+	l.update("left", http.Header{"X-Ratelimit-Remaining": {"10"}})
+
+	if err := l.wait(context.Background(), "left"); err != nil {
+		t.Errorf("waited with budget left: %v", err)
+	}
+	if err := l.wait(context.Background(), "untracked"); err != nil {
+		t.Errorf("waited on an untracked budget: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, "spent"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want to wait until the deadline", err)
+	}
+
+	l.budgets["soon"] = rateBudget{Reset: time.Now().Add(20 * time.Millisecond)}
+	start := time.Now()
+	if err := l.wait(context.Background(), "soon"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("resumed after %v, before the reset", elapsed)
+	}
+}
+
+func TestCredentialKey(t *testing.T) {
+	f := newFakeGitHub(t)
+
+	first, err := signJWT("42", f.Key, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := signJWT("42", f.Key, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("JWTs are the same")
+	}
+
+	if credentialKey("github.com", first) != credentialKey("github.com", second) {
+		t.Error("JWTs of the same App have different budgets")
+	}
+	if credentialKey("github.com", "ghs_a") == credentialKey("github.com", "ghs_b") {
+		t.Error("different tokens share a budget")
+	}
+	if credentialKey("github.com", "ghs_a") == credentialKey("ghe.example.com", "ghs_a") {
+		t.Error("different hosts share a budget")
+	}
+	if key := credentialKey("github.com", "ghs_secret"); strings.Contains(key, "ghs_secret") {
+		t.Errorf("key %q contains the token", key)
+	}
+}
+
+func TestGitHubRequestETag(t *testing.T) {
+	body := `{"id":1}`
+	var conditional int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf("%q", body)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	savedClient, savedETags := httpClient, githubETags
+	httpClient, githubETags = srv.Client(), newETagCache()
+	defer func() { httpClient, githubETags = savedClient, savedETags }()
+
+	for _, want := range []int{1, 1, 2} {
+		if want == 2 {
+			body = `{"id":2}`
+		}
+
+		var out struct{ ID int }
+		if err := githubRequest(context.Background(), http.MethodGet, srv.URL+"/app/installations", "token", nil, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.ID != want {
+			t.Errorf("got ID %v, want %v", out.ID, want)
+		}
+	}
+
+	if conditional != 1 {
+		t.Errorf("got %v not modified responses, want 1", conditional)
+	}
+}
+
+func TestGitHubRequestPrimaryRateLimit(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"message":"API rate limit exceeded"}`)
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+
+	savedClient, savedLimits, savedDelay, savedLog := httpClient, githubLimits, githubRetryDelay, log.w
+	httpClient, githubLimits, githubRetryDelay = srv.Client(), newRateLimiter(), 0
+	var logged bytes.Buffer
+	log.w = &logged
+	defer func() {
+		httpClient, githubLimits, githubRetryDelay, log.w = savedClient, savedLimits, savedDelay, savedLog
+	}()
+
+	if err := githubRequest(context.Background(), http.MethodGet, srv.URL+"/app", "token", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("got %v requests, want the rate limited one retried", requests)
+	}
+	if !strings.Contains(logged.String(), "API rate limit exceeded") {
+		t.Errorf("rate limit was not logged: %q", logged.String())
+	}
+}
+
+func TestRateLimitCommand(t *testing.T) {
+	f := newFakeGitHub(t)
+	setupFake(t, f, ModeLegacy)
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := userToken
+	userToken = func(context.Context, githubInstance) (string, error) { return "gho_user", nil }
+	defer func() { userToken = saved }()
+
+	budgets := credentialBudgets(context.Background(), mustLoadHost(t))
+	if len(budgets) != 3 {
+		t.Fatalf("got %v budgets, want 3", len(budgets))
+	}
+	for _, b := range budgets {
+		if b.Err != nil || !b.Tracked || b.Budget.Limit != 5000 || b.Budget.Remaining >= 5000 {
+			t.Errorf("got %+v, want a tracked budget", b)
+		}
+	}
+	if !contains(f.Requests(), "POST /api/v3/app/installations/7/access_tokens") {
+		t.Errorf("no installation token was created, requests: %v", f.Requests())
+	}
+
+	var out bytes.Buffer
+	printRateLimits(&out, budgets)
+	for _, want := range []string{"user token", "App JWT", "installation token", "5000"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output is missing %q:\n%v", want, out.String())
+		}
+	}
+
+	f.mu.Lock()
+	f.RateLimitReset = time.Time{}
+	f.mu.Unlock()
+	githubLimits = newRateLimiter()
+	out.Reset()
+	printRateLimits(&out, credentialBudgets(context.Background(), mustLoadHost(t)))
+	if n := strings.Count(out.String(), "rate limiting is disabled"); n != 3 {
+		t.Errorf("got %v credentials with rate limiting disabled, want 3:\n%v", n, out.String())
+	}
+}
+
+func mustLoadHost(t *testing.T) githubInstance {
+	t.Helper()
+
+	githubHost, err := loadHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return githubHost
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2"
+)
+
+const (
+	webhookServerNamespace  = "actions-runner-system"
+	webhookServerDeployment = "actions-runner-controller-github-webhook-server"
+)
+
+func rotateMain(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageError("usage: arc-setup rotate webhook-secret|private-key")
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		return err
+	}
+
+	githubHost, err := loadHost()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "webhook-secret":
+		return rotateWebhookSecret(ctx, state, vars, githubHost)
+	case "private-key":
+		return rotatePrivateKey(ctx, state, vars, githubHost)
+	default:
+		return fmt.Errorf("unknown credential %q (must be webhook-secret or private-key)", args[0])
+	}
+}
+
+// rotateWebhookSecret replaces the App's webhook secret.
+//
+// The webhook server reads the secret from its environment, so updating the
+// Secret does nothing until it restarts. The new secret is stored first, so
+// it can't be lost, then the App is switched and the server restarted straight
+// after, which keeps the window where the two disagree short. Deliveries which
+// failed in that window are redelivered.
+func rotateWebhookSecret(ctx context.Context, state *State, vars Vars, githubHost githubInstance) error {
+	if !state.Mode.NeedsWebhook() {
+		return fmt.Errorf("%v mode has no webhook secret", state.Mode)
+	}
+
+	client, err := newAppClient(ctx, githubHost, vars)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error generating secret: %w", err)
+	}
+	secret := hex.EncodeToString(b)
+
+	backend, err := chooseSecretsBackend(state)
+	if err != nil {
+		return err
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	oldVars := vars
+	oldSecret, err := vars.webhookSecret(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read webhook secret: %w", err)
+	}
+
+	// Should storing the new secret or switching the App fail, the old
+	// secret is put back everywhere, so nothing disagrees with GitHub.
+	restore := func(err error) error {
+		logWarnf("Rotating the webhook secret failed, restoring the old one...")
+		if rerr := storeWebhookSecret(ctx, state, backend, oldVars, oldSecret); rerr != nil {
+			return fmt.Errorf("%w (and restoring the old webhook secret failed: %v)", err, rerr)
+		}
+
+		return err
+	}
+
+	vars.WebhookSecretRef = backend.Ref(secretWebhookSecret)
+	vars.WebhookSecret = ""
+	if err := storeWebhookSecret(ctx, state, backend, vars, secret); err != nil {
+		return restore(err)
+	}
+
+	// Allow for clock drift between here and GitHub when picking out
+	// deliveries made after the switch.
+	switched := time.Now().Add(-time.Minute)
+
+	logInfof("Updating the App's webhook secret...")
+	if err := client.updateHookConfig(ctx, hookConfig{Secret: secret}); err != nil {
+		return restore(err)
+	}
+
+	logInfof("Restarting %v/%v...", webhookServerNamespace, webhookServerDeployment)
+	if err := kube.restartDeployment(webhookServerNamespace, webhookServerDeployment); err != nil {
+		return err
+	}
+	if err := kube.waitForDeployment(ctx, webhookServerNamespace, webhookServerDeployment); err != nil {
+		return err
+	}
+
+	deliveries, err := client.hookDeliveries(ctx, switched)
+	if err != nil {
+		return fmt.Errorf("listing webhook deliveries: %w", err)
+	}
+
+	for _, d := range failedDeliveries(deliveries, switched) {
+		logInfof("Redelivering %v webhook %v, which failed with status %v...", d.Event, d.ID, d.StatusCode)
+		if err := client.redeliver(ctx, d.ID); err != nil {
+			return fmt.Errorf("redelivering webhook %v: %w", d.ID, err)
+		}
+	}
+
+	fmt.Printf("✅ Webhook secret rotated.\n")
+
+	return nil
+}
+
+// storeWebhookSecret puts secret in backend and the webhook server's Secret,
+// saving vars as arc.env.
+func storeWebhookSecret(ctx context.Context, state *State, backend SecretsBackend, vars Vars, secret string) error {
+	logInfof("Storing the webhook secret in the %v secrets backend...", backend.Name())
+	if _, err := backend.Put(ctx, secretWebhookSecret, []byte(secret)); err != nil {
+		return fmt.Errorf("storing webhook secret: %w", err)
+	}
+	if err := saveVars(vars); err != nil {
+		return err
+	}
+
+	if backend.Name() != "kubernetes" {
+		logInfof("Updating the %v Secret...", kubernetesSecretNames[secretWebhookSecret])
+		cluster := &kubernetesSecrets{namespace: secretsNamespace(state.Mode)}
+		if _, err := cluster.Put(ctx, secretWebhookSecret, []byte(secret)); err != nil {
+			return fmt.Errorf("updating webhook secret: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// failedDeliveries are the deliveries made since which failed and haven't
+// been redelivered successfully since. Redeliveries are never picked
+// themselves, their original is.
+func failedDeliveries(deliveries []hookDelivery, since time.Time) []hookDelivery {
+	succeeded := map[string]bool{}
+	for _, d := range deliveries {
+		if d.StatusCode >= 200 && d.StatusCode < 300 {
+			succeeded[d.GUID] = true
+		}
+	}
+
+	var failed []hookDelivery
+	for _, d := range deliveries {
+		if d.Redelivery || d.DeliveredAt.Before(since) || succeeded[d.GUID] {
+			continue
+		}
+		failed = append(failed, d)
+	}
+
+	return failed
+}
+
+// rotatePrivateKey swaps the App's private key for one the user generates in
+// the UI, as GitHub has no API for creating keys.
+func rotatePrivateKey(ctx context.Context, state *State, vars Vars, githubHost githubInstance) error {
+	settingsURL := githubHost.AppSettingsURL(vars.Organization, "")
+	if client, err := newAppClient(ctx, githubHost, vars); err == nil {
+		if app, err := client.app(ctx); err == nil {
+			settingsURL = githubHost.AppSettingsURL(vars.Organization, app.Slug)
+		}
+	}
+
+	fmt.Printf("ℹ Generate a new private key under \"Private keys\" at %v\n", settingsURL)
+	fmt.Printf("ℹ Keep the old key until this finishes, so runners keep working in the meantime.\n")
+
+	prompt := &survey.Input{
+		Message: "Path to the downloaded private key (.pem):",
+	}
+	var keyPath string
+	if err := ask(prompt, &keyPath, survey.WithValidator(fileValidator())); err != nil {
+		return err
+	}
+
+	key, err := files.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	jwt, err := appJWT(vars.AppID, key)
+	if err != nil {
+		return err
+	}
+
+	app, err := (&appClient{apiURL: githubHost.APIURL(), jwt: jwt}).app(ctx)
+	if err != nil {
+		return fmt.Errorf("the new private key was not accepted by GitHub: %w", err)
+	}
+	if strconv.Itoa(app.ID) != vars.AppID {
+		return fmt.Errorf("the new private key belongs to App %v, not %v", app.ID, vars.AppID)
+	}
+
+	backend, err := chooseSecretsBackend(state)
+	if err != nil {
+		return err
+	}
+
+	logInfof("Storing the new private key in the %v secrets backend...", backend.Name())
+	ref, err := backend.Put(ctx, secretPrivateKey, key)
+	if err != nil {
+		return fmt.Errorf("storing private key: %w", err)
+	}
+	vars.PrivateKeyRef = ref
+	vars.PrivateKey = ""
+	if err := saveVars(vars); err != nil {
+		return err
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var namespace, controller string
+	if state.Mode.NeedsWebhook() {
+		namespace, controller = "actions-runner-system", "actions-runner-controller"
+
+		if backend.Name() != "kubernetes" {
+			logInfof("Updating the %v Secret...", kubernetesSecretNames[secretPrivateKey])
+			cluster := &kubernetesSecrets{namespace: secretsNamespace(state.Mode)}
+			if _, err := cluster.Put(ctx, secretPrivateKey, key); err != nil {
+				return fmt.Errorf("updating private key: %w", err)
+			}
+		}
+	} else {
+		namespace, controller = scaleSetControllerNamespace, scaleSetControllerRelease+"-gha-rs-controller"
+
+		// Without the kubernetes backend each scale set has its own Secret,
+		// created by the chart from its values.
+		if !vars.inClusterSecrets() {
+			for _, name := range splitScaleSets(vars.ScaleSets) {
+				release, err := scaleSetHelmRelease(ctx, vars, name)
+				if err != nil {
+					return err
+				}
+
+				logInfof("Updating runner scale set %v...", name)
+				if err := release.install(ctx, os.Stdout); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	logInfof("Restarting %v/%v...", namespace, controller)
+	if err := kube.restartDeployment(namespace, controller); err != nil {
+		return err
+	}
+	if err := kube.waitForDeployment(ctx, namespace, controller); err != nil {
+		return err
+	}
+
+	fmt.Printf("✅ Private key rotated.\n")
+	fmt.Printf("ℹ Now delete the old private key at %v, and the downloaded %v.\n", settingsURL, keyPath)
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRotateWebhookSecretRestoresOnFailure(t *testing.T) {
+	f := newFakeGitHub(t)
+	setupFake(t, f, ModeLegacy)
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	kube := newFakeKube(t)
+
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := loadVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	githubHost, err := loadHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := vars.webhookSecret(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.HookConfigStatus = http.StatusUnprocessableEntity
+	f.mu.Unlock()
+
+	if err := rotateWebhookSecret(context.Background(), state, vars, githubHost); err == nil {
+		t.Fatal("got no error when GitHub refused the new secret")
+	}
+
+	restored, err := loadVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored, vars) {
+		t.Errorf("got %v %+v, want %+v restored", VarFileName, restored, vars)
+	}
+	if got, err := restored.webhookSecret(context.Background()); err != nil || got != old {
+		t.Errorf("got webhook secret %q (error %v), want the old %q", got, err, old)
+	}
+	if got := kube.Secret(webhookServerNamespace, kubernetesSecretNames[secretWebhookSecret], secretWebhookSecret); got != old {
+		t.Errorf("got %q in the webhook server's Secret, want the old %q", got, old)
+	}
+}
+
+func TestHookDeliveries(t *testing.T) {
+	f := newFakeGitHub(t)
+	setupFake(t, f, ModeLegacy)
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 250; i++ {
+		f.Deliveries = append(f.Deliveries, hookDelivery{ID: int64(1000 - i), DeliveredAt: now.Add(-time.Duration(i) * time.Minute), StatusCode: 200})
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+	githubHost, err := loadHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newAppClient(context.Background(), githubHost, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second page reaches back before since, so there's no need for
+	// the third.
+	deliveries, err := client.hookDeliveries(context.Background(), now.Add(-150*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 200 {
+		t.Errorf("got %v deliveries, want the first two pages", len(deliveries))
+	}
+
+	deliveries, err = client.hookDeliveries(context.Background(), now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 250 {
+		t.Errorf("got %v deliveries, want all three pages", len(deliveries))
+	}
+}
+
+func TestFailedDeliveries(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	at := since.Add(time.Second)
+
+	deliveries := []hookDelivery{
+		{ID: 9, GUID: "c", DeliveredAt: at, StatusCode: 200, Redelivery: true},
+		{ID: 8, GUID: "d", DeliveredAt: at, StatusCode: 401, Redelivery: true},
+		{ID: 7, GUID: "a", DeliveredAt: at, StatusCode: 401},
+		{ID: 6, GUID: "b", DeliveredAt: at, StatusCode: 200},
+		{ID: 5, GUID: "c", DeliveredAt: at, StatusCode: 401},
+		{ID: 4, GUID: "d", DeliveredAt: at, StatusCode: 401},
+		{ID: 3, GUID: "e", DeliveredAt: since.Add(-time.Second), StatusCode: 401},
+	}
+
+	var ids []int64
+	for _, d := range failedDeliveries(deliveries, since) {
+		ids = append(ids, d.ID)
+	}
+
+	// c was redelivered successfully already, and d's failed redelivery is
+	// retried by redelivering d itself.
+	if want := []int64{7, 4}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2"
+	env "github.com/Netflix/go-env"
+)
+
+// runnerGroupVisibilities are who may use a runner group: any repository,
+// those selected, or private and internal ones only.
+var runnerGroupVisibilities = []string{"all", "selected", "private"}
+
+// runnerGroupUnmanaged is the visibility prompt's answer for leaving the
+// group's access as it is on GitHub.
+const runnerGroupUnmanaged = "unmanaged"
+
+// runnerGroupPolicy is who may use the runner group, as configured in
+// arc.env.
+type runnerGroupPolicy struct {
+	Visibility               string
+	Repositories             []string
+	RestrictedToWorkflows    bool
+	SelectedWorkflows        []string
+	AllowsPublicRepositories bool
+}
+
+// runnerGroupPolicy returns the runner group's access policy, or nil if
+// arc-setup doesn't manage it.
+func (v Vars) runnerGroupPolicy() (*runnerGroupPolicy, error) {
+	if v.RunnerGroupVisibility == "" {
+		return nil, nil
+	}
+
+	p := &runnerGroupPolicy{
+		Visibility:        v.RunnerGroupVisibility,
+		Repositories:      splitList(v.RunnerGroupRepositories),
+		SelectedWorkflows: splitList(v.RunnerGroupWorkflows),
+	}
+	p.RestrictedToWorkflows = len(p.SelectedWorkflows) > 0
+	sort.Strings(p.Repositories)
+	sort.Strings(p.SelectedWorkflows)
+
+	valid := false
+	for _, v := range runnerGroupVisibilities {
+		valid = valid || v == p.Visibility
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid ARC_GITHUB_APP_RUNNER_GROUP_VISIBILITY %q (must be one of %v)", p.Visibility, strings.Join(runnerGroupVisibilities, ", "))
+	}
+	if p.Visibility != "selected" && len(p.Repositories) > 0 {
+		return nil, fmt.Errorf("ARC_GITHUB_APP_RUNNER_GROUP_REPOSITORIES is only used with visibility selected, not %v", p.Visibility)
+	}
+	if v.RunnerGroupPublicRepos != "" {
+		allowed, err := strconv.ParseBool(v.RunnerGroupPublicRepos)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ARC_GITHUB_APP_RUNNER_GROUP_PUBLIC_REPOS %q (must be true or false)", v.RunnerGroupPublicRepos)
+		}
+		p.AllowsPublicRepositories = allowed
+	}
+
+	return p, nil
+}
+
+// askRunnerGroupPolicy sets vars' runner group policy from the environment
+// or, if ARC_GITHUB_APP_RUNNER_GROUP_VISIBILITY isn't set, by prompting. It
+// warns about any of it the instance doesn't support.
+func askRunnerGroupPolicy(vars *Vars, caps capabilities) error {
+	if os.Getenv("ARC_GITHUB_APP_RUNNER_GROUP_VISIBILITY") != "" {
+		var fromEnv Vars
+		if _, err := env.UnmarshalFromEnviron(&fromEnv); err != nil {
+			return fmt.Errorf("error reading settings from the environment: %w", err)
+		}
+		vars.RunnerGroupVisibility = fromEnv.RunnerGroupVisibility
+		vars.RunnerGroupRepositories = fromEnv.RunnerGroupRepositories
+		vars.RunnerGroupWorkflows = fromEnv.RunnerGroupWorkflows
+		vars.RunnerGroupPublicRepos = fromEnv.RunnerGroupPublicRepos
+
+		policy, err := vars.runnerGroupPolicy()
+		if err != nil {
+			return &setupError{Kind: kindUsage, Err: err}
+		}
+		warnRunnerGroupPolicy(caps, policy)
+
+		return nil
+	}
+
+	visibility := runnerGroupUnmanaged
+	prompt := &survey.Select{
+		Message: fmt.Sprintf("Which repositories may use runner group %q?", vars.RunnerGroup),
+		Help:    "all: any repository. selected: only those you list. private: private and internal repositories only. unmanaged: leave the group's access as it is on GitHub.",
+		Options: append([]string{runnerGroupUnmanaged}, runnerGroupVisibilities...),
+		Default: runnerGroupUnmanaged,
+	}
+	if err := ask(prompt, &visibility); err != nil {
+		return err
+	}
+	if visibility == runnerGroupUnmanaged {
+		return nil
+	}
+	vars.RunnerGroupVisibility = visibility
+
+	if visibility == "selected" {
+		repos := &survey.Input{
+			Message: fmt.Sprintf("Which repositories should runner group %q be limited to? (comma separated)", vars.RunnerGroup),
+		}
+		if err := ask(repos, &vars.RunnerGroupRepositories, survey.WithValidator(survey.Required)); err != nil {
+			return err
+		}
+	}
+
+	workflows := &survey.Input{
+		Message: fmt.Sprintf("Which workflows may use runner group %q? (comma separated, blank for any)", vars.RunnerGroup),
+		Help:    "Each is a workflow file and ref, like my-org/my-repo/.github/workflows/ci.yml@refs/heads/main.",
+	}
+	if err := ask(workflows, &vars.RunnerGroupWorkflows); err != nil {
+		return err
+	}
+
+	public := "no"
+	publicPrompt := &survey.Select{
+		Message: fmt.Sprintf("May public repositories use runner group %q?", vars.RunnerGroup),
+		Help:    "Jobs from forks of public repositories can run arbitrary code on the runners.",
+		Options: []string{"no", "yes"},
+		Default: "no",
+	}
+	if err := ask(publicPrompt, &public); err != nil {
+		return err
+	}
+	vars.RunnerGroupPublicRepos = strconv.FormatBool(public == "yes")
+
+	vars.RunnerGroupRepositories = strings.Join(splitList(vars.RunnerGroupRepositories), ",")
+	vars.RunnerGroupWorkflows = strings.Join(splitList(vars.RunnerGroupWorkflows), ",")
+
+	policy, err := vars.runnerGroupPolicy()
+	if err != nil {
+		return err
+	}
+	warnRunnerGroupPolicy(caps, policy)
+
+	return nil
+}
+
+func warnRunnerGroupPolicy(caps capabilities, policy *runnerGroupPolicy) {
+	for _, w := range caps.runnerGroupWarnings(policy) {
+		logWarnf("%v.", w)
+	}
+}
+
+// runnerGroup is the subset of a runner group arc-setup manages.
+type runnerGroup struct {
+	ID                       int64    `json:"id"`
+	Name                     string   `json:"name"`
+	Visibility               string   `json:"visibility"`
+	AllowsPublicRepositories bool     `json:"allows_public_repositories"`
+	RestrictedToWorkflows    bool     `json:"restricted_to_workflows"`
+	SelectedWorkflows        []string `json:"selected_workflows"`
+}
+
+// runnerGroupClient manages an org's runner groups as the App's installation.
+type runnerGroupClient struct {
+	ctx   context.Context
+	api   string
+	org   string
+	token string
+}
+
+func newRunnerGroupClient(ctx context.Context, githubHost githubInstance, vars Vars) (*runnerGroupClient, error) {
+	token, err := cachedInstallationToken(ctx, githubHost, vars, tokenScope{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &runnerGroupClient{ctx: ctx, api: githubHost.APIURL(), org: vars.Organization, token: token.Token}, nil
+}
+
+func (c *runnerGroupClient) url(format string, a ...interface{}) string {
+	return c.api + "/orgs/" + url.PathEscape(c.org) + fmt.Sprintf(format, a...)
+}
+
+// group returns the runner group called name, or nil if there is none.
+func (c *runnerGroupClient) group(name string) (*runnerGroup, error) {
+	for page := 1; ; page++ {
+		var res struct {
+			TotalCount   int           `json:"total_count"`
+			RunnerGroups []runnerGroup `json:"runner_groups"`
+		}
+		if err := githubRequest(c.ctx, http.MethodGet, c.url("/actions/runner-groups?per_page=100&page=%v", page), c.token, nil, &res); err != nil {
+			return nil, err
+		}
+
+		for _, g := range res.RunnerGroups {
+			if g.Name == name {
+				return &g, nil
+			}
+		}
+		if len(res.RunnerGroups) == 0 || page*100 >= res.TotalCount {
+			return nil, nil
+		}
+	}
+}
+
+type groupRepository struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// repositories returns the sorted names of the repositories selected to use
+// group id.
+func (c *runnerGroupClient) repositories(id int64) ([]string, error) {
+	var names []string
+	for page := 1; ; page++ {
+		var res struct {
+			TotalCount   int               `json:"total_count"`
+			Repositories []groupRepository `json:"repositories"`
+		}
+		if err := githubRequest(c.ctx, http.MethodGet, c.url("/actions/runner-groups/%v/repositories?per_page=100&page=%v", id, page), c.token, nil, &res); err != nil {
+			return nil, err
+		}
+
+		for _, r := range res.Repositories {
+			names = append(names, r.Name)
+		}
+		if len(res.Repositories) == 0 || len(names) >= res.TotalCount {
+			sort.Strings(names)
+			return names, nil
+		}
+	}
+}
+
+// apply sets group's access to policy.
+func (c *runnerGroupClient) apply(group *runnerGroup, policy *runnerGroupPolicy) error {
+	workflows := policy.SelectedWorkflows
+	if workflows == nil {
+		workflows = []string{}
+	}
+	update := map[string]interface{}{
+		"name":                       group.Name,
+		"visibility":                 policy.Visibility,
+		"allows_public_repositories": policy.AllowsPublicRepositories,
+		"restricted_to_workflows":    policy.RestrictedToWorkflows,
+		"selected_workflows":         workflows,
+	}
+	// Setting the same policy twice is harmless.
+	if err := githubRequestWith(c.ctx, retryServerErrors, http.MethodPatch, c.url("/actions/runner-groups/%v", group.ID), c.token, update, nil); err != nil {
+		return err
+	}
+
+	if policy.Visibility != "selected" {
+		return nil
+	}
+
+	ids := []int64{}
+	for _, name := range policy.Repositories {
+		var repo groupRepository
+		if err := githubRequest(c.ctx, http.MethodGet, c.api+"/repos/"+url.PathEscape(c.org)+"/"+url.PathEscape(name), c.token, nil, &repo); err != nil {
+			return fmt.Errorf("looking up repository %v: %w", name, err)
+		}
+		ids = append(ids, repo.ID)
+	}
+
+	return githubRequest(c.ctx, http.MethodPut, c.url("/actions/runner-groups/%v/repositories", group.ID), c.token, map[string]interface{}{"selected_repository_ids": ids}, nil)
+}
+
+// changes compares group's live access with policy.
+func (c *runnerGroupClient) changes(group *runnerGroup, policy *runnerGroupPolicy) ([]change, error) {
+	var changes []change
+
+	if group.Visibility != policy.Visibility {
+		changes = append(changes, change{Path: "visibility", Live: group.Visibility, Desired: policy.Visibility})
+	}
+
+	if policy.Visibility == "selected" {
+		live := []string{}
+		if group.Visibility == "selected" {
+			repos, err := c.repositories(group.ID)
+			if err != nil {
+				return nil, err
+			}
+			live = append(live, repos...)
+		}
+		want := append([]string{}, policy.Repositories...)
+		if !reflect.DeepEqual(live, want) {
+			changes = append(changes, change{Path: "repositories", Live: live, Desired: want})
+		}
+	}
+
+	if group.RestrictedToWorkflows != policy.RestrictedToWorkflows {
+		changes = append(changes, change{Path: "restricted_to_workflows", Live: group.RestrictedToWorkflows, Desired: policy.RestrictedToWorkflows})
+	}
+
+	live := append([]string{}, group.SelectedWorkflows...)
+	sort.Strings(live)
+	want := append([]string{}, policy.SelectedWorkflows...)
+	if policy.RestrictedToWorkflows && !reflect.DeepEqual(live, want) {
+		changes = append(changes, change{Path: "selected_workflows", Live: live, Desired: want})
+	}
+
+	if group.AllowsPublicRepositories != policy.AllowsPublicRepositories {
+		changes = append(changes, change{Path: "allows_public_repositories", Live: group.AllowsPublicRepositories, Desired: policy.AllowsPublicRepositories})
+	}
+
+	return changes, nil
+}
+
+// runnerGroupDrift compares the runner group's access with arc.env, returning
+// nil if it matches or arc-setup doesn't manage it.
+func runnerGroupDrift(ctx context.Context, githubHost githubInstance, vars Vars) (*drift, error) {
+	policy, err := vars.runnerGroupPolicy()
+	if err != nil || policy == nil {
+		return nil, err
+	}
+
+	c, err := newRunnerGroupClient(ctx, githubHost, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("runner group %v access on %v", vars.RunnerGroup, vars.Organization)
+
+	group, err := c.group(vars.RunnerGroup)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return &drift{Target: target, Missing: true, Manual: "create it at " + githubHost.RunnersURL(vars.Organization)}, nil
+	}
+
+	changes, err := c.changes(group, policy)
+	if err != nil || len(changes) == 0 {
+		return nil, err
+	}
+
+	return &drift{
+		Target:  target,
+		Changes: changes,
+		fix: func(w io.Writer) error {
+			if err := c.apply(group, policy); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(w, "runner group %v access updated\n", group.Name)
+
+			return nil
+		},
+	}, nil
+}
+
+// applyRunnerGroupPolicy applies vars' policy during setup. Failing is not
+// fatal, as reconcile applies it later.
+func applyRunnerGroupPolicy(ctx context.Context, githubHost githubInstance, vars Vars) {
+	policy, err := vars.runnerGroupPolicy()
+	if err != nil || policy == nil {
+		return
+	}
+
+	err = func() error {
+		c, err := newRunnerGroupClient(ctx, githubHost, vars)
+		if err != nil {
+			return err
+		}
+
+		group, err := c.group(vars.RunnerGroup)
+		if err != nil {
+			return err
+		}
+		if group == nil {
+			return fmt.Errorf("it does not exist, create it at %v", githubHost.RunnersURL(vars.Organization))
+		}
+
+		return c.apply(group, policy)
+	}()
+	if err != nil {
+		logWarnf("Could not set who may use runner group %q, run `arc-setup reconcile` to retry: %v", vars.RunnerGroup, err)
+		return
+	}
+
+	logInfof("Runner group %q may be used by %v repositories.", vars.RunnerGroup, policy.Visibility)
+}
+
+func statusMain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	githubHost, err := loadHost()
+	if err != nil {
+		return err
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		return err
+	}
+
+	return printStatus(ctx, os.Stdout, state, githubHost, vars)
+}
+
+// printStatus describes the installation, with who may use its runner group.
+func printStatus(ctx context.Context, w io.Writer, state *State, githubHost githubInstance, vars Vars) error {
+	fmt.Fprintf(w, "Mode: %v\n", state.Mode)
+	fmt.Fprintf(w, "GitHub: %v\n", githubHost)
+	fmt.Fprintf(w, "Organization: %v\n", vars.Organization)
+	fmt.Fprintf(w, "App ID: %v\n", vars.AppID)
+	fmt.Fprintf(w, "Installation ID: %v\n", vars.InstallationID)
+	fmt.Fprintf(w, "Runner group: %v\n", vars.RunnerGroup)
+
+	policy, err := vars.runnerGroupPolicy()
+	if err != nil {
+		return err
+	}
+
+	c, err := newRunnerGroupClient(ctx, githubHost, vars)
+	if err != nil {
+		return err
+	}
+
+	group, err := c.group(vars.RunnerGroup)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		fmt.Fprintf(w, "  Missing, create it at %v\n", githubHost.RunnersURL(vars.Organization))
+		return nil
+	}
+
+	fmt.Fprintf(w, "  Visibility: %v\n", group.Visibility)
+	if group.Visibility == "selected" {
+		repos, err := c.repositories(group.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  Repositories: %v\n", listOrNone(repos))
+	}
+	if group.RestrictedToWorkflows {
+		fmt.Fprintf(w, "  Workflows: %v\n", listOrNone(group.SelectedWorkflows))
+	} else {
+		fmt.Fprintf(w, "  Workflows: any\n")
+	}
+	fmt.Fprintf(w, "  Public repositories: %v\n", allowed(group.AllowsPublicRepositories))
+
+	if policy == nil {
+		fmt.Fprintf(w, "  Policy: not managed by arc-setup\n")
+		return nil
+	}
+
+	changes, err := c.changes(group, policy)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "  Policy: matches %v\n", VarFileName)
+		return nil
+	}
+
+	fmt.Fprintf(w, "  Policy: differs from %v, run `arc-setup reconcile` to apply it\n", VarFileName)
+	for _, c := range changes {
+		fmt.Fprintf(w, "    %v: %v => %v\n", c.Path, formatDriftValue(c.Path, c.Live), formatDriftValue(c.Path, c.Desired))
+	}
+
+	return nil
+}
+
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "(none)"
+	}
+
+	return strings.Join(list, ", ")
+}
+
+func allowed(b bool) string {
+	if b {
+		return "allowed"
+	}
+
+	return "not allowed"
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunnerGroupPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		vars    Vars
+		want    *runnerGroupPolicy
+		wantErr bool
+	}{
+		{name: "unmanaged", vars: Vars{RunnerGroupRepositories: "api"}},
+		{
+			name: "selected",
+			vars: Vars{RunnerGroupVisibility: "selected", RunnerGroupRepositories: "web, api", RunnerGroupWorkflows: "acme/api/.github/workflows/ci.yml@refs/heads/main", RunnerGroupPublicRepos: "false"},
+			want: &runnerGroupPolicy{Visibility: "selected", Repositories: []string{"api", "web"}, RestrictedToWorkflows: true, SelectedWorkflows: []string{"acme/api/.github/workflows/ci.yml@refs/heads/main"}},
+		},
+		{
+			name: "private with public repos",
+			vars: Vars{RunnerGroupVisibility: "private", RunnerGroupPublicRepos: "true"},
+			want: &runnerGroupPolicy{Visibility: "private", AllowsPublicRepositories: true},
+		},
+		{name: "unknown visibility", vars: Vars{RunnerGroupVisibility: "public"}, wantErr: true},
+		{name: "repositories without selected", vars: Vars{RunnerGroupVisibility: "all", RunnerGroupRepositories: "api"}, wantErr: true},
+		{name: "bad public repos", vars: Vars{RunnerGroupVisibility: "all", RunnerGroupPublicRepos: "sometimes"}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.vars.runnerGroupPolicy()
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, c.wantErr)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSetupRunnerGroupPolicy(t *testing.T) {
+	f := newFakeGitHub(t)
+	_, p := setupFake(t, f, ModeLegacy)
+	p.answers["repositories may"] = "selected"
+	p.answers["limited to"] = "web, api"
+	p.answers["workflows may"] = "acme/api/.github/workflows/ci.yml@refs/heads/main"
+	p.answers["public repositories"] = "no"
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := runnerGroup{ID: 1, Name: "Default", Visibility: "selected", RestrictedToWorkflows: true, SelectedWorkflows: []string{"acme/api/.github/workflows/ci.yml@refs/heads/main"}}
+	f.mu.Lock()
+	if got := f.RunnerGroups[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got runner group %+v, want %+v", got, want)
+	}
+	if got := f.GroupRepositories[1]; !reflect.DeepEqual(got, []int64{101, 102}) {
+		t.Errorf("got selected repositories %v, want api and web", got)
+	}
+	f.mu.Unlock()
+
+	githubHost, vars, err := tokenCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.RunnerGroupVisibility != "selected" || vars.RunnerGroupRepositories != "web,api" || vars.RunnerGroupPublicRepos != "false" {
+		t.Errorf("%v does not hold the policy: %+v", VarFileName, vars)
+	}
+
+	if d, err := runnerGroupDrift(context.Background(), githubHost, vars); err != nil || d != nil {
+		t.Fatalf("got drift %+v (error %v), want none", d, err)
+	}
+
+	f.mu.Lock()
+	f.RunnerGroups[0].Visibility = "all"
+	f.RunnerGroups[0].AllowsPublicRepositories = true
+	f.mu.Unlock()
+
+	var out bytes.Buffer
+	if err := printStatus(context.Background(), &out, &State{Mode: ModeLegacy}, githubHost, vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Runner group: Default", "Visibility: all", "Public repositories: allowed", "differs from", `visibility: "all" => "selected"`} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("status does not contain %q:\n%v", line, out.String())
+		}
+	}
+
+	d, err := runnerGroupDrift(context.Background(), githubHost, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || d.fix == nil {
+		t.Fatalf("got drift %+v, want a fixable drift", d)
+	}
+	paths := []string{}
+	for _, c := range d.Changes {
+		paths = append(paths, c.Path)
+	}
+	if want := []string{"visibility", "repositories", "allows_public_repositories"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("got changes to %v, want %v", paths, want)
+	}
+
+	if err := d.fix(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := runnerGroupDrift(context.Background(), githubHost, vars); err != nil || d != nil {
+		t.Errorf("got drift %+v (error %v) after fixing it, want none", d, err)
+	}
+
+	out.Reset()
+	if err := printStatus(context.Background(), &out, &State{Mode: ModeLegacy}, githubHost, vars); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Repositories: api, web") || !strings.Contains(out.String(), "matches") {
+		t.Errorf("status does not show the applied policy:\n%v", out.String())
+	}
+}
+
+func TestSetupRunnerGroupPolicyFromEnv(t *testing.T) {
+	f := newFakeGitHub(t)
+	_, p := setupFake(t, f, ModeLegacy)
+	delete(p.answers, "repositories may")
+	t.Setenv("ARC_GITHUB_APP_RUNNER_GROUP_VISIBILITY", "private")
+	t.Setenv("ARC_GITHUB_APP_RUNNER_GROUP_PUBLIC_REPOS", "false")
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if g := f.RunnerGroups[0]; g.Visibility != "private" || g.AllowsPublicRepositories || g.RestrictedToWorkflows {
+		t.Errorf("got runner group %+v, want private without public repositories", g)
+	}
+}
+
+func TestSetupWarnsOfMissingRunnerGroup(t *testing.T) {
+	for _, group := range []string{"Default", "production"} {
+		t.Run(group, func(t *testing.T) {
+			f := newFakeGitHub(t)
+			_, p := setupFake(t, f, ModeLegacy)
+			p.answers["Runner Group"] = group
+			var logged bytes.Buffer
+			log.w = &logged
+			if err := realMain(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			warned := strings.Contains(logged.String(), `Runner group "`+group+`" does not exist`)
+			if warned != (group != "Default") {
+				t.Errorf("got warned %v for runner group %v:\n%v", warned, group, logged.String())
+			}
+			if strings.Contains(logged.String(), "Could not list") {
+				t.Errorf("could not list runner groups:\n%v", logged.String())
+			}
+		})
+	}
+}
+
+func TestRunnerGroupPolicyMissingGroup(t *testing.T) {
+	f := newFakeGitHub(t)
+	setupFake(t, f, ModeLegacy)
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	githubHost, vars, err := tokenCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars.RunnerGroup = "production"
+	vars.RunnerGroupVisibility = "private"
+
+	d, err := runnerGroupDrift(context.Background(), githubHost, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || !d.Missing || d.fix != nil || !strings.Contains(d.Manual, githubHost.RunnersURL(vars.Organization)) {
+		t.Errorf("got drift %+v, want the group reported missing, to be created by hand", d)
+	}
+}
+
+func TestRunnerGroupWarnings(t *testing.T) {
+	workflows := &runnerGroupPolicy{Visibility: "all", RestrictedToWorkflows: true, SelectedWorkflows: []string{"acme/api/.github/workflows/ci.yml@refs/heads/main"}}
+	cases := []struct {
+		version string
+		policy  *runnerGroupPolicy
+		want    string
+	}{
+		{version: "", policy: workflows},
+		{version: "3.5.0", policy: workflows},
+		{version: "3.4.2", policy: &runnerGroupPolicy{Visibility: "all"}},
+		{version: "3.4.2", policy: workflows, want: "can't restrict runner groups to workflows"},
+		{version: "3.4.2"},
+		{version: "2.22.0", want: "predates runner groups"},
+		{version: "2.22.0", policy: workflows, want: "predates runner groups"},
+	}
+
+	for _, c := range cases {
+		var caps capabilities
+		if c.version == "" {
+			caps = capabilities{Actions: true, WorkflowJob: true, ScaleSets: true, RunnerGroupWorkflows: true}
+		} else {
+			v, err := parseGHESVersion(c.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			caps = capabilities{Version: c.version, Actions: v.atLeast(ghesActions), RunnerGroupWorkflows: v.atLeast(ghesRunnerGroupWorkflows)}
+		}
+
+		got := strings.Join(caps.runnerGroupWarnings(c.policy), "\n")
+		if (c.want == "") != (got == "") || !strings.Contains(got, c.want) {
+			t.Errorf("GHES %q with policy %+v: got warnings %q, want %q", c.version, c.policy, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runnerDeploymentPrefix starts the name of every runner, and its pod, from
+// the arc-runners RunnerDeployment in data/arc.yml.
+const runnerDeploymentPrefix = "arc-runners-"
+
+// runnerDeploymentLabel is the label data/arc.yml gives the deployment's
+// runners, alongside the codespace's name.
+const runnerDeploymentLabel = "arc-runner"
+
+// githubRunner is the subset of a self-hosted runner arc-setup reads.
+type githubRunner struct {
+	ID     int64         `json:"id"`
+	Name   string        `json:"name"`
+	Status string        `json:"status"`
+	Busy   bool          `json:"busy"`
+	Labels []runnerLabel `json:"labels"`
+}
+
+type runnerLabel struct {
+	Name string `json:"name"`
+}
+
+func (r githubRunner) hasLabel(name string) bool {
+	for _, l := range r.Labels {
+		if l.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// orgRunners lists every self-hosted runner registered to org.
+func orgRunners(ctx context.Context, githubHost githubInstance, token, org string) ([]githubRunner, error) {
+	var runners []githubRunner
+	for page := 1; ; page++ {
+		var res struct {
+			TotalCount int            `json:"total_count"`
+			Runners    []githubRunner `json:"runners"`
+		}
+		u := fmt.Sprintf("%v/orgs/%v/actions/runners?per_page=100&page=%v", githubHost.APIURL(), url.PathEscape(org), page)
+		if err := githubRequest(ctx, http.MethodGet, u, token, nil, &res); err != nil {
+			return nil, err
+		}
+
+		runners = append(runners, res.Runners...)
+		if len(res.Runners) == 0 || len(runners) >= res.TotalCount {
+			return runners, nil
+		}
+	}
+}
+
+func deleteOrgRunner(ctx context.Context, githubHost githubInstance, token, org string, id int64) error {
+	u := fmt.Sprintf("%v/orgs/%v/actions/runners/%v", githubHost.APIURL(), url.PathEscape(org), id)
+
+	return githubRequest(ctx, http.MethodDelete, u, token, nil, nil)
+}
+
+func runnersMain(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return usageError("usage: arc-setup runners prune [--dry-run] [--older-than duration] [--codespace name] [--prefix prefix]")
+	}
+
+	flags := flag.NewFlagSet("runners prune", flag.ContinueOnError)
+	opts := pruneOptions{}
+	flags.DurationVar(&opts.olderThan, "older-than", 0, "only delete runners seen offline by an earlier prune at least this long ago")
+	flags.StringVar(&opts.codespace, "codespace", os.Getenv("CODESPACE_NAME"), "only delete runners labelled with this codespace's name")
+	flags.StringVar(&opts.prefix, "prefix", runnerDeploymentPrefix, "only delete runners whose names start with `prefix`")
+	flags.BoolVar(&dryRun, "dry-run", dryRun, "print which runners would be deleted, without deleting them")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+	opts.dryRun = dryRun
+
+	if !opts.dryRun {
+		lock, err := lockData(ctx, LockFileName, "arc-setup runners prune", waitForLock)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	githubHost, err := loadHost()
+	if err != nil {
+		return err
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		return err
+	}
+
+	pods, err := runnerPods(ctx)
+	if err != nil {
+		return err
+	}
+
+	return pruneRunners(ctx, os.Stdout, state, githubHost, vars, pods, opts)
+}
+
+// runnerPods returns the live pods in the runners' namespace. Without a
+// cluster, e.g. after `arc-setup cluster delete`, no runner has a pod.
+func runnerPods(ctx context.Context) (map[string]bool, error) {
+	kube, err := newKubeClient(ctx, "")
+	if err == nil {
+		var pods map[string]bool
+		if pods, err = kube.livePods("arc-runners"); err == nil {
+			return pods, nil
+		}
+	}
+
+	if classifyError(err).Kind != kindClusterUnavailable {
+		return nil, err
+	}
+	logWarnf("The cluster is unavailable, so no runner has a pod: %v", err)
+
+	return map[string]bool{}, nil
+}
+
+// pruneOptions selects which runners `runners prune` deletes.
+type pruneOptions struct {
+	prefix    string
+	codespace string
+	olderThan time.Duration
+	dryRun    bool
+}
+
+// matches reports whether r is one of the RunnerDeployment's runners.
+func (o pruneOptions) matches(r githubRunner) bool {
+	if !strings.HasPrefix(r.Name, o.prefix) || !r.hasLabel(runnerDeploymentLabel) {
+		return false
+	}
+
+	return o.codespace == "" || r.hasLabel(o.codespace)
+}
+
+// pruneRunners deletes the deployment's runners which are offline, have no
+// live pod, and have been offline for opts.olderThan, printing what it did
+// with each of them to w. When each runner was first seen offline is kept in
+// state, except on a dry run.
+func pruneRunners(ctx context.Context, w io.Writer, state *State, githubHost githubInstance, vars Vars, pods map[string]bool, opts pruneOptions) error {
+	if opts.codespace == "" {
+		logWarnf("CODESPACE_NAME is not set, so runners are matched by name and the %v label alone.", runnerDeploymentLabel)
+	}
+
+	token, err := cachedInstallationToken(ctx, githubHost, vars, tokenScope{})
+	if err != nil {
+		return err
+	}
+
+	runners, err := orgRunners(ctx, githubHost, token.Token, vars.Organization)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	offline := map[string]time.Time{}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "RUNNER\tID\tSTATUS\tOFFLINE FOR\tACTION\n")
+
+	var deleted, failed int
+	for _, r := range runners {
+		if !opts.matches(r) {
+			continue
+		}
+
+		id := strconv.FormatInt(r.ID, 10)
+		offlineFor := "-"
+		var action string
+
+		switch {
+		case r.Status != "offline":
+			action = "keep: " + r.Status
+		case r.Busy:
+			action = "keep: busy"
+		case pods[r.Name]:
+			action = "keep: pod is running"
+		default:
+			since, ok := state.OfflineRunners[id]
+			if !ok {
+				since = now
+			}
+			offline[id] = since
+			offlineFor = now.Sub(since).Round(time.Second).String()
+
+			switch {
+			case now.Sub(since) < opts.olderThan:
+				action = fmt.Sprintf("keep: offline for less than %v", opts.olderThan)
+			case opts.dryRun:
+				action = "would delete"
+			default:
+				var gerr *githubError
+				err := deleteOrgRunner(ctx, githubHost, token.Token, vars.Organization, r.ID)
+				if errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound {
+					// Already gone.
+					err = nil
+				}
+				if err != nil {
+					logWarnf("Could not delete runner %v: %v", r.Name, err)
+					action = "delete failed"
+					failed++
+					break
+				}
+				delete(offline, id)
+				action = "deleted"
+				deleted++
+			}
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", r.Name, r.ID, r.Status, offlineFor, action)
+	}
+	tw.Flush()
+
+	if opts.dryRun {
+		return nil
+	}
+
+	logInfof("Deleted %v stale runners from %v.", deleted, vars.Organization)
+
+	state.OfflineRunners = offline
+	if len(offline) == 0 {
+		state.OfflineRunners = nil
+	}
+	if err := state.save(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return errors.New("some stale runners could not be deleted")
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneRunners(t *testing.T) {
+	f := newFakeGitHub(t)
+	setupFake(t, f, ModeLegacy)
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := func(names ...string) []runnerLabel {
+		var l []runnerLabel
+		for _, n := range names {
+			l = append(l, runnerLabel{Name: n})
+		}
+		return l
+	}
+
+	// Enough runners of other deployments to need a second page.
+	for i := 0; i < 120; i++ {
+		f.Runners = append(f.Runners, githubRunner{ID: int64(1000 + i), Name: fmt.Sprintf("other-%v", i), Status: "offline", Labels: labels("self-hosted")})
+	}
+	f.Runners = append(f.Runners,
+		githubRunner{ID: 1, Name: "arc-runners-abc-stale", Status: "offline", Labels: labels("self-hosted", "arc-runner", "cs1")},
+		githubRunner{ID: 2, Name: "arc-runners-abc-online", Status: "online", Labels: labels("self-hosted", "arc-runner", "cs1")},
+		githubRunner{ID: 3, Name: "arc-runners-abc-starting", Status: "offline", Labels: labels("self-hosted", "arc-runner", "cs1")},
+		githubRunner{ID: 4, Name: "arc-runners-abc-elsewhere", Status: "offline", Labels: labels("self-hosted", "arc-runner", "cs2")},
+		githubRunner{ID: 5, Name: "runner-abc", Status: "offline", Labels: labels("self-hosted", "arc-runner", "cs1")},
+		githubRunner{ID: 6, Name: "arc-runners-abc-busy", Status: "offline", Busy: true, Labels: labels("self-hosted", "arc-runner", "cs1")},
+	)
+
+	githubHost, vars, err := tokenCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pods := map[string]bool{"arc-runners-abc-starting": true}
+	opts := pruneOptions{prefix: runnerDeploymentPrefix, codespace: "cs1"}
+
+	prune := func(opts pruneOptions) string {
+		t.Helper()
+
+		state, err := loadState()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := pruneRunners(context.Background(), &out, state, githubHost, vars, pods, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		return out.String()
+	}
+
+	deletes := func() []string {
+		var d []string
+		for _, r := range f.Requests() {
+			if strings.HasPrefix(r, "DELETE /api/v3/orgs/") {
+				d = append(d, r)
+			}
+		}
+		return d
+	}
+
+	dry := opts
+	dry.dryRun = true
+	out := prune(dry)
+	if !strings.Contains(out, "arc-runners-abc-stale") || !strings.Contains(out, "would delete") {
+		t.Errorf("dry run did not list the stale runner:\n%v", out)
+	}
+	for _, name := range []string{"arc-runners-abc-elsewhere", "runner-abc", "other-"} {
+		if strings.Contains(out, name) {
+			t.Errorf("listed %v, which isn't the deployment's:\n%v", name, out)
+		}
+	}
+	if d := deletes(); len(d) > 0 {
+		t.Errorf("dry run deleted runners: %v", d)
+	}
+
+	aged := opts
+	aged.olderThan = time.Hour
+	prune(aged)
+	if d := deletes(); len(d) > 0 {
+		t.Errorf("deleted runners offline for less than an hour: %v", d)
+	}
+
+	state, err := loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.OfflineRunners) != 1 {
+		t.Fatalf("got offline runners %v, want only runner 1 tracked", state.OfflineRunners)
+	}
+	state.OfflineRunners["1"] = time.Now().Add(-2 * time.Hour)
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	out = prune(aged)
+	if d := deletes(); len(d) != 1 || d[0] != "DELETE /api/v3/orgs/acme/actions/runners/1" {
+		t.Errorf("got deletes %v, want only runner 1", d)
+	}
+	if !strings.Contains(out, "deleted") {
+		t.Errorf("output does not say the runner was deleted:\n%v", out)
+	}
+
+	state, err = loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.OfflineRunners != nil {
+		t.Errorf("deleted runners are still tracked: %v", state.OfflineRunners)
+	}
+}
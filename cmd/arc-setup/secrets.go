@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/AlecAivazis/survey/v2"
+)
+
+const (
+	SecretsFileName = "data/secrets.age"
+
+	secretPrivateKey     = "github_app_private_key"
+	secretWebhookSecret  = "github_webhook_secret_token"
+	secretAppID          = "github_app_id"
+	secretInstallationID = "github_app_installation_id"
+)
+
+// SecretsBackend stores the App's credentials somewhere other than plaintext
+// on disk. Values are addressed by refs of the form
+// <backend>:<location>#<key>, which are what arc.env records.
+type SecretsBackend interface {
+	// Name is the ref scheme, and the value of ARC_SECRETS_BACKEND that
+	// selects this backend.
+	Name() string
+
+	// Put stores value under key, returning a ref to it.
+	Put(ctx context.Context, key string, value []byte) (string, error)
+
+	// Ref is the ref Put returns for key, without storing anything.
+	Ref(key string) string
+
+	// Get returns the value at the location and key of a ref.
+	Get(ctx context.Context, location, key string) ([]byte, error)
+
+	// Delete removes key from the location of a ref, doing nothing if it
+	// isn't there.
+	Delete(ctx context.Context, location, key string) error
+}
+
+var secretsBackendNames = []string{"file", "kubernetes", "vault"}
+
+// secretsBackend returns the backend called name. namespace is where the
+// kubernetes backend creates its Secrets.
+func secretsBackend(name, namespace string) (SecretsBackend, error) {
+	switch name {
+	case "file":
+		return &fileSecrets{path: SecretsFileName}, nil
+	case "kubernetes":
+		return &kubernetesSecrets{namespace: namespace}, nil
+	case "vault":
+		return newVaultSecrets()
+	default:
+		return nil, fmt.Errorf("unknown secrets backend %q (must be one of %v)", name, strings.Join(secretsBackendNames, ", "))
+	}
+}
+
+// chooseSecretsBackend picks the backend from ARC_SECRETS_BACKEND, or prompts
+// for it, and saves it to state.
+func chooseSecretsBackend(state *State) (SecretsBackend, error) {
+	if state.SecretsBackend == "" {
+		answer := os.Getenv("ARC_SECRETS_BACKEND")
+		if answer == "" {
+			prompt := &survey.Select{
+				Message: "Where should the GitHub App's private key and webhook secret be stored?",
+				Help:    "file encrypts them into " + SecretsFileName + ". kubernetes writes the Secrets the chart reads directly. vault uses the KV engine at VAULT_ADDR.",
+				Options: secretsBackendNames,
+				Default: "file",
+			}
+			if err := ask(prompt, &answer); err != nil {
+				return nil, err
+			}
+		}
+
+		state.SecretsBackend = answer
+	}
+
+	backend, err := secretsBackend(state.SecretsBackend, secretsNamespace(state.Mode))
+	if err != nil {
+		return nil, err
+	}
+
+	return backend, state.save()
+}
+
+// secretsNamespace is where the chart for mode expects its Secrets.
+func secretsNamespace(mode Mode) string {
+	if mode.NeedsWebhook() {
+		return "actions-runner-system"
+	}
+
+	return scaleSetNamespace
+}
+
+// resolveSecret fetches the value a ref points at.
+func resolveSecret(ctx context.Context, ref string) ([]byte, error) {
+	scheme, rest, ok := cut(ref, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid secret ref %q", ref)
+	}
+
+	location, key, ok := cut(rest, "#")
+	if !ok {
+		return nil, fmt.Errorf("invalid secret ref %q", ref)
+	}
+
+	switch scheme {
+	case "file":
+		return (&fileSecrets{path: location}).Get(ctx, location, key)
+	case "kubernetes":
+		return (&kubernetesSecrets{}).Get(ctx, location, key)
+	case "vault":
+		backend, err := newVaultSecrets()
+		if err != nil {
+			return nil, err
+		}
+
+		return backend.Get(ctx, location, key)
+	case planScheme:
+		return []byte(redacted), nil
+	default:
+		return nil, fmt.Errorf("unknown secret ref scheme %q", scheme)
+	}
+}
+
+// deleteSecret removes the value a ref points at.
+func deleteSecret(ctx context.Context, ref string) error {
+	scheme, rest, ok := cut(ref, ":")
+	if !ok {
+		return fmt.Errorf("invalid secret ref %q", ref)
+	}
+
+	location, key, ok := cut(rest, "#")
+	if !ok {
+		return fmt.Errorf("invalid secret ref %q", ref)
+	}
+
+	switch scheme {
+	case "file":
+		return (&fileSecrets{path: location}).Delete(ctx, location, key)
+	case "kubernetes":
+		return (&kubernetesSecrets{}).Delete(ctx, location, key)
+	case "vault":
+		backend, err := newVaultSecrets()
+		if err != nil {
+			return err
+		}
+
+		return backend.Delete(ctx, location, key)
+	default:
+		return fmt.Errorf("unknown secret ref scheme %q", scheme)
+	}
+}
+
+func cut(s, sep string) (string, string, bool) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+
+	return s[:i], s[i+len(sep):], true
+}
+
+// storeAppSecrets puts the App's private key and webhook secret into
+// backend, recording refs to them in vars.
+func storeAppSecrets(ctx context.Context, backend SecretsBackend, vars *Vars, privateKey []byte, webhookSecret string) error {
+	ref, err := backend.Put(ctx, secretPrivateKey, privateKey)
+	if err != nil {
+		return fmt.Errorf("storing private key: %w", err)
+	}
+	vars.PrivateKeyRef = ref
+	vars.PrivateKey = ""
+
+	if webhookSecret != "" {
+		ref, err := backend.Put(ctx, secretWebhookSecret, []byte(webhookSecret))
+		if err != nil {
+			return fmt.Errorf("storing webhook secret: %w", err)
+		}
+		vars.WebhookSecretRef = ref
+		vars.WebhookSecret = ""
+	}
+
+	return nil
+}
+
+// storeAppIDs puts the App and installation IDs into backend alongside its
+// credentials, as the kubernetes backend's Secrets must be complete for the
+// charts to use them.
+func storeAppIDs(ctx context.Context, backend SecretsBackend, vars Vars) error {
+	if _, err := backend.Put(ctx, secretAppID, []byte(vars.AppID)); err != nil {
+		return fmt.Errorf("storing app id: %w", err)
+	}
+	if _, err := backend.Put(ctx, secretInstallationID, []byte(vars.InstallationID)); err != nil {
+		return fmt.Errorf("storing installation id: %w", err)
+	}
+
+	return nil
+}
+
+// fileSecrets keeps secrets in a JSON object encrypted with age, either to a
+// passphrase (ARC_SECRETS_PASSPHRASE, or prompted for) or to the X25519
+// identity in the file at ARC_SECRETS_IDENTITY, generated if missing.
+type fileSecrets struct {
+	path string
+}
+
+func (*fileSecrets) Name() string { return "file" }
+
+func (f *fileSecrets) Put(_ context.Context, key string, value []byte) (string, error) {
+	values, err := f.load()
+	if err != nil {
+		return "", err
+	}
+
+	values[key] = string(value)
+
+	if err := f.save(values); err != nil {
+		return "", err
+	}
+
+	return f.Ref(key), nil
+}
+
+// save encrypts values into the file, replacing what it held.
+func (f *fileSecrets) save(values map[string]string) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("error encoding secrets: %w", err)
+	}
+
+	recipient, err := secretsRecipient()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return fmt.Errorf("error encrypting secrets: %w", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("error encrypting secrets: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error encrypting secrets: %w", err)
+	}
+
+	if err := files.WriteFile(f.path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("error writing %v: %w", f.path, err)
+	}
+
+	return nil
+}
+
+func (f *fileSecrets) Ref(key string) string { return "file:" + f.path + "#" + key }
+
+func (f *fileSecrets) Get(_ context.Context, _, key string) ([]byte, error) {
+	values, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := values[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %v not found in %v", key, f.path)
+	}
+
+	return []byte(v), nil
+}
+
+func (f *fileSecrets) Delete(_ context.Context, _, key string) error {
+	values, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := values[key]; !ok {
+		return nil
+	}
+
+	delete(values, key)
+
+	return f.save(values)
+}
+
+func (f *fileSecrets) load() (map[string]string, error) {
+	b, err := files.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	identity, err := secretsIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(b), identity)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %v: %w", f.path, err)
+	}
+
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %v: %w", f.path, err)
+	}
+
+	values := map[string]string{}
+	if err := json.Unmarshal(plain, &values); err != nil {
+		return nil, fmt.Errorf("error decoding %v: %w", f.path, err)
+	}
+
+	return values, nil
+}
+
+// scryptWorkFactor is the log2 of the scrypt cost a passphrase is stretched
+// with, age's default.
+var scryptWorkFactor = 18
+
+// secretsPassphrase is remembered so the user is only prompted once per run.
+var secretsPassphrase string
+
+func passphrase() (string, error) {
+	if secretsPassphrase != "" {
+		return secretsPassphrase, nil
+	}
+
+	if v := os.Getenv("ARC_SECRETS_PASSPHRASE"); v != "" {
+		secretsPassphrase = v
+		return v, nil
+	}
+
+	prompt := &survey.Password{
+		Message: "Passphrase for " + SecretsFileName + ":",
+	}
+	if err := ask(prompt, &secretsPassphrase); err != nil {
+		return "", err
+	}
+
+	return secretsPassphrase, nil
+}
+
+func secretsRecipient() (age.Recipient, error) {
+	if path := os.Getenv("ARC_SECRETS_IDENTITY"); path != "" {
+		identity, err := loadOrCreateIdentity(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return identity.Recipient(), nil
+	}
+
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := age.NewScryptRecipient(p)
+	if err != nil {
+		return nil, err
+	}
+	recipient.SetWorkFactor(scryptWorkFactor)
+
+	return recipient, nil
+}
+
+func secretsIdentity() (age.Identity, error) {
+	if path := os.Getenv("ARC_SECRETS_IDENTITY"); path != "" {
+		return loadOrCreateIdentity(path)
+	}
+
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	return age.NewScryptIdentity(p)
+}
+
+func loadOrCreateIdentity(path string) (*age.X25519Identity, error) {
+	b, err := files.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return nil, fmt.Errorf("error generating identity: %w", err)
+		}
+
+		if err := files.WriteFile(path, []byte(identity.String()+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("error writing %v: %w", path, err)
+		}
+
+		return identity, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity %v: %w", path, err)
+	}
+
+	for _, i := range identities {
+		if x, ok := i.(*age.X25519Identity); ok {
+			return x, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no X25519 identity in %v", path)
+}
+
+// kubernetesSecretNames maps keys to the Secrets the charts read them from.
+var kubernetesSecretNames = map[string]string{
+	secretPrivateKey:     "arc-github-app",
+	secretAppID:          "arc-github-app",
+	secretInstallationID: "arc-github-app",
+	secretWebhookSecret:  "arc-webhook-server",
+}
+
+// kubernetesSecrets writes the Secrets consumed by the charts directly, so
+// the credentials never leave the cluster once stored.
+type kubernetesSecrets struct {
+	namespace string
+}
+
+func (*kubernetesSecrets) Name() string { return "kubernetes" }
+
+func (k *kubernetesSecrets) Put(ctx context.Context, key string, value []byte) (string, error) {
+	name, ok := kubernetesSecretNames[key]
+	if !ok {
+		return "", fmt.Errorf("no kubernetes secret for %v", key)
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return "", err
+	}
+
+	ns := kubeObject{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   map[string]interface{}{"name": k.namespace},
+	}
+	if err := kube.apply(ns); err != nil {
+		return "", err
+	}
+
+	// Applying drops keys we owned but omitted, so carry existing ones over.
+	var existing struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := kube.get("v1", "Secret", k.namespace, name, &existing); err != nil && !isNotFound(err) {
+		return "", err
+	}
+
+	data := map[string]interface{}{}
+	for k, v := range existing.Data {
+		data[k] = v
+	}
+	data[key] = base64.StdEncoding.EncodeToString(value)
+
+	secret := kubeObject{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": name, "namespace": k.namespace},
+		"type":       "Opaque",
+		"data":       data,
+	}
+	if err := kube.apply(secret); err != nil {
+		return "", err
+	}
+
+	return k.Ref(key), nil
+}
+
+func (k *kubernetesSecrets) Ref(key string) string {
+	return "kubernetes:" + k.namespace + "/" + kubernetesSecretNames[key] + "#" + key
+}
+
+func (k *kubernetesSecrets) Get(ctx context.Context, location, key string) ([]byte, error) {
+	namespace, name, ok := cut(location, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid kubernetes secret location %q", location)
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var secret struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := kube.get("v1", "Secret", namespace, name, &secret); err != nil {
+		return nil, err
+	}
+
+	v, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("key %v not found in secret %v", key, location)
+	}
+
+	return base64.StdEncoding.DecodeString(v)
+}
+
+func (k *kubernetesSecrets) Delete(ctx context.Context, location, key string) error {
+	namespace, name, ok := cut(location, "/")
+	if !ok {
+		return fmt.Errorf("invalid kubernetes secret location %q", location)
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var existing struct {
+		Data map[string]string `json:"data"`
+	}
+	err = kube.get("v1", "Secret", namespace, name, &existing)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := existing.Data[key]; !ok {
+		return nil
+	}
+
+	// Applying without the key drops it, as we own it.
+	data := map[string]interface{}{}
+	for k, v := range existing.Data {
+		if k != key {
+			data[k] = v
+		}
+	}
+
+	return kube.apply(kubeObject{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+		"type":       "Opaque",
+		"data":       data,
+	})
+}
+
+// vaultSecrets stores secrets in a HashiCorp Vault KV version 2 engine,
+// configured by VAULT_ADDR and VAULT_TOKEN. ARC_VAULT_MOUNT (default secret)
+// and ARC_VAULT_PATH (default arc-setup) pick where.
+type vaultSecrets struct {
+	addr  string
+	token string
+	mount string
+	path  string
+}
+
+func newVaultSecrets() (*vaultSecrets, error) {
+	v := &vaultSecrets{
+		addr:  strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		token: os.Getenv("VAULT_TOKEN"),
+		mount: os.Getenv("ARC_VAULT_MOUNT"),
+		path:  os.Getenv("ARC_VAULT_PATH"),
+	}
+	if v.addr == "" || v.token == "" {
+		return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set to use the vault secrets backend")
+	}
+	if v.mount == "" {
+		v.mount = "secret"
+	}
+	if v.path == "" {
+		v.path = "arc-setup"
+	}
+
+	return v, nil
+}
+
+func (*vaultSecrets) Name() string { return "vault" }
+
+func (v *vaultSecrets) Put(ctx context.Context, key string, value []byte) (string, error) {
+	// KV v2 writes replace the whole secret, so merge with what is there.
+	data, err := v.read(ctx, v.mount, v.path)
+	if err != nil {
+		return "", err
+	}
+	data[key] = string(value)
+
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return "", fmt.Errorf("error encoding vault secret: %w", err)
+	}
+
+	if err := v.do(ctx, http.MethodPost, v.mount, v.path, body, nil); err != nil {
+		return "", err
+	}
+
+	return v.Ref(key), nil
+}
+
+func (v *vaultSecrets) Ref(key string) string { return "vault:" + v.mount + "/" + v.path + "#" + key }
+
+func (v *vaultSecrets) Get(ctx context.Context, location, key string) ([]byte, error) {
+	mount, path, ok := cut(location, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid vault secret location %q", location)
+	}
+
+	data, err := v.read(ctx, mount, path)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return nil, fmt.Errorf("key %v not found in vault secret %v", key, location)
+	}
+
+	return []byte(value), nil
+}
+
+func (v *vaultSecrets) Delete(ctx context.Context, location, key string) error {
+	mount, path, ok := cut(location, "/")
+	if !ok {
+		return fmt.Errorf("invalid vault secret location %q", location)
+	}
+
+	data, err := v.read(ctx, mount, path)
+	if err != nil {
+		return err
+	}
+	if _, ok := data[key]; !ok {
+		return nil
+	}
+	delete(data, key)
+
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return fmt.Errorf("error encoding vault secret: %w", err)
+	}
+
+	return v.do(ctx, http.MethodPost, mount, path, body, nil)
+}
+
+func (v *vaultSecrets) read(ctx context.Context, mount, path string) (map[string]string, error) {
+	var res struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+
+	err := v.do(ctx, http.MethodGet, mount, path, nil, &res)
+	if errors.Is(err, errVaultNotFound) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.Data.Data == nil {
+		return map[string]string{}, nil
+	}
+
+	return res.Data.Data, nil
+}
+
+var errVaultNotFound = errors.New("vault secret not found")
+
+func (v *vaultSecrets) do(ctx context.Context, method, mount, path string, body []byte, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	url := fmt.Sprintf("%v/v1/%v/data/%v", v.addr, mount, path)
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return fmt.Errorf("error building request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request to vault: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errVaultNotFound
+	}
+	if res.StatusCode > 299 || res.StatusCode < 200 {
+		var errs struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&errs)
+
+		return fmt.Errorf("vault %v %v: got status %v: %v", method, url, res.Status, strings.Join(errs.Errors, "; "))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding vault response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useSecretsFiles points the file backend at a filesystem in memory, with a
+// prompter that refuses to ask for a passphrase.
+func useSecretsFiles(t *testing.T) *memFileSystem {
+	t.Helper()
+
+	mem := newMemFileSystem()
+	savedFiles, savedPrompts, savedPassphrase, savedWorkFactor := files, prompts, secretsPassphrase, scryptWorkFactor
+	t.Cleanup(func() {
+		files, prompts, secretsPassphrase, scryptWorkFactor = savedFiles, savedPrompts, savedPassphrase, savedWorkFactor
+	})
+	files, prompts, secretsPassphrase = mem, &scriptedPrompter{answers: map[string]string{}}, ""
+	// Cheap enough to test, as decrypting reads it from the file.
+	scryptWorkFactor = 10
+
+	t.Setenv("ARC_SECRETS_IDENTITY", "")
+	t.Setenv("ARC_SECRETS_PASSPHRASE", "")
+
+	return mem
+}
+
+func TestFileSecretsPassphrase(t *testing.T) {
+	mem := useSecretsFiles(t)
+	t.Setenv("ARC_SECRETS_PASSPHRASE", "correct horse")
+
+	backend := &fileSecrets{path: SecretsFileName}
+
+	if _, err := backend.Get(context.Background(), "", secretPrivateKey); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got error %v from a missing file, want not found", err)
+	}
+
+	ref, err := backend.Put(context.Background(), secretPrivateKey, []byte("-----BEGIN KEY-----\nabc\n-----END KEY-----\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "file:" + SecretsFileName + "#" + secretPrivateKey; ref != want || backend.Ref(secretPrivateKey) != want {
+		t.Errorf("got ref %v, want %v", ref, want)
+	}
+	if _, err := backend.Put(context.Background(), secretWebhookSecret, []byte("hook")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := mem.ReadFile(SecretsFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "hook") || strings.Contains(string(b), "BEGIN KEY") {
+		t.Errorf("%v holds secrets in plaintext", SecretsFileName)
+	}
+
+	// A fresh run, which has to decrypt again.
+	secretsPassphrase = ""
+	got, err := resolveSecret(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "-----BEGIN KEY-----\nabc\n-----END KEY-----\n" {
+		t.Errorf("got private key %q", got)
+	}
+	if got, err := resolveSecret(context.Background(), backend.Ref(secretWebhookSecret)); err != nil || string(got) != "hook" {
+		t.Errorf("got webhook secret %q (error %v), want hook", got, err)
+	}
+
+	secretsPassphrase = ""
+	t.Setenv("ARC_SECRETS_PASSPHRASE", "wrong")
+	if _, err := backend.Get(context.Background(), "", secretPrivateKey); err == nil || !strings.Contains(err.Error(), "error decrypting") {
+		t.Errorf("got error %v with the wrong passphrase, want a decryption error", err)
+	}
+
+	// The identity doesn't open a file encrypted to a passphrase.
+	t.Setenv("ARC_SECRETS_IDENTITY", "data/identity.txt")
+	if _, err := backend.Get(context.Background(), "", secretPrivateKey); err == nil {
+		t.Error("decrypted a passphrase encrypted file with an identity")
+	}
+}
+
+func TestFileSecretsIdentity(t *testing.T) {
+	mem := useSecretsFiles(t)
+	t.Setenv("ARC_SECRETS_IDENTITY", "data/identity.txt")
+
+	backend := &fileSecrets{path: SecretsFileName}
+	ref, err := backend.Put(context.Background(), secretWebhookSecret, []byte("hook"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := mem.ReadFile("data/identity.txt")
+	if err != nil {
+		t.Fatalf("identity was not generated: %v", err)
+	}
+	if !strings.HasPrefix(string(identity), "AGE-SECRET-KEY-") {
+		t.Errorf("got identity %q", identity)
+	}
+
+	if got, err := resolveSecret(context.Background(), ref); err != nil || string(got) != "hook" {
+		t.Errorf("got %q (error %v), want hook", got, err)
+	}
+
+	// Without the identity it falls back to the passphrase, which can't
+	// decrypt a file encrypted to the identity.
+	t.Setenv("ARC_SECRETS_IDENTITY", "")
+	t.Setenv("ARC_SECRETS_PASSPHRASE", "correct horse")
+	if _, err := backend.Get(context.Background(), "", secretWebhookSecret); err == nil || !strings.Contains(err.Error(), "error decrypting") {
+		t.Errorf("got error %v with a passphrase, want a decryption error", err)
+	}
+
+	// Nor can a different identity.
+	t.Setenv("ARC_SECRETS_IDENTITY", "data/other.txt")
+	if _, err := backend.Get(context.Background(), "", secretWebhookSecret); err == nil || !strings.Contains(err.Error(), "error decrypting") {
+		t.Errorf("got error %v with another identity, want a decryption error", err)
+	}
+}
+
+// fakeVault plays a Vault KV version 2 engine.
+type fakeVault struct {
+	*httptest.Server
+
+	token string
+
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+
+	v := &fakeVault{token: "s.root", secrets: map[string]map[string]string{}}
+	v.Server = httptest.NewServer(http.HandlerFunc(v.serveHTTP))
+	t.Cleanup(v.Close)
+
+	t.Setenv("VAULT_ADDR", v.URL)
+	t.Setenv("VAULT_TOKEN", v.token)
+	t.Setenv("ARC_VAULT_MOUNT", "")
+	t.Setenv("ARC_VAULT_PATH", "")
+
+	return v
+}
+
+func (v *fakeVault) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != v.token {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	mount, path, ok := cut(strings.TrimPrefix(r.URL.Path, "/v1/"), "/data/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	key := mount + "/" + path
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := v.secrets[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"data": map[string]interface{}{"data": data}})
+	case http.MethodPost:
+		var body struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.secrets[key] = body.Data
+		writeJSON(w, map[string]interface{}{"data": map[string]interface{}{"version": 1}})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestVaultSecrets(t *testing.T) {
+	v := newFakeVault(t)
+	savedClient := httpClient
+	t.Cleanup(func() { httpClient = savedClient })
+	httpClient = v.Client()
+
+	backend, err := secretsBackend("vault", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.Get(context.Background(), "secret/arc-setup", secretPrivateKey); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got error %v from a missing path, want not found", err)
+	}
+
+	ref, err := backend.Put(context.Background(), secretPrivateKey, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "vault:secret/arc-setup#" + secretPrivateKey; ref != want || backend.Ref(secretPrivateKey) != want {
+		t.Errorf("got ref %v, want %v", ref, want)
+	}
+	if _, err := backend.Put(context.Background(), secretWebhookSecret, []byte("hook")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes replace the whole secret, so the second must have kept the
+	// first.
+	v.mu.Lock()
+	stored := v.secrets["secret/arc-setup"]
+	v.mu.Unlock()
+	if stored[secretPrivateKey] != "key" || stored[secretWebhookSecret] != "hook" {
+		t.Errorf("got stored secret %v, want both keys", stored)
+	}
+
+	if got, err := resolveSecret(context.Background(), ref); err != nil || string(got) != "key" {
+		t.Errorf("got %q (error %v), want key", got, err)
+	}
+
+	if _, err := resolveSecret(context.Background(), "vault:secret/elsewhere#"+secretPrivateKey); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("got error %v from a missing path, want not found", err)
+	}
+
+	if err := deleteSecret(context.Background(), ref); err != nil {
+		t.Fatal(err)
+	}
+	v.mu.Lock()
+	stored = v.secrets["secret/arc-setup"]
+	v.mu.Unlock()
+	if _, ok := stored[secretPrivateKey]; ok || stored[secretWebhookSecret] != "hook" {
+		t.Errorf("got stored secret %v after deleting the private key, want only the webhook secret", stored)
+	}
+
+	t.Setenv("ARC_VAULT_PATH", "custom")
+	backend, err = secretsBackend("vault", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := backend.Put(context.Background(), secretAppID, []byte("42")); err != nil || ref != "vault:secret/custom#"+secretAppID {
+		t.Errorf("got ref %v (error %v), want one under ARC_VAULT_PATH", ref, err)
+	}
+
+	t.Setenv("VAULT_TOKEN", "s.wrong")
+	if _, err := resolveSecret(context.Background(), ref); err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("got error %v with a bad token, want the 403 and its message", err)
+	}
+
+	t.Setenv("VAULT_ADDR", "")
+	if _, err := secretsBackend("vault", ""); err == nil {
+		t.Error("got no error without VAULT_ADDR")
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupFake points arc-setup at f, with its data files in memory, and
+// returns the filesystem and prompter it will use.
+func setupFake(t *testing.T, f *fakeGitHub, mode Mode) (*memFileSystem, *scriptedPrompter) {
+	t.Helper()
+
+	mem := newMemFileSystem()
+	p := &scriptedPrompter{answers: map[string]string{
+		"Which GitHub Org":   f.Org,
+		"Runner Group":       "Default",
+		"repositories may":   runnerGroupUnmanaged,
+		"Installation ID":    "7",
+		"runner scale sets":  "arc-runner-set",
+		"GitHub App ID":      "42",
+		"GitHub App slug":    f.Slug,
+		"downloaded private": "downloads/key.pem",
+	}}
+
+	savedFiles, savedPrompts, savedClient := files, prompts, httpClient
+	savedLog, savedEvents, savedOutput := log.w, eventOutput, output
+	savedIntervals := []time.Duration{codePollInterval, githubRetryDelay, installationPollInterval}
+	savedLimits, savedETags, savedTokenLock := githubLimits, githubETags, tokenCacheLock
+	t.Cleanup(func() {
+		files, prompts, httpClient = savedFiles, savedPrompts, savedClient
+		githubLimits, githubETags, tokenCacheLock = savedLimits, savedETags, savedTokenLock
+		log.w, eventOutput, output = savedLog, savedEvents, savedOutput
+		codePollInterval, githubRetryDelay, installationPollInterval = savedIntervals[0], savedIntervals[1], savedIntervals[2]
+	})
+
+	files, prompts, httpClient = mem, p, f.Client()
+	githubLimits, githubETags = newRateLimiter(), newETagCache()
+	tokenCacheLock = filepath.Join(t.TempDir(), ".tokens.lock")
+	log.w = io.Discard
+	codePollInterval, githubRetryDelay, installationPollInterval = 0, 0, 0
+
+	t.Setenv("ARC_PUBLIC_URL", f.URL)
+	t.Setenv("ARC_SECRETS_IDENTITY", "data/identity.txt")
+	t.Setenv("ARC_SECRETS_PASSPHRASE", "")
+
+	state, err := json.Marshal(State{Mode: mode, SecretsBackend: "file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgs := `[{"role":"admin","state":"active","organization":{"id":1,"login":"` + f.Org + `"}}]`
+
+	for name, data := range map[string][]byte{
+		GitHubHostFile:      []byte(f.Host() + "\n"),
+		GitHubOrgsFile:      []byte(orgs),
+		StateFileName:       state,
+		"downloads/key.pem": f.PEM(),
+	} {
+		if err := mem.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return mem, p
+}
+
+// checkSetup checks setup wrote arc.env, and that the credentials it stored
+// authenticate as the App.
+func checkSetup(t *testing.T, f *fakeGitHub, webhook bool) Vars {
+	t.Helper()
+
+	vars, err := loadVars()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vars.AppID != "42" || vars.InstallationID != "7" || vars.Organization != f.Org || vars.RunnerGroup != "Default" {
+		t.Errorf("unexpected arc.env: %+v", vars)
+	}
+	if want := "https://" + f.Host(); vars.EnterpriseURL != want {
+		t.Errorf("got enterprise URL %q, want %q", vars.EnterpriseURL, want)
+	}
+	if !strings.HasPrefix(vars.PrivateKeyRef, "file:") {
+		t.Errorf("got private key ref %q, want a file ref", vars.PrivateKeyRef)
+	}
+
+	key, err := vars.privateKeyPEM(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, f.PEM()) {
+		t.Error("stored private key does not match the App's")
+	}
+
+	secret, err := vars.webhookSecret(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webhook && secret != f.Secret {
+		t.Errorf("got webhook secret %q, want %q", secret, f.Secret)
+	}
+
+	host, err := parseGitHubHost(f.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newAppClient(context.Background(), host, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := client.app(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.ID != f.AppID {
+		t.Errorf("got App %v, want %v", app.ID, f.AppID)
+	}
+
+	return vars
+}
+
+func TestSetupManifest(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(f *fakeGitHub)
+		err    string
+		kind   errorKind
+
+		// failFast errors must not retry the conversion.
+		failFast bool
+	}{
+		{name: "ok"},
+		{
+			name:   "slow code",
+			script: func(f *fakeGitHub) { f.CodeAfter = 3 },
+		},
+		{
+			name:   "code never arrives",
+			script: func(f *fakeGitHub) { f.CodeAfter = 100 },
+			err:    "failed to fetch exchange token",
+			kind:   kindConversionExpired,
+		},
+		{
+			name:   "5xx during conversion",
+			script: func(f *fakeGitHub) { f.ConversionStatuses = []int{502, 503} },
+		},
+		{
+			name:   "secondary rate limit during conversion",
+			script: func(f *fakeGitHub) { f.ConversionStatuses = []int{403} },
+		},
+		{
+			name:   "conversion keeps failing",
+			script: func(f *fakeGitHub) { f.ConversionStatuses = []int{500, 500, 500, 500, 500} },
+			err:    "500 Internal Server Error",
+			kind:   kindUnknown,
+		},
+		{
+			name:     "expired code",
+			script:   func(f *fakeGitHub) { f.ConversionStatuses = []int{404, 404} },
+			err:      "fake failure",
+			kind:     kindConversionExpired,
+			failFast: true,
+		},
+		{
+			name:   "expired code after 5xx",
+			script: func(f *fakeGitHub) { f.ConversionStatuses = []int{502, 404} },
+			err:    "may have been created",
+			kind:   kindUnknown,
+		},
+		{
+			name:     "invalid manifest",
+			script:   func(f *fakeGitHub) { f.ConversionStatuses = []int{422, 422} },
+			err:      "Unprocessable Entity",
+			kind:     kindValidation,
+			failFast: true,
+		},
+		{
+			name:   "bad JSON",
+			script: func(f *fakeGitHub) { f.ConversionBody = `{"id": 42, "pem": ` },
+			err:    "error decoding response",
+			kind:   kindUnknown,
+		},
+		{
+			name:   "GHES without workflow_job",
+			script: func(f *fakeGitHub) { f.Version = "3.2.0" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGitHub(t)
+			if tt.script != nil {
+				tt.script(f)
+			}
+			_, p := setupFake(t, f, ModeLegacy)
+
+			err := realMain(context.Background())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				if kind := classifyError(err).Kind; kind != tt.kind {
+					t.Errorf("got %v error, want %v", kind, tt.kind)
+				}
+				if tt.failFast {
+					conversions := 0
+					for _, r := range f.Requests() {
+						if strings.HasPrefix(r, "POST /api/v3/app-manifests/") {
+							conversions++
+						}
+					}
+					if conversions != 1 {
+						t.Errorf("tried conversion %v times, want to fail after 1", conversions)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkSetup(t, f, true)
+
+			if p.enters != 1 {
+				t.Errorf("waited for enter %v times, want 1", p.enters)
+			}
+			v, err := parseGHESVersion(f.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := f.payload.Manifest.DefaultEvents, (capabilities{WorkflowJob: v.atLeast(ghesWorkflowJob)}).appEvents(); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("got events %v, want %v", got, want)
+			}
+			if want := f.URL + "/webhook"; f.payload.Manifest.HookAttributes.URL != want {
+				t.Errorf("got hook URL %q, want %q", f.payload.Manifest.HookAttributes.URL, want)
+			}
+		})
+	}
+}
+
+func TestSetupRegistration(t *testing.T) {
+	f := newFakeGitHub(t)
+	_, p := setupFake(t, f, ModeScaleSet)
+
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	vars := checkSetup(t, f, false)
+	if vars.ScaleSets != "arc-runner-set" {
+		t.Errorf("got scale sets %q, want arc-runner-set", vars.ScaleSets)
+	}
+
+	for _, r := range f.Requests() {
+		if strings.HasPrefix(r, "POST /gamf") {
+			t.Errorf("registration made a gamf request: %v", r)
+		}
+	}
+	if p.enters != 0 {
+		t.Errorf("waited for enter %v times, want 0", p.enters)
+	}
+}
+
+func TestSetupDetectsInstallation(t *testing.T) {
+	f := newFakeGitHub(t)
+	f.InstalledAfter = 2
+	_, p := setupFake(t, f, ModeLegacy)
+	delete(p.answers, "Installation ID")
+
+	var events bytes.Buffer
+	output, eventOutput = outputNDJSON, &events
+
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSetup(t, f, true)
+
+	var types []string
+	dec := json.NewDecoder(&events)
+	for dec.More() {
+		var e event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, string(e.Type))
+
+		if e.Type == eventInstallationDetected && e.InstallationID != "7" {
+			t.Errorf("got installation %v, want 7", e.InstallationID)
+		}
+	}
+
+	want := []eventType{eventManifestStarted, eventActionRequired, eventExchangeCodeReceived, eventAppConverted, eventActionRequired, eventInstallationDetected, eventActionRequired, eventEnvWritten}
+	if got := strings.Join(types, ","); got != joinEvents(want) {
+		t.Errorf("got events %v, want %v", got, joinEvents(want))
+	}
+}
+
+func joinEvents(types []eventType) string {
+	s := make([]string, len(types))
+	for i, t := range types {
+		s[i] = string(t)
+	}
+
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+const StateFileName = "data/state.json"
+
+// Mode is the flavour of Actions Runner Controller that arc-setup installs.
+type Mode string
+
+const (
+	// ModeLegacy installs the summerwind actions-runner-controller chart,
+	// RunnerDeployments and a webhook driven HorizontalRunnerAutoscaler.
+	ModeLegacy Mode = "legacy"
+
+	// ModeScaleSet installs gha-runner-scale-set-controller and one
+	// gha-runner-scale-set release per configured scale set. It does not
+	// need a webhook server, ingress or a public URL.
+	ModeScaleSet Mode = "scale-set"
+)
+
+var modes = []Mode{ModeLegacy, ModeScaleSet}
+
+func parseMode(s string) (Mode, error) {
+	for _, m := range modes {
+		if string(m) == s {
+			return m, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown mode %q (must be one of %v)", s, modes)
+}
+
+// NeedsWebhook reports whether the mode relies on GitHub delivering webhooks
+// into the cluster, and so requires gamf, ingress and a public URL.
+func (m Mode) NeedsWebhook() bool {
+	return m != ModeScaleSet
+}
+
+// State is everything arc-setup has decided about this installation that is
+// not a chart value, persisted to StateFileName between runs.
+type State struct {
+	Mode           Mode   `json:"mode,omitempty"`
+	Cluster        string `json:"cluster,omitempty"`
+	SecretsBackend string `json:"secrets_backend,omitempty"`
+
+	// Pending is an App setup created but did not finish.
+	Pending *pendingSetup `json:"pending,omitempty"`
+
+	// OfflineRunners is when `runners prune` first saw each of the
+	// deployment's runners offline, by runner ID, as GitHub doesn't say.
+	OfflineRunners map[string]time.Time `json:"offline_runners,omitempty"`
+}
+
+func loadState() (*State, error) {
+	b, err := files.ReadFile(StateFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error unmarshaling state: %w", err)
+	}
+
+	return &state, nil
+}
+
+func (s *State) save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state: %w", err)
+	}
+
+	if err := files.WriteFile(StateFileName, append(b, '\n'), 0600); err != nil {
+		return fmt.Errorf("error writing %v: %w", StateFileName, err)
+	}
+
+	return nil
+}
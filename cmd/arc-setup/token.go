@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenCacheFileName caches installation tokens between runs, encrypted like
+// SecretsFileName.
+const TokenCacheFileName = "data/tokens.age"
+
+// TokenCacheLockFileName guards TokenCacheFileName, which commands that don't
+// hold LockFileName write to as well. It is a lock of its own so that commands
+// which do hold LockFileName can still cache tokens.
+const TokenCacheLockFileName = "data/.tokens.lock"
+
+// tokenCacheLock is the lock storeToken takes. Tests point it at a temporary
+// directory, as locks are taken on disk rather than through files.
+var tokenCacheLock = TokenCacheLockFileName
+
+// tokenExpiryMargin is how long before it expires a cached token stops being
+// handed out, so it doesn't expire part way through whatever uses it.
+var tokenExpiryMargin = 5 * time.Minute
+
+// tokenScopeFlags are the flags narrowing an installation token.
+type tokenScopeFlags struct {
+	permissions string
+	repos       string
+}
+
+func (t *tokenScopeFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&t.permissions, "permissions", "", "comma separated `name=level` permissions to limit the token to, e.g. contents=read")
+	flags.StringVar(&t.repos, "repos", "", "comma separated repository `names` to limit the token to")
+}
+
+func (t *tokenScopeFlags) scope() (tokenScope, error) {
+	var scope tokenScope
+
+	for _, p := range splitList(t.permissions) {
+		name, level, ok := cut(p, "=")
+		if !ok || name == "" || level == "" {
+			return scope, usageError("invalid permission %q, want name=level", p)
+		}
+		if scope.Permissions == nil {
+			scope.Permissions = map[string]string{}
+		}
+		scope.Permissions[name] = level
+	}
+
+	scope.Repositories = splitList(t.repos)
+
+	return scope, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+func tokenMain(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usageError("usage: arc-setup token app|installation [--permissions name=level,...] [--repos name,...]")
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+
+	switch args[0] {
+	case "app":
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+
+		githubHost, vars, err := tokenCredentials()
+		if err != nil {
+			return err
+		}
+
+		client, err := newAppClient(ctx, githubHost, vars)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(client.jwt)
+
+		return nil
+	case "installation":
+		var scopeFlags tokenScopeFlags
+		scopeFlags.register(flags)
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+
+		scope, err := scopeFlags.scope()
+		if err != nil {
+			return err
+		}
+
+		githubHost, vars, err := tokenCredentials()
+		if err != nil {
+			return err
+		}
+
+		token, err := cachedInstallationToken(ctx, githubHost, vars, scope)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(token.Token)
+
+		return nil
+	default:
+		return usageError("unknown token %q (must be app or installation)", args[0])
+	}
+}
+
+// commandExitError is a command run by exec exiting non-zero, which
+// arc-setup exits with too.
+type commandExitError struct {
+	name string
+	code int
+}
+
+func (e *commandExitError) Error() string {
+	return fmt.Sprintf("%v exited with status %v", e.name, e.code)
+}
+
+// execMain runs a command with an installation token in its environment, as
+// gh and most GitHub tooling read it.
+func execMain(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	var scopeFlags tokenScopeFlags
+	scopeFlags.register(flags)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	command := flags.Args()
+	if len(command) == 0 {
+		return usageError("usage: arc-setup exec [--permissions name=level,...] [--repos name,...] -- command [args...]")
+	}
+
+	scope, err := scopeFlags.scope()
+	if err != nil {
+		return err
+	}
+
+	githubHost, vars, err := tokenCredentials()
+	if err != nil {
+		return err
+	}
+
+	token, err := cachedInstallationToken(ctx, githubHost, vars, scope)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = tokenEnv(os.Environ(), githubHost, token.Token)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		var xerr *exec.ExitError
+		if errors.As(err, &xerr) && xerr.ExitCode() > 0 {
+			return &commandExitError{name: command[0], code: xerr.ExitCode()}
+		}
+
+		return fmt.Errorf("%v: %w", command[0], err)
+	}
+
+	return nil
+}
+
+// tokenEnv is environ with token set as the variables gh, the GitHub
+// Actions toolkit and most other clients read, pointing them at githubHost.
+func tokenEnv(environ []string, githubHost githubInstance, token string) []string {
+	set := map[string]string{
+		"GH_TOKEN":     token,
+		"GITHUB_TOKEN": token,
+		"GH_HOST":      githubHost.Name(),
+	}
+	if githubHost.IsGHES() {
+		set["GH_ENTERPRISE_TOKEN"] = token
+		set["GITHUB_ENTERPRISE_TOKEN"] = token
+	}
+
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := cut(kv, "=")
+		if _, ok := set[name]; !ok {
+			env = append(env, kv)
+		}
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+set[name])
+	}
+
+	return env
+}
+
+// tokenCredentials reads the App's credentials from arc.env, or from state if
+// setup was interrupted before writing it.
+func tokenCredentials() (githubInstance, Vars, error) {
+	githubHost, err := loadHost()
+	if err != nil {
+		return githubHost, Vars{}, err
+	}
+
+	vars, err := loadVars()
+	if !errors.Is(err, fs.ErrNotExist) {
+		return githubHost, vars, err
+	}
+
+	state, stateErr := loadState()
+	if stateErr != nil || state.Pending == nil || state.Pending.AppID == "" {
+		return githubHost, vars, err
+	}
+	logInfof("Using App %v from the setup that was interrupted.", state.Pending.AppSlug)
+
+	return githubHost, state.Pending.vars(githubHost), nil
+}
+
+// cachedInstallationToken returns an installation token for vars' App
+// narrowed to scope, reusing one from TokenCacheFileName until shortly before
+// it expires. Tokens are only cached when the App's private key is in the
+// file secrets backend, which already decrypts SecretsFileName; the other
+// backends would need a passphrase just for the cache.
+func cachedInstallationToken(ctx context.Context, githubHost githubInstance, vars Vars, scope tokenScope) (installationToken, error) {
+	id, err := strconv.ParseInt(vars.InstallationID, 10, 64)
+	if err != nil {
+		return installationToken{}, fmt.Errorf("%v has no valid installation ID (%q); install the App and run arc-setup again", VarFileName, vars.InstallationID)
+	}
+
+	var cache *fileSecrets
+	if strings.HasPrefix(vars.PrivateKeyRef, "file:") {
+		cache = &fileSecrets{path: TokenCacheFileName}
+	}
+	key := tokenCacheKey(githubHost, vars.AppID, id, scope)
+
+	if cache != nil {
+		if token, ok := lookupToken(ctx, cache, key); ok {
+			logDebugf("Using the cached installation token, which expires at %v.", token.ExpiresAt.Local().Format(time.Kitchen))
+			return token, nil
+		}
+	}
+
+	client, err := newAppClient(ctx, githubHost, vars)
+	if err != nil {
+		return installationToken{}, err
+	}
+
+	token, err := client.installationToken(ctx, id, scope)
+	if err != nil {
+		return installationToken{}, err
+	}
+
+	if cache != nil {
+		if err := storeToken(ctx, cache, key, token); err != nil {
+			logWarnf("Could not cache the installation token: %v", err)
+		}
+	}
+
+	return token, nil
+}
+
+// tokenCacheKey identifies tokens which are interchangeable.
+func tokenCacheKey(githubHost githubInstance, appID string, id int64, scope tokenScope) string {
+	permissions := make([]string, 0, len(scope.Permissions))
+	for name, level := range scope.Permissions {
+		permissions = append(permissions, name+"="+level)
+	}
+	sort.Strings(permissions)
+
+	repos := append([]string(nil), scope.Repositories...)
+	sort.Strings(repos)
+
+	return fmt.Sprintf("%v/apps/%v/installations/%v?permissions=%v&repos=%v", githubHost.Name(), appID, id, strings.Join(permissions, ","), strings.Join(repos, ","))
+}
+
+func lookupToken(ctx context.Context, cache *fileSecrets, key string) (installationToken, bool) {
+	var token installationToken
+
+	b, err := cache.Get(ctx, "", key)
+	if err != nil {
+		return token, false
+	}
+	if err := json.Unmarshal(b, &token); err != nil {
+		return token, false
+	}
+
+	return token, time.Until(token.ExpiresAt) > tokenExpiryMargin
+}
+
+// storeToken adds token to the cache, dropping any that have expired. It
+// waits for any other arc-setup storing a token, so neither loses the other's.
+func storeToken(ctx context.Context, cache *fileSecrets, key string, token installationToken) error {
+	lock, err := lockData(ctx, tokenCacheLock, "arc-setup token cache", true)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	values, err := cache.load()
+	if err != nil {
+		return err
+	}
+
+	for k, v := range values {
+		var cached installationToken
+		if json.Unmarshal([]byte(v), &cached) != nil || time.Now().After(cached.ExpiresAt) {
+			delete(values, k)
+		}
+	}
+
+	b, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("error encoding token: %w", err)
+	}
+	values[key] = string(b)
+
+	return cache.save(values)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachedInstallationToken(t *testing.T) {
+	f := newFakeGitHub(t)
+	mem, _ := setupFake(t, f, ModeLegacy)
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	githubHost, vars, err := tokenCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenRequests := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		return len(f.TokenScopes)
+	}
+
+	// Setup itself uses an unscoped token, for the runner group.
+	before := tokenRequests()
+	scope := tokenScope{Permissions: map[string]string{"contents": "read"}, Repositories: []string{"b", "a"}}
+	for i := 0; i < 2; i++ {
+		token, err := cachedInstallationToken(context.Background(), githubHost, vars, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Token != fakeInstallationToken {
+			t.Errorf("got token %q, want %q", token.Token, fakeInstallationToken)
+		}
+	}
+	if n := tokenRequests() - before; n != 1 {
+		t.Errorf("got %v token requests, want the second served from the cache", n)
+	}
+	f.mu.Lock()
+	if got := f.TokenScopes[before]; !reflect.DeepEqual(got, scope) {
+		t.Errorf("requested %+v, want %+v", got, scope)
+	}
+	f.mu.Unlock()
+
+	b, err := mem.ReadFile(TokenCacheFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), fakeInstallationToken) {
+		t.Errorf("%v holds the token in plaintext", TokenCacheFileName)
+	}
+
+	if _, err := cachedInstallationToken(context.Background(), githubHost, vars, tokenScope{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := tokenRequests(); n != 2 {
+		t.Errorf("got %v token requests, want a differently scoped token requested", n)
+	}
+
+	saved := tokenExpiryMargin
+	tokenExpiryMargin = 2 * time.Hour
+	defer func() { tokenExpiryMargin = saved }()
+	if _, err := cachedInstallationToken(context.Background(), githubHost, vars, scope); err != nil {
+		t.Fatal(err)
+	}
+	if n := tokenRequests(); n != 3 {
+		t.Errorf("got %v token requests, want a token about to expire replaced", n)
+	}
+}
+
+func TestStoreTokenConcurrently(t *testing.T) {
+	f := newFakeGitHub(t)
+	mem, _ := setupFake(t, f, ModeLegacy)
+
+	// Each store reads the cache, adds its token and writes it back, so
+	// without the lock they overwrite each other's tokens. Slow writes make
+	// sure they would overlap.
+	files = slowWrites{mem}
+
+	saved := lockPollInterval
+	lockPollInterval = time.Millisecond
+	defer func() { lockPollInterval = saved }()
+	cache := &fileSecrets{path: TokenCacheFileName}
+	token := installationToken{Token: fakeInstallationToken, ExpiresAt: time.Now().Add(time.Hour)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- storeToken(context.Background(), &fileSecrets{path: TokenCacheFileName}, fmt.Sprint(i), token)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		if _, ok := lookupToken(context.Background(), cache, fmt.Sprint(i)); !ok {
+			t.Errorf("token %v was lost", i)
+		}
+	}
+}
+
+// slowWrites delays every write to a filesystem.
+type slowWrites struct{ fileSystem }
+
+func (s slowWrites) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	time.Sleep(10 * time.Millisecond)
+
+	return s.fileSystem.WriteFile(name, data, perm)
+}
+
+func TestTokenScopeFlags(t *testing.T) {
+	scope, err := (&tokenScopeFlags{permissions: "contents=read, issues=write", repos: "a,,b"}).scope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tokenScope{Permissions: map[string]string{"contents": "read", "issues": "write"}, Repositories: []string{"a", "b"}}
+	if !reflect.DeepEqual(scope, want) {
+		t.Errorf("got %+v, want %+v", scope, want)
+	}
+
+	_, err = (&tokenScopeFlags{permissions: "contents"}).scope()
+	var serr *setupError
+	if !errors.As(err, &serr) || serr.Kind != kindUsage {
+		t.Errorf("got error %v, want a usage error", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	f := newFakeGitHub(t)
+	setupFake(t, f, ModeLegacy)
+	if err := realMain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GH_TOKEN", "stale")
+	script := `test "$GH_TOKEN" = ` + fakeInstallationToken + ` && test "$GITHUB_TOKEN" = "$GH_ENTERPRISE_TOKEN" && test "$GH_HOST" = ` + f.Host()
+	if err := execMain(context.Background(), []string{"--", "sh", "-c", script}); err != nil {
+		t.Fatalf("token was not in the environment: %v", err)
+	}
+
+	err := execMain(context.Background(), []string{"--permissions", "contents=read", "--", "sh", "-c", "exit 3"})
+	var cerr *commandExitError
+	if !errors.As(err, &cerr) || cerr.code != 3 {
+		t.Errorf("got error %v, want exit status 3", err)
+	}
+}
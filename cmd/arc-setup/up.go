@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+
+	env "github.com/Netflix/go-env"
+)
+
+// upMain brings up a complete Actions Runner Controller installation,
+// replacing script/install.sh. Every step checks live state first, so it is
+// safe to re-run after a failure or on an existing installation.
+func upMain(ctx context.Context, args []string) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	defaultCluster := os.Getenv("ARC_CLUSTER")
+	if defaultCluster == "" {
+		defaultCluster = state.Cluster
+	}
+	if defaultCluster == "" {
+		defaultCluster = "minikube"
+	}
+
+	flags := flag.NewFlagSet("up", flag.ContinueOnError)
+	clusterName := flags.String("cluster", defaultCluster, "cluster provider: minikube, kind, k3d or existing")
+	retries := flags.Int("retries", 2, "times to retry a failed step")
+	flags.BoolVar(&dryRun, "dry-run", dryRun, "print what up would do, without doing it")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	provider, err := clusterProvider(*clusterName)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		return planMain(ctx, os.Stdout, provider)
+	}
+
+	lock, err := lockData(ctx, LockFileName, "arc-setup up", waitForLock)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	// Another arc-setup may have changed state while we waited.
+	if state, err = loadState(); err != nil {
+		return err
+	}
+
+	if state.Mode == "" {
+		if err := chooseMode(ctx, state); err != nil {
+			return err
+		}
+	}
+
+	results, err := runPipeline(ctx, upSteps(ctx, state, provider, *retries))
+	fmt.Fprintln(humanOutput())
+	printStepSummary(humanOutput(), results)
+
+	return err
+}
+
+func upSteps(ctx context.Context, state *State, provider ClusterProvider, retries int) []step {
+	steps := []step{
+		{
+			name:        "tools",
+			interactive: true,
+			done:        func() (bool, error) { return len(missingTools(state, provider)) == 0, nil },
+			run: func(w io.Writer) error {
+				fmt.Fprintf(w, "ℹ Missing %v, running bootstrap...\n", strings.Join(missingTools(state, provider), ", "))
+
+				cmd := exec.CommandContext(ctx, "./script/bootstrap.sh")
+				cmd.Env = append(os.Environ(), "ARC_CLUSTER="+provider.Name())
+				cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, w, w
+
+				return cmd.Run()
+			},
+		},
+		{
+			name:    "cluster",
+			deps:    []string{"tools"},
+			retries: retries,
+			done: func() (bool, error) {
+				status, err := provider.Status(ctx)
+				if err != nil {
+					return false, err
+				}
+
+				return status.Running && state.Cluster == provider.Name(), nil
+			},
+			run: func(w io.Writer) error {
+				if err := provider.Create(ctx); err != nil {
+					return err
+				}
+
+				state.Cluster = provider.Name()
+
+				return state.save()
+			},
+		},
+		{
+			name:        "github-login",
+			deps:        []string{"tools"},
+			interactive: true,
+			done: func() (bool, error) {
+				_, err := commandOutput(ctx, "gh", "auth", "status")
+				return err == nil, nil
+			},
+			run: func(w io.Writer) error {
+				cmd := exec.CommandContext(ctx, "gh", "auth", "login")
+				cmd.Env = append(os.Environ(), "GITHUB_TOKEN=", "BROWSER=echo")
+				cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, w, w
+
+				return cmd.Run()
+			},
+		},
+		{
+			name:    "github-host",
+			deps:    []string{"github-login"},
+			retries: retries,
+			done:    func() (bool, error) { return fileExists(GitHubHostFile) },
+			run: func(w io.Writer) error {
+				out, err := ghOutput(ctx, "api", "/", "--jq", ".current_user_url")
+				if err != nil {
+					return err
+				}
+
+				host, err := parseGitHubHost(out)
+				if err != nil {
+					return err
+				}
+
+				if _, err := host.verify(ctx); err != nil {
+					return err
+				}
+
+				return files.WriteFile(GitHubHostFile, []byte(host.Name()+"\n"), 0644)
+			},
+		},
+		{
+			name:    "github-orgs",
+			deps:    []string{"github-login"},
+			retries: retries,
+			done:    func() (bool, error) { return fileExists(GitHubOrgsFile) },
+			run: func(w io.Writer) error {
+				out, err := ghOutput(ctx, "api", "/user/memberships/orgs?state=active")
+				if err != nil {
+					return err
+				}
+
+				return files.WriteFile(GitHubOrgsFile, []byte(out+"\n"), 0644)
+			},
+		},
+	}
+
+	appDeps := []string{"cluster", "github-host", "github-orgs"}
+
+	if state.Mode.NeedsWebhook() {
+		appDeps = append(appDeps, "gamf")
+
+		steps = append(steps,
+			step{
+				name:    "public-port",
+				deps:    []string{"tools"},
+				retries: retries,
+				done:    func() (bool, error) { return publicPortDone(ctx) },
+				run: func(w io.Writer) error {
+					return runCommandTo(ctx, w, "gh", "cs", "ports", "visibility", "80:public", "-c", os.Getenv("CODESPACE_NAME"))
+				},
+			},
+			step{
+				name: "tunnel",
+				deps: []string{"cluster"},
+				done: func() (bool, error) {
+					_, err := commandOutput(ctx, "overmind", "status")
+					return err == nil, nil
+				},
+				run: func(w io.Writer) error {
+					return runCommandTo(ctx, w, "overmind", "start", "-D")
+				},
+			},
+			helmStep(ctx, ingressNginxRelease(), retries, []string{"cluster"}),
+			helmStep(ctx, certManagerRelease(), retries, []string{"cluster"}),
+			step{
+				name:    "gamf",
+				deps:    []string{"ingress-nginx", "tunnel", "public-port", "github-host"},
+				retries: retries,
+				done: func() (bool, error) {
+					kube, err := newKubeClient(ctx, "")
+					if err != nil {
+						return false, err
+					}
+
+					return kube.deploymentAvailable(kube.namespace, "gamf")
+				},
+				run: func(w io.Writer) error {
+					return applyTemplate(ctx, w, "data/gamf.yml")
+				},
+			},
+		)
+	} else {
+		steps = append(steps,
+			helmStep(ctx, scaleSetControllerHelmRelease(), retries, []string{"cluster"}),
+		)
+	}
+
+	steps = append(steps, step{
+		name:        "app",
+		deps:        appDeps,
+		interactive: true,
+		done:        func() (bool, error) { return appDone(ctx) },
+		run: func(w io.Writer) error {
+			fmt.Fprintf(w, "ℹ We need some additional information to create the Actions Runner Controller GitHub App.\n")
+
+			return realMain(ctx)
+		},
+	})
+
+	if state.Mode.NeedsWebhook() {
+		steps = append(steps,
+			step{
+				name:    "actions-runner-controller",
+				deps:    []string{"app", "cert-manager"},
+				retries: retries,
+				done: func() (bool, error) {
+					return helmReleaseDeployed(ctx, "actions-runner-system", "actions-runner-controller"), nil
+				},
+				run: func(w io.Writer) error {
+					vars, err := loadVars()
+					if err != nil {
+						return err
+					}
+
+					release, err := arcRelease(ctx, vars)
+					if err != nil {
+						return err
+					}
+
+					if err := applyCABundle(ctx, w, "actions-runner-system", "arc-runners"); err != nil {
+						return err
+					}
+
+					return release.install(ctx, w)
+				},
+			},
+			step{
+				name:    "runners",
+				deps:    []string{"actions-runner-controller", "ingress-nginx"},
+				retries: retries,
+				done: func() (bool, error) {
+					return manifestsExist(ctx, "data/arc.yml")
+				},
+				run: func(w io.Writer) error {
+					return applyTemplate(ctx, w, "data/arc.yml")
+				},
+			},
+		)
+	} else {
+		steps = append(steps,
+			step{
+				name:    "gha-runner-scale-sets",
+				deps:    []string{"app", "gha-runner-scale-set-controller"},
+				retries: retries,
+				done: func() (bool, error) {
+					vars, err := loadVars()
+					if err != nil {
+						return false, err
+					}
+
+					for _, name := range splitScaleSets(vars.ScaleSets) {
+						if !helmReleaseDeployed(ctx, "arc-runners", name) {
+							return false, nil
+						}
+					}
+
+					return true, nil
+				},
+				run: func(w io.Writer) error {
+					vars, err := loadVars()
+					if err != nil {
+						return err
+					}
+
+					if err := applyCABundle(ctx, w, scaleSetNamespace); err != nil {
+						return err
+					}
+
+					for _, name := range splitScaleSets(vars.ScaleSets) {
+						fmt.Fprintf(w, "ℹ Installing runner scale set %v...\n", name)
+
+						release, err := scaleSetHelmRelease(ctx, vars, name)
+						if err != nil {
+							return err
+						}
+						if err := release.install(ctx, w); err != nil {
+							return err
+						}
+					}
+
+					return nil
+				},
+			},
+		)
+	}
+
+	return steps
+}
+
+// missingTools lists the binaries the pipeline needs which are not on PATH.
+func missingTools(state *State, provider ClusterProvider) []string {
+	tools := []string{"kubectl", "helm", "gh", "jq"}
+	if provider.Name() != "existing" {
+		tools = append(tools, provider.Name())
+	}
+	if state.Mode.NeedsWebhook() {
+		tools = append(tools, "socat", "overmind")
+	}
+
+	var missing []string
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+
+	return missing
+}
+
+// appDone reports whether arc.env describes a usable App. An arc.env whose
+// private key has gone missing (e.g. a temporary file lost on reboot) is an
+// error rather than not done, as re-running would create a second App.
+func appDone(ctx context.Context) (bool, error) {
+	ok, err := fileExists(VarFileName)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	vars, err := loadVars()
+	if err != nil {
+		return false, err
+	}
+
+	if vars.AppID == "" || vars.InstallationID == "" {
+		return false, fmt.Errorf("%v is incomplete, remove it to create a new App", VarFileName)
+	}
+
+	if _, err := vars.privateKeyPEM(ctx); err != nil {
+		return false, fmt.Errorf("private key from %v is unavailable, remove %v to create a new App: %w", VarFileName, VarFileName, err)
+	}
+
+	return true, nil
+}
+
+func publicPortDone(ctx context.Context) (bool, error) {
+	out, err := commandOutput(ctx, "gh", "cs", "ports", "-c", os.Getenv("CODESPACE_NAME"), "--json", "sourcePort,visibility")
+	if err != nil {
+		return false, nil
+	}
+
+	var ports []struct {
+		SourcePort int    `json:"sourcePort"`
+		Visibility string `json:"visibility"`
+	}
+	if err := json.Unmarshal([]byte(out), &ports); err != nil {
+		return false, fmt.Errorf("error decoding codespace ports: %w", err)
+	}
+
+	for _, p := range ports {
+		if p.SourcePort == 80 && p.Visibility == "public" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// helmStep installs release, named after it.
+func helmStep(ctx context.Context, release helmRelease, retries int, deps []string) step {
+	return step{
+		name:    release.Name,
+		deps:    deps,
+		retries: retries,
+		done: func() (bool, error) {
+			return release.deployed(ctx), nil
+		},
+		run: func(w io.Writer) error {
+			return release.install(ctx, w)
+		},
+	}
+}
+
+// manifestsExist reports whether every object in the rendered template at
+// path exists in the cluster.
+func manifestsExist(ctx context.Context, path string) (bool, error) {
+	objs, err := renderManifests(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return false, err
+	}
+
+	for _, obj := range objs {
+		ok, err := kube.exists(obj.apiVersion(), obj.kind(), obj.namespace(), obj.name())
+		if err != nil || !ok {
+			// a missing CRD means the object can't exist yet either
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// templateVars returns arc.env, if it exists yet, as a map for
+// renderTemplate.
+func templateVars() (map[string]string, error) {
+	vars := map[string]string{}
+
+	if ok, _ := fileExists(VarFileName); ok {
+		v, err := loadVars()
+		if err != nil {
+			return nil, err
+		}
+
+		es, err := env.Marshal(&v)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding to env: %w", err)
+		}
+		for k, v := range es {
+			vars[k] = v
+		}
+	}
+
+	return vars, nil
+}
+
+// renderManifests renders the template at path, adjusted for the CA bundle
+// and the GitHub instance's capabilities.
+func renderManifests(ctx context.Context, path string) ([]kubeObject, error) {
+	vars, err := templateVars()
+	if err != nil {
+		return nil, err
+	}
+
+	githubHost, err := loadHost()
+	if err != nil {
+		return nil, err
+	}
+
+	caps, err := detectCapabilities(ctx, githubHost)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderManifestsWith(path, vars, caps)
+}
+
+// renderManifestsWith is renderManifests with the template variables and
+// capabilities given, rather than read from data/.
+func renderManifestsWith(path string, vars map[string]string, caps capabilities) ([]kubeObject, error) {
+	manifests, err := renderTemplate(path, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	objs, err := parseManifests(manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	withCABundle(objs)
+	withPullMetrics(objs, caps)
+
+	return objs, nil
+}
+
+// applyTemplate renders the manifests at path and server-side applies them.
+func applyTemplate(ctx context.Context, w io.Writer, path string) error {
+	objs, err := renderManifests(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	kube, err := newKubeClient(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	return kube.applyObjects(w, objs)
+}
+
+func ghOutput(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "gh", args...)
+	cmd.Env = append(os.Environ(), "GITHUB_TOKEN=")
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("gh %v: %w", strings.Join(args, " "), err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func fileExists(path string) (bool, error) {
+	_, err := files.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -2,18 +2,32 @@
 
 set -euo pipefail
 
-# install tmux, socat
-echo "ℹ Installing tmux, socat..."
-sudo apt-get -q install -y socat tmux
+# install tmux, socat, jq
+echo "ℹ Installing tmux, socat, jq..."
+sudo apt-get -q install -y socat tmux jq
 
 # install minikube
-if [[ ! -f /usr/local/bin/minikube ]]; then
+if [[ "${ARC_CLUSTER:-minikube}" == "minikube" && ! -f /usr/local/bin/minikube ]]; then
   echo "ℹ Installing minikube..."
   curl -LO --silent https://storage.googleapis.com/minikube/releases/latest/minikube-linux-amd64
   chmod +x minikube-linux-amd64
   sudo mv minikube-linux-amd64 /usr/local/bin/minikube
 fi
 
+# install kind
+if [[ "${ARC_CLUSTER:-minikube}" == "kind" && ! -f /usr/local/bin/kind ]]; then
+  echo "ℹ Installing kind..."
+  curl -Lo kind --silent https://kind.sigs.k8s.io/dl/v0.20.0/kind-linux-amd64
+  chmod +x kind
+  sudo mv kind /usr/local/bin/kind
+fi
+
+# install k3d
+if [[ "${ARC_CLUSTER:-minikube}" == "k3d" && ! -f /usr/local/bin/k3d ]]; then
+  echo "ℹ Installing k3d..."
+  curl --silent https://raw.githubusercontent.com/k3d-io/k3d/main/install.sh | bash
+fi
+
 # install overmind
 if [[ ! -f /usr/local/bin/overmind ]]; then
   echo "ℹ Installing overmind..."
@@ -28,6 +42,3 @@ if [[ ! -f /usr/local/bin/helm ]]; then
   echo "ℹ Installing helm..."
   curl --silent https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | bash
 fi
-
-echo "ℹ Exposing our codespaces port publicly..."
-gh cs ports visibility 80:public -c "${CODESPACE_NAME}"
@@ -2,9 +2,7 @@
 
 set -euo pipefail
 
-./script/bootstrap.sh
-./script/start.sh
-./script/configure.sh
+go run ./cmd/arc-setup up
 
 echo
 echo
@@ -13,7 +11,11 @@ echo "ℹ The following workflow file can be used in order to test it out:"
 echo
 echo
 
-./script/subst.sh ./data/workflow.yml
+if [[ "$(./script/mode.sh)" == "scale-set" ]]; then
+  ARC_RUNNER_SCALE_SET_NAME="$(./script/scale-sets.sh | head -n 1)" ./script/subst.sh ./data/workflow-scale-set.yml
+else
+  ./script/subst.sh ./data/workflow.yml
+fi
 
 echo
 echo
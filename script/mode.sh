@@ -0,0 +1,6 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# print the Actions Runner Controller mode recorded by `arc-setup mode`
+jq -r '.mode // "legacy"' data/state.json
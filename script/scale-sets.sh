@@ -0,0 +1,6 @@
+#!/bin/bash
+
+set -euo pipefail
+
+# print the configured runner scale set names, one per line
+echo '${ARC_RUNNER_SCALE_SETS}' | script/subst.sh /dev/stdin | tr ',' '\n'
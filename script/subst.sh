@@ -1,7 +1,6 @@
 #!/bin/bash
 
-set -a
-source data/arc.env
-set +a
+set -euo pipefail
 
-envsubst < "${1}"
+# render a template with the values from data/arc.env, without sourcing it
+go run ./cmd/arc-setup render "${1}"